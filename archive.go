@@ -0,0 +1,171 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// A result is the outcome of restructuring one control flow graph of a batch
+// (e.g. an entry of an archive).
+type result struct {
+	// Located control flow primitives, on success.
+	Prims []*Primitive `json:"prims,omitempty"`
+	// Error message, on failure.
+	Error string `json:"error,omitempty"`
+}
+
+// checkArchive reports an error if output of the reduction itself is requested
+// in combination with the "-archive" flag, as each entry is restructured
+// separately and such output would only describe the last entry.
+func checkArchive() error {
+	if len(flagDiagnostics) > 0 || len(flagDumpGraph) > 0 || len(flagExceptionEdges) > 0 || len(flagStats) > 0 {
+		return errutil.New("-archive does not support -diagnostics, -dump-graph, -exception-edges or -stats")
+	}
+	return nil
+}
+
+// restructureArchive restructures each control flow graph (*.dot, or *.json if
+// specified by the "-input" flag) of the given zip or tar archive, and returns
+// the results keyed by entry name. Entries of nested directories are included,
+// and other entries are skipped. The format of the archive is determined by its
+// file extension; ".zip" for zip archives, and ".tar", ".tar.gz" or ".tgz" for
+// (optionally gzip-compressed) tar archives.
+func restructureArchive(archivePath string) (map[string]*result, error) {
+	results := make(map[string]*result)
+	visit := func(name string, r io.Reader) error {
+		if path.Ext(name) != inputExt() {
+			return nil
+		}
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			return errutil.Err(err)
+		}
+		results[name] = restructureEntry(name, buf)
+		return nil
+	}
+	var err error
+	switch {
+	case strings.HasSuffix(archivePath, ".zip"):
+		err = walkZip(archivePath, visit)
+	case strings.HasSuffix(archivePath, ".tar"):
+		err = walkTar(archivePath, false, visit)
+	case strings.HasSuffix(archivePath, ".tar.gz"), strings.HasSuffix(archivePath, ".tgz"):
+		err = walkTar(archivePath, true, visit)
+	default:
+		return nil, errutil.Newf("unable to determine archive format of %q", archivePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// inputExt returns the file extension of control flow graphs in the input
+// format specified by the "-input" flag.
+func inputExt() string {
+	if flagInput == inputJSON {
+		return ".json"
+	}
+	return ".dot"
+}
+
+// restructureEntry restructures the control flow graph of the given archive
+// entry contents, parsed as described by parseGraph.
+func restructureEntry(name string, buf []byte) *result {
+	graph, err := parseGraphData(name, buf)
+	if err != nil {
+		return &result{Error: err.Error()}
+	}
+	prims, err := Restructure(graph)
+	if err != nil {
+		warnf("unreduced", nil, "unable to restructure %q; %v", name, err)
+		return &result{Error: err.Error()}
+	}
+	return &result{Prims: prims}
+}
+
+// walkZip invokes visit for each regular file entry of the given zip archive,
+// skipping entries not modified since the time of incremental mode.
+func walkZip(archivePath string, visit func(name string, r io.Reader) error) error {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || !changed(f.FileInfo().ModTime()) {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return errutil.Err(err)
+		}
+		err = visit(f.Name, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkTar invokes visit for each regular file entry of the given tar archive,
+// which is gzip-compressed if compressed is true, skipping entries not modified
+// since the time of incremental mode.
+func walkTar(archivePath string, compressed bool, visit func(name string, r io.Reader) error) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if compressed {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return errutil.Err(err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errutil.Err(err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if !changed(hdr.ModTime) {
+			continue
+		}
+		if err := visit(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// writeResults writes the given results to w as a JSON object keyed by name.
+func writeResults(w io.Writer, results map[string]*result) error {
+	if flagIndent {
+		buf, err := json.MarshalIndent(results, "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(buf, '\n'))
+		return err
+	}
+	return json.NewEncoder(w).Encode(results)
+}
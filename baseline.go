@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// loadPrims loads control flow primitives from the given JSON file.
+func loadPrims(path string) ([]*Primitive, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	var prims []*Primitive
+	if err := json.Unmarshal(buf, &prims); err != nil {
+		return nil, errutil.Newf("unable to parse primitives of %q; %v", path, err)
+	}
+	return prims, nil
+}
+
+// A primDiff describes a difference between baseline and current control flow
+// primitives.
+type primDiff struct {
+	// Baseline primitive; nil if added.
+	old *Primitive
+	// Current primitive; nil if removed.
+	new *Primitive
+	// Canonical forms of the primitive trees rooted at old and new.
+	oldCanon, newCanon string
+}
+
+// String returns a human-readable description of the difference.
+func (d *primDiff) String() string {
+	switch {
+	case d.old == nil:
+		return fmt.Sprintf("added: %s %s", d.new.Node, d.newCanon)
+	case d.new == nil:
+		return fmt.Sprintf("removed: %s %s", d.old.Node, d.oldCanon)
+	default:
+		return fmt.Sprintf("changed: %s %s -> %s %s", d.old.Node, d.oldCanon, d.new.Node, d.newCanon)
+	}
+}
+
+// diffPrims compares the current control flow primitives against the baseline
+// primitives, and returns their differences.
+//
+// Primitives are compared by the canonical form of the primitive tree rooted
+// at each primitive, as used by fingerprint, which makes the comparison
+// insensitive to renamed nodes. Each primitive of one list is paired with an
+// unpaired primitive of the other list with identical canonical form, where
+// such exists. The remaining primitives of the same type are paired up in
+// order and reported as changed, while others are reported as removed or
+// added.
+func diffPrims(base, cur []*Primitive) []*primDiff {
+	baseCanons, _ := canonicals(base)
+	curCanons, _ := canonicals(cur)
+
+	// Pair identical primitive trees.
+	unpaired := make(map[string][]int)
+	for i, canon := range baseCanons {
+		unpaired[canon] = append(unpaired[canon], i)
+	}
+	basePaired := make([]bool, len(base))
+	curPaired := make([]bool, len(cur))
+	for i, canon := range curCanons {
+		if is := unpaired[canon]; len(is) > 0 {
+			basePaired[is[0]] = true
+			curPaired[i] = true
+			unpaired[canon] = is[1:]
+		}
+	}
+
+	// Pair changed primitives of the same type.
+	var diffs []*primDiff
+	for i, prim := range base {
+		if basePaired[i] {
+			continue
+		}
+		d := &primDiff{old: prim, oldCanon: baseCanons[i]}
+		for j := range cur {
+			if !curPaired[j] && cur[j].Prim == prim.Prim {
+				curPaired[j] = true
+				d.new, d.newCanon = cur[j], curCanons[j]
+				break
+			}
+		}
+		diffs = append(diffs, d)
+	}
+	for j, prim := range cur {
+		if !curPaired[j] {
+			diffs = append(diffs, &primDiff{new: prim, newCanon: curCanons[j]})
+		}
+	}
+	return diffs
+}
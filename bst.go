@@ -0,0 +1,172 @@
+package main
+
+import (
+	"decomp.org/x/graphs/primitive"
+	"github.com/mewfork/dot"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// Compilers may lower a sparse switch into a balanced binary search tree of
+// range comparisons rather than a jump table. Such a tree is located as a
+// switch primitive, once no primitive template may be located.
+//
+// A binary search tree switch is recognized by the following heuristic. The
+// comparisons of the tree are nodes with two successors; the root comparison
+// is the entry of the switch, and every other comparison is entered
+// exclusively from its parent comparison. The leaves of the tree are case
+// nodes, entered exclusively from a comparison and leading only to the follow
+// node, or the follow node itself. The tree has at least two comparisons and
+// three case nodes, the depth of its leaves differs by at most one (i.e. the
+// tree is balanced), and the follow node may only be entered from within the
+// switch. The primitive templates do not match such trees, as the follow node
+// is shared by more than two cases.
+//
+// The nodes of the switch, including its follow node, are merged into a single
+// node. In the node mapping of the primitive, the comparisons (in breadth-first
+// order from the root), the cases (from left to right) and the follow node are
+// mapped to "A", "B", "C", etc.
+
+// minBSTCases specifies the minimum number of case nodes of a binary search
+// tree switch; a tree with two cases is a 2-way conditional.
+const minBSTCases = 3
+
+// A bstSwitch is a located binary search tree switch.
+type bstSwitch struct {
+	// Comparisons, in breadth-first order from the root.
+	comparisons []*dot.Node
+	// Case nodes, from left to right.
+	cases []*dot.Node
+	// Follow node.
+	follow *dot.Node
+}
+
+// findBSTSwitch locates the first binary search tree switch of graph, in node
+// order of its root comparison, and merges its nodes into a single node. It
+// returns nil if graph contains no such switch.
+func findBSTSwitch(graph *dot.Graph, labels edgeLabels) (*Primitive, error) {
+	for _, node := range graph.Nodes.Nodes {
+		s, ok := matchBSTSwitch(node)
+		if !ok {
+			continue
+		}
+		m := make(map[string]string)
+		var names []string
+		add := func(n *dot.Node) {
+			m[role(len(m))] = n.Name
+			names = append(names, n.Name)
+		}
+		for _, c := range s.comparisons {
+			add(c)
+		}
+		for _, c := range s.cases {
+			add(c)
+		}
+		add(s.follow)
+		name, err := mergeRegion(graph, names, switchPrim)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+		labels.merge(m, name)
+		prim := &Primitive{
+			Primitive: &primitive.Primitive{
+				Node:  name,
+				Prim:  switchPrim,
+				Nodes: m,
+			},
+			entry: node.Name,
+			exit:  s.follow.Name,
+		}
+		return prim, nil
+	}
+	return nil, nil
+}
+
+// matchBSTSwitch reports whether root is the root comparison of a binary search
+// tree switch, and returns the located switch if so.
+func matchBSTSwitch(root *dot.Node) (*bstSwitch, bool) {
+	if !isComparison(root) {
+		return nil, false
+	}
+	s := &bstSwitch{}
+	region := map[*dot.Node]bool{root: true}
+	// Leaf depths; follow leaves included.
+	minDepth, maxDepth := -1, -1
+	addLeaf := func(depth int) {
+		if minDepth == -1 || depth < minDepth {
+			minDepth = depth
+		}
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+	}
+	var follow *dot.Node
+	// setFollow sets the follow node of the switch, and reports whether it is
+	// consistent with the follow node of the other leaves.
+	setFollow := func(n *dot.Node) bool {
+		if follow == nil {
+			follow = n
+		}
+		return n == follow
+	}
+
+	// Visit the tree in breadth-first order.
+	type item struct {
+		n     *dot.Node
+		depth int
+	}
+	queue := []item{{n: root}}
+	for i := 0; i < len(queue); i++ {
+		x := queue[i]
+		s.comparisons = append(s.comparisons, x.n)
+		for _, c := range x.n.Succs {
+			switch {
+			case region[c] || isEntry(c):
+				return nil, false
+			case len(c.Preds) == 1 && isComparison(c):
+				region[c] = true
+				queue = append(queue, item{n: c, depth: x.depth + 1})
+			case len(c.Preds) == 1 && len(c.Succs) == 1:
+				// Case node, leading only to the follow node.
+				if !setFollow(c.Succs[0]) {
+					return nil, false
+				}
+				region[c] = true
+				s.cases = append(s.cases, c)
+				addLeaf(x.depth + 1)
+			default:
+				// The follow node itself.
+				if !setFollow(c) {
+					return nil, false
+				}
+				addLeaf(x.depth + 1)
+			}
+		}
+	}
+	if len(s.comparisons) < 2 || len(s.cases) < minBSTCases || maxDepth-minDepth > 1 {
+		return nil, false
+	}
+	if region[follow] || isEntry(follow) {
+		return nil, false
+	}
+	for _, c := range s.cases {
+		if c == follow {
+			return nil, false
+		}
+	}
+	region[follow] = true
+	s.follow = follow
+
+	// The follow node may only be entered from within the switch.
+	for _, pred := range follow.Preds {
+		if !region[pred] {
+			return nil, false
+		}
+	}
+	return s, true
+}
+
+// isComparison reports whether n is a candidate comparison of a binary search
+// tree switch; i.e. a node with two distinct successors.
+func isComparison(n *dot.Node) bool {
+	return len(n.Succs) == 2 && n.Succs[0] != n.Succs[1]
+}
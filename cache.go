@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"decomp.org/x/graphs"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// The primitive cache (the "-cache-dir" flag) stores the control flow
+// primitives located in a control flow graph, keyed by a hash of the input DOT
+// file, the primitive set and the flags affecting the located primitives. On a
+// cache hit, the reduction is skipped entirely. Changing the primitive set (its
+// primitives or their order) or any of the flags invalidates the cached
+// entries computed with the previous configuration.
+
+// cacheFlags specifies the names of the flags affecting the located primitives,
+// which are part of the cache key.
+var cacheFlags = []string{
+	"addr-attr", "allow-prims", "assert-complete", "assert-single-root",
+	"carry-attrs", "collapse-residual", "equiv-attr", "exclude-nodes", "input",
+	"loops-only", "mark-return", "mismatches", "name-offset", "name-prefix",
+	"node-order", "postdom-follow", "prefer-largest", "require-reduced",
+	"reverse", "strategy", "transform", "virtual-root", "weight-attr",
+	"with-confidence", "with-edges", "with-ports", "with-shape",
+}
+
+// cacheable reports whether the primitives of a control flow graph may be
+// cached; i.e. unless output requiring the reduction itself is requested (e.g.
+// diagnostics, the progress of the reduction, or primitives streamed as they
+// are located). The sinks of emitters (e.g. "-tee") receive the cached
+// primitives on a cache hit, as described by restructureCached.
+func cacheable() bool {
+	return len(flagDiagnostics) == 0 && len(flagExceptionEdges) == 0 && len(flagDumpGraph) == 0 && len(flagStats) == 0 && !flagExplain && !flagProgress && !flagVerbose && !flagStream && !flagNDJSON
+}
+
+// restructureCached attempts to recover the control flow primitives of a given
+// control flow graph, as described by restructure, using the primitive cache
+// of the given directory. On a cache hit, the cached primitives are emitted to
+// the sinks of emitters in the order located, as by the reduction.
+func restructureCached(dotPath, cacheDir string) ([]*Primitive, error) {
+	buf, err := readInput(dotPath)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	key := cacheKey(buf, subs)
+	cachePath := filepath.Join(cacheDir, key+".json")
+	if data, err := ioutil.ReadFile(cachePath); err == nil {
+		var prims []*Primitive
+		if err := json.Unmarshal(data, &prims); err == nil {
+			resetDiagnostics()
+			replayPrims(prims)
+			return prims, nil
+		}
+		// Recompute corrupt cache entry.
+	}
+	graph, err := parseGraphData(dotPath, buf)
+	if err != nil {
+		resetDiagnostics()
+		return nil, err
+	}
+	prims, err := Restructure(graph)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(prims)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return nil, errutil.Err(err)
+	}
+	if err := ioutil.WriteFile(cachePath, data, 0644); err != nil {
+		return nil, errutil.Err(err)
+	}
+	return prims, nil
+}
+
+// replayPrims emits the given cached control flow primitives to the sinks of
+// emitters.
+func replayPrims(prims []*Primitive) {
+	out := newFanout(emitters...)
+	for _, prim := range prims {
+		out.Emit(prim)
+	}
+	if err := out.Close(); err != nil {
+		warnf("emit-failure", nil, "unable to emit primitives; %v", err)
+	}
+}
+
+// readInput returns the contents of the given input DOT file, of standard input
+// if dotPath is "-", or the source of the "-dot" flag if dotPath is
+// dotFlagPath.
+func readInput(dotPath string) ([]byte, error) {
+	switch dotPath {
+	case dotFlagPath:
+		return []byte(flagDot), nil
+	case "-":
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(dotPath)
+}
+
+// cacheKey returns the cache key of the given input DOT file contents, when
+// restructured using the given ordered list of subgraphs.
+func cacheKey(buf []byte, set []*graphs.SubGraph) string {
+	h := sha256.New()
+	h.Write(buf)
+	for _, sub := range set {
+		writeSubIdentity(h, sub)
+	}
+	for _, name := range cacheFlags {
+		if f := flag.Lookup(name); f != nil {
+			fmt.Fprintf(h, "flag %s=%q\n", name, f.Value.String())
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeSubIdentity writes the identity of the given subgraph to w; its name,
+// entry and exit nodes, and its nodes and edges with their attributes.
+func writeSubIdentity(w io.Writer, sub *graphs.SubGraph) {
+	fmt.Fprintf(w, "sub %q entry=%q exit=%q\n", sub.Name, sub.Entry(), sub.Exit())
+	for _, node := range sub.Nodes.Nodes {
+		fmt.Fprintf(w, "\tnode %s%s\n", quoteID(node.Name), formatAttrs(node.Attrs))
+	}
+	for _, e := range sub.Edges.Edges {
+		fmt.Fprintf(w, "\tedge %s -> %s%s\n", quoteID(e.Src), quoteID(e.Dst), formatAttrs(e.Attrs))
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/mewfork/dot"
+)
+
+// A coverage records the nodes and edges of a control flow graph prior to its
+// reduction, for the coverage check of the "-assert-complete" flag.
+type coverage struct {
+	// Names of the original nodes, in node order.
+	nodes []string
+	// Tracker of the consumed edges of the original graph.
+	edges *consumedEdges
+}
+
+// newCoverage returns the coverage record of the given control flow graph,
+// prior to its reduction.
+func newCoverage(graph *dot.Graph) *coverage {
+	c := &coverage{edges: newConsumedEdges(graph)}
+	for _, node := range graph.Nodes.Nodes {
+		c.nodes = append(c.nodes, unquote(node.Name))
+	}
+	return c
+}
+
+// check verifies that the given control flow primitives, as located by the
+// reduction of the recorded graph, account for every original node and edge;
+// i.e. that the union of the nodes covered by the primitives equals the set of
+// original nodes, and that the union of the edges consumed by the primitives
+// equals the set of original edges. An error of kind KindIncomplete, listing
+// the nodes and edges not accounted for, is returned otherwise. The primitives
+// are not modified.
+func (c *coverage) check(prims []*Primitive) error {
+	covered := make(map[string]bool)
+	consumed := make(map[[2]string]bool)
+	for _, prim := range prims {
+		p := *prim
+		p.ConsumedEdges = nil
+		c.edges.annotate(&p)
+		for _, e := range p.ConsumedEdges {
+			consumed[e] = true
+		}
+		for name := range c.edges.members[p.Node] {
+			covered[name] = true
+		}
+	}
+	var nodes []string
+	for _, name := range c.nodes {
+		if !covered[name] {
+			nodes = append(nodes, name)
+		}
+	}
+	var edges [][2]string
+	for _, e := range c.edges.edges {
+		if !consumed[e] {
+			edges = append(edges, e)
+			consumed[e] = true
+		}
+	}
+	if len(nodes) == 0 && len(edges) == 0 {
+		return nil
+	}
+	sort.Strings(nodes)
+	sort.Sort(edgesByName(edges))
+	errorf("incomplete", nodes, "incomplete coverage; uncovered nodes %q, uncovered edges %q", nodes, edges)
+	return &Error{Kind: KindIncomplete, Msg: fmt.Sprintf("incomplete coverage; %d node(s) and %d edge(s) not accounted for by the primitives: nodes %q, edges %q", len(nodes), len(edges), nodes, edges)}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mewfork/dot"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// checkConnected validates that the given graph is weakly connected; i.e. that
+// every node is connected to the entry node when ignoring edge directions. A
+// disconnected graph (e.g. a DOT file concatenating two functions) may never
+// be reduced into a single node. The error lists the sizes of the components,
+// starting with the component of the first node.
+func checkConnected(graph *dot.Graph) error {
+	comps := components(graph)
+	if len(comps) < 2 {
+		return nil
+	}
+	var sizes []int
+	for _, comp := range comps {
+		sizes = append(sizes, len(comp))
+	}
+	msg := fmt.Sprintf("disconnected control flow graph %q; %d components of sizes %v (see -components)", graph.Name, len(comps), sizes)
+	errorf("disconnected", nil, "%s", msg)
+	return &Error{Kind: KindDisconnected, Msg: msg}
+}
+
+// restructureComponents restructures each weakly connected component of the
+// given control flow graph separately, and returns the results keyed by the
+// name of the entry node of the component. The entry node of a component is
+// its node labeled "entry", or its only node without predecessors.
+func restructureComponents(dotPath string) (map[string]*result, error) {
+	graph, err := parseGraph(dotPath)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	results := make(map[string]*result)
+	for _, comp := range components(graph) {
+		name, res := restructureComponent(graph, comp)
+		results[name] = res
+	}
+	return results, nil
+}
+
+// restructureComponent restructures the given weakly connected component of
+// graph, and returns the name of its entry node and the result.
+func restructureComponent(graph *dot.Graph, comp []*dot.Node) (string, *result) {
+	in := make(map[string]bool)
+	var nodes []*dot.Node
+	for _, node := range comp {
+		in[node.Name] = true
+		nodes = append(nodes, node)
+	}
+	var edges []*dot.Edge
+	for _, e := range graph.Edges.Edges {
+		if in[e.Src] {
+			edges = append(edges, e)
+		}
+	}
+	g, err := newGraph(graph.Name, nodes, edges)
+	if err != nil {
+		return comp[0].Name, &result{Error: err.Error()}
+	}
+	entry, err := entryNode(g)
+	if err != nil {
+		return comp[0].Name, &result{Error: err.Error()}
+	}
+	if !isEntry(entry) {
+		if entry.Attrs == nil {
+			entry.Attrs = make(dot.Attrs)
+		}
+		entry.Attrs["label"] = "entry"
+	}
+	prims, err := Restructure(g)
+	if err != nil {
+		warnf("unreduced", nil, "unable to restructure component of node %q; %v", unquote(entry.Name), err)
+		return entry.Name, &result{Error: err.Error()}
+	}
+	return entry.Name, &result{Prims: prims}
+}
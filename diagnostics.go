@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/mewfork/dot"
+)
+
+// A Diagnostic is a structured warning or error reported by restructure.
+type Diagnostic struct {
+	// Severity of the diagnostic; "warning" or "error".
+	Severity string `json:"severity"`
+	// Code identifying the kind of diagnostic (e.g. "residual-loop").
+	Code string `json:"code"`
+	// Diagnostic message.
+	Message string `json:"message"`
+	// Nodes involved, if any.
+	Nodes []string `json:"nodes,omitempty"`
+}
+
+// Diagnostic severities.
+const (
+	severityWarning = "warning"
+	severityError   = "error"
+)
+
+// diags holds the diagnostics reported by the most recent call to restructure.
+var diags []*Diagnostic
+
+// Diagnostics returns the diagnostics reported by the most recent call to
+// restructure.
+func Diagnostics() []*Diagnostic {
+	return diags
+}
+
+// resetDiagnostics discards the reported diagnostics.
+func resetDiagnostics() {
+	diags = nil
+}
+
+// warnf reports a warning diagnostic with the given code and involved nodes.
+// Warnings are additionally printed to standard error, unless in quiet mode.
+func warnf(code string, nodes []string, format string, a ...interface{}) {
+	report(severityWarning, code, nodes, format, a...)
+}
+
+// errorf reports an error diagnostic with the given code and involved nodes.
+// Errors are not printed, as they are returned to the caller.
+func errorf(code string, nodes []string, format string, a ...interface{}) {
+	report(severityError, code, nodes, format, a...)
+}
+
+// report reports a diagnostic of the given severity.
+func report(severity, code string, nodes []string, format string, a ...interface{}) {
+	d := &Diagnostic{
+		Severity: severity,
+		Code:     code,
+		Message:  fmt.Sprintf(format, a...),
+	}
+	for _, name := range nodes {
+		d.Nodes = append(d.Nodes, unquote(name))
+	}
+	diags = append(diags, d)
+	switch {
+	case flagQuiet:
+		// Suppressed.
+	case flagVetFormat:
+		endProgress()
+		fmt.Fprintf(os.Stderr, "%s: %s\n", vetPosition(d.Nodes), d.Message)
+	case severity == severityWarning:
+		endProgress()
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", d.Message)
+	}
+}
+
+// In vet format (the "-vet-format" flag), diagnostics are printed to standard
+// error as "file:line:col: message", as parsed by editors, and errors are
+// printed along with warnings. Each diagnostic is keyed to the source location
+// of the first involved node with line information, as specified by the
+// "line" and "col" node attributes of the control flow graph (e.g. as recorded
+// by the producer of the DOT file); the column defaults to 1. Diagnostics
+// without located nodes are keyed to the file alone.
+
+// A sourcePos is the source location of a node, as specified by its "line" and
+// "col" attributes.
+type sourcePos struct {
+	line, col int
+}
+
+var (
+	// sourcePath holds the path of the most recently parsed control flow graph.
+	sourcePath string
+	// sourcePositions maps from node name to the source location of the node,
+	// for the nodes of the control flow graph under reduction with line
+	// information.
+	sourcePositions map[string]sourcePos
+)
+
+// setSourcePositions records the source locations of the nodes of the given
+// control flow graph.
+func setSourcePositions(graph *dot.Graph) {
+	sourcePositions = make(map[string]sourcePos)
+	for _, node := range graph.Nodes.Nodes {
+		line, err := strconv.Atoi(attr(node.Attrs, "line"))
+		if err != nil || line <= 0 {
+			continue
+		}
+		col, err := strconv.Atoi(attr(node.Attrs, "col"))
+		if err != nil || col <= 0 {
+			col = 1
+		}
+		sourcePositions[unquote(node.Name)] = sourcePos{line: line, col: col}
+	}
+}
+
+// vetPosition returns the vet-style source location of a diagnostic involving
+// the given nodes.
+func vetPosition(nodes []string) string {
+	file := sourcePath
+	switch file {
+	case "":
+		file = "restructure"
+	case "-":
+		file = "<stdin>"
+	}
+	for _, name := range nodes {
+		if pos, ok := sourcePositions[name]; ok {
+			return fmt.Sprintf("%s:%d:%d", file, pos.line, pos.col)
+		}
+	}
+	return file
+}
+
+// analyze reports whether optional analyses producing diagnostics should be
+// run; i.e. in verbose mode or when diagnostics are requested by the
+// "-diagnostics" flag.
+func analyze() bool {
+	return flagVerbose || len(flagDiagnostics) > 0
+}
+
+// writeDiagnostics writes the reported diagnostics as JSON to the given path.
+func writeDiagnostics(path string) error {
+	list := diags
+	if list == nil {
+		list = []*Diagnostic{}
+	}
+	buf, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf, 0644)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"decomp.org/x/graphs"
+	"decomp.org/x/graphs/merge"
+	"github.com/mewfork/dot"
+)
+
+// dispatchPrim is the name of the dispatch primitive.
+//
+// A dispatch is an indirect jump node (its dispatcher), marked by the node
+// attribute indirect="true", with two or more successors (its targets), as
+// produced by jump tables lowered to an unconditional dispatch node whose
+// out-edges are chosen at runtime. Unlike a switch, whose dispatcher is a
+// conditional, the out-edges of the dispatcher carry no condition, and unlike a
+// jump table, which is inferred from the shape of the graph, the dispatcher is
+// identified by its attribute. Each target must be entered exclusively from the
+// dispatcher, but the targets need not converge. Dispatches are located once no
+// primitive template may be located, before switches, and the dispatcher of a
+// dispatch is never located as the dispatcher of a switch or jump table.
+//
+// The dispatcher and its targets are merged into a single node, as the nodes of
+// a jump table (see jumpTable).
+const dispatchPrim = "dispatch"
+
+// minDispatchTargets specifies the minimum number of targets of a dispatch.
+const minDispatchTargets = 2
+
+// isIndirect reports whether the given node is marked as an indirect jump.
+func isIndirect(node *dot.Node) bool {
+	return attr(node.Attrs, "indirect") == "true"
+}
+
+// findDispatch locates the first dispatch of graph, in node order, and merges
+// its nodes into a single node. It returns nil if graph contains no dispatch.
+func findDispatch(graph *dot.Graph, labels edgeLabels) (*Primitive, error) {
+	return findFanout(graph, labels, dispatchPrim, isDispatch)
+}
+
+// isDispatch reports whether the given node is the dispatcher of a dispatch.
+func isDispatch(node *dot.Node) bool {
+	return isIndirect(node) && isFanout(node, minDispatchTargets)
+}
+
+// mergePrim merges the nodes of the isomorphism m of sub in graph into a single
+// node, as merge.Merge. As the super-node inherits the out-edges of the node
+// mapped to the exit node of sub, it is marked as an indirect jump if the exit
+// node is; e.g. when a basic block ending with an indirect jump is merged into
+// a list.
+func mergePrim(graph *dot.Graph, m map[string]string, sub *graphs.SubGraph) (string, error) {
+	exit, ok := graph.Nodes.Lookup[m[sub.Exit()]]
+	indirect := ok && isIndirect(exit)
+	node, err := merge.Merge(graph, m, sub)
+	if err != nil {
+		return "", err
+	}
+	if super, ok := graph.Nodes.Lookup[node]; ok && indirect {
+		if super.Attrs == nil {
+			super.Attrs = make(dot.Attrs)
+		}
+		super.Attrs["indirect"] = "true"
+	}
+	return node, nil
+}
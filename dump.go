@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/mewfork/dot"
+)
+
+// A graphDump holds the control flow graph of a call to Restructure, as
+// required by the "-dump-graph" flag.
+type graphDump struct {
+	// Control flow graph prior to reduction.
+	orig *dot.Graph
+	// Reduced control flow graph.
+	reduced *dot.Graph
+	// Control flow primitives located in the graph; when the reduction stalled,
+	// the primitives located before it stalled.
+	prims []*Primitive
+}
+
+// dumped holds the control flow graph of the most recent call to Restructure,
+// if the "-dump-graph" flag is set.
+var dumped *graphDump
+
+// writeGraphDump writes the control flow graph of the most recent call to
+// Restructure to the given path, in Graphviz DOT format. The reduced graph is
+// written, unless -dump-graph-nested is set, in which case the original graph
+// is written with each merged region wrapped in a cluster. Nothing is written
+// if the graph could not be parsed, or if the clusters are nested deeper than
+// permitted by the "-max-depth" flag.
+func writeGraphDump(path string) error {
+	if dumped == nil {
+		return nil
+	}
+	buf := &bytes.Buffer{}
+	if flagDumpGraphNested {
+		if err := writeNestedDOT(buf, dumped.orig, dumped.prims); err != nil {
+			return err
+		}
+	} else {
+		writeFlatDOT(buf, dumped.reduced)
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// writeFlatDOT writes the given graph to w, in Graphviz DOT format.
+func writeFlatDOT(w io.Writer, graph *dot.Graph) {
+	fmt.Fprintf(w, "digraph %s {\n", quoteID(graph.Name))
+	for _, node := range graph.Nodes.Nodes {
+		fmt.Fprintf(w, "\t%s%s\n", quoteID(node.Name), formatAttrs(node.Attrs))
+	}
+	for _, e := range graph.Edges.Edges {
+		fmt.Fprintf(w, "\t%s -> %s%s\n", quoteID(e.Src), quoteID(e.Dst), formatAttrs(e.Attrs))
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// writeNestedDOT writes the given graph to w, in Graphviz DOT format, with the
+// nodes of each merged region of the given control flow primitives wrapped in
+// a cluster named after the super-node of the region (e.g. "cluster_list0").
+// The regions of nested primitives are wrapped in nested clusters, and each
+// cluster is labeled with the type of its primitive. An error is returned if
+// the clusters are nested deeper than permitted by the "-max-depth" flag.
+func writeNestedDOT(w io.Writer, graph *dot.Graph, prims []*Primitive) error {
+	nodes := primTree(prims)
+	if err := checkDepth(nodes); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "digraph %s {\n", quoteID(graph.Name))
+	// covered tracks the nodes of graph within a cluster.
+	covered := make(map[string]bool)
+	// clusters tracks the cluster names in use, as super-node names may be
+	// reused once the super-node has been merged.
+	clusters := make(map[string]bool)
+	var write func(n *primNode, depth int)
+	write = func(n *primNode, depth int) {
+		indent := strings.Repeat("\t", depth)
+		name := "cluster_" + n.prim.Node
+		for i := 1; clusters[name]; i++ {
+			name = fmt.Sprintf("cluster_%s_%d", n.prim.Node, i)
+		}
+		clusters[name] = true
+		fmt.Fprintf(w, "%ssubgraph %s {\n", indent, quoteID(name))
+		fmt.Fprintf(w, "%s\tlabel=%q\n", indent, n.prim.Prim)
+		for _, role := range n.roles() {
+			if child, ok := n.children[role]; ok {
+				write(child, depth+1)
+				continue
+			}
+			name := n.prim.Nodes[role]
+			covered[name] = true
+			var attrs dot.Attrs
+			if node, ok := lookupNode(graph, name); ok {
+				attrs = node.Attrs
+			}
+			fmt.Fprintf(w, "%s\t%s%s\n", indent, quoteID(name), formatAttrs(attrs))
+		}
+		fmt.Fprintf(w, "%s}\n", indent)
+	}
+	for _, n := range nodes {
+		if n.parent == nil {
+			write(n, 1)
+		}
+	}
+	for _, node := range graph.Nodes.Nodes {
+		if !covered[unquote(node.Name)] {
+			fmt.Fprintf(w, "\t%s%s\n", quoteID(node.Name), formatAttrs(node.Attrs))
+		}
+	}
+	for _, e := range graph.Edges.Edges {
+		fmt.Fprintf(w, "\t%s -> %s%s\n", quoteID(e.Src), quoteID(e.Dst), formatAttrs(e.Attrs))
+	}
+	fmt.Fprintln(w, "}")
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"embed"
+	"path"
+
+	"decomp.org/x/graphs"
+	"github.com/mewfork/dot"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// defaultPrims holds the default control flow primitives, as specified by
+// priorSubNames, subNames and localSubNames, so that the restructure binary is
+// self-contained and does not depend on the source tree being present at
+// runtime. The primitives of subNames are copies of the ones provided by
+// decomp.org/x/graphs/testdata/primitives. The embedded primitives may be
+// overridden using the "-prims" and "-prims-dir" flags.
+//
+//go:embed primitives/*.dot
+var defaultPrims embed.FS
+
+// defaultSubNames returns the names of the default control flow primitives, in
+// order of priority.
+func defaultSubNames() []string {
+	var names []string
+	names = append(names, priorSubNames...)
+	names = append(names, subNames...)
+	names = append(names, localSubNames...)
+	return names
+}
+
+// defaultSubPaths returns the paths of the default control flow primitives
+// within the given directory, in order of priority.
+func defaultSubPaths(dir string) []string {
+	var subPaths []string
+	for _, subName := range defaultSubNames() {
+		subPaths = append(subPaths, path.Join(dir, subName))
+	}
+	return subPaths
+}
+
+// parseEmbeddedSub parses the subgraph of the given embedded control flow
+// primitive (e.g. "primitives/if.dot").
+func parseEmbeddedSub(subPath string) (*graphs.SubGraph, error) {
+	graph, err := readEmbeddedGraph(subPath)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	return graphs.NewSubGraph(graph)
+}
+
+// readEmbeddedGraph parses the graph of the given embedded control flow
+// primitive.
+func readEmbeddedGraph(subPath string) (*dot.Graph, error) {
+	buf, err := defaultPrims.ReadFile(subPath)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	graph, err := dot.Read(buf)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	return graph, nil
+}
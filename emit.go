@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// emitters specifies the sinks to which control flow primitives are emitted
+// as they are located by restructure.
+var emitters []Emitter
+
+// primary specifies the emitter of the primary output (e.g. "-stream"), to
+// which control flow primitives are emitted as they are located by
+// restructure. Unlike the sinks of emitters, the primary output is written
+// synchronously and never detached; the reduction fails if it may not be
+// written.
+var primary Emitter
+
+// An Emitter receives control flow primitives as they are located.
+type Emitter interface {
+	// Emit emits the given control flow primitive.
+	Emit(prim *Primitive) error
+}
+
+// jsonEmitter emits control flow primitives as newline-delimited JSON.
+type jsonEmitter struct {
+	enc *json.Encoder
+}
+
+// newJSONEmitter returns an emitter which writes control flow primitives to w
+// as newline-delimited JSON.
+func newJSONEmitter(w io.Writer) *jsonEmitter {
+	return &jsonEmitter{enc: json.NewEncoder(w)}
+}
+
+// Emit writes the given control flow primitive as a line of JSON.
+func (e *jsonEmitter) Emit(prim *Primitive) error {
+	return e.enc.Encode(prim)
+}
+
+// arrayEmitter emits control flow primitives as the elements of a JSON array,
+// one per line, as requested by the "-stream" flag. The opening bracket is
+// written along with the first primitive, and the closing bracket by Close, so
+// the output is a valid JSON array once closed.
+type arrayEmitter struct {
+	w io.Writer
+	// Number of emitted primitives.
+	n int
+}
+
+// newArrayEmitter returns an emitter which writes control flow primitives to w
+// as the elements of a JSON array.
+func newArrayEmitter(w io.Writer) *arrayEmitter {
+	return &arrayEmitter{w: w}
+}
+
+// Emit writes the given control flow primitive as an element of the JSON
+// array.
+func (e *arrayEmitter) Emit(prim *Primitive) error {
+	buf, err := json.Marshal(prim)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	sep := ",\n"
+	if e.n == 0 {
+		sep = "[\n"
+	}
+	e.n++
+	_, err = fmt.Fprintf(e.w, "%s%s", sep, buf)
+	return err
+}
+
+// Close closes the JSON array.
+func (e *arrayEmitter) Close() error {
+	end := "\n]\n"
+	if e.n == 0 {
+		end = "[" + end
+	}
+	_, err := io.WriteString(e.w, end)
+	return err
+}
+
+// checkStream validates the flags of a streaming output format, as requested
+// by the "-stream" and "-ndjson" flags. As primitives are written as they are
+// located, output options which require the complete list of primitives are
+// not supported.
+func checkStream() error {
+	name := "-stream"
+	if flagNDJSON {
+		name = "-ndjson"
+	}
+	switch {
+	case flagStream && flagNDJSON:
+		return errutil.New("-stream and -ndjson are mutually exclusive")
+	case flagFormat != "json":
+		return errutil.Newf("%s requires the json output format, got %q", name, flagFormat)
+	case flagFingerprint, flagIndent, flagLoopNests, flagReverseMap, flagSimplify, flagSortOutput, len(flagMeta) > 0:
+		return errutil.Newf("%s does not support -fingerprint, -indent, -loop-nests, -meta, -reverse-map, -simplify or -sort-output", name)
+	case flagComponents, len(flagArchive) > 0, flagScore, flagTune, flagUsage:
+		return errutil.Newf("%s does not support -archive, -components, -score, -tune or -usage", name)
+	}
+	return nil
+}
+
+// sinkTimeout specifies how long a fanout waits for a slow sink to accept a
+// control flow primitive before detaching it.
+const sinkTimeout = 5 * time.Second
+
+// sinkBuffer specifies the number of control flow primitives buffered per
+// sink of a fanout.
+const sinkBuffer = 64
+
+// A primaryEmitter emits control flow primitives to the primary output, and to
+// the sinks of a fanout.
+type primaryEmitter struct {
+	primary Emitter
+	sinks   *fanout
+}
+
+// Emit emits the given control flow primitive to the primary output, and then
+// to the sinks. An error is returned if the primary output may not be written.
+func (e *primaryEmitter) Emit(prim *Primitive) error {
+	if err := e.primary.Emit(prim); err != nil {
+		return errutil.Err(err)
+	}
+	return e.sinks.Emit(prim)
+}
+
+// A fanout emits control flow primitives to several sinks concurrently. Each
+// sink is served by a dedicated goroutine, so that a slow sink delays neither
+// the reduction nor the other sinks for longer than sinkTimeout after its
+// buffer has filled up. Sinks which fail or time out are detached, and their
+// errors are reported by Close.
+type fanout struct {
+	sinks []*sink
+}
+
+// A sink is an emitter attached to a fanout.
+type sink struct {
+	e  Emitter
+	ch chan *Primitive
+	// done is closed when the goroutine serving the sink returns.
+	done chan struct{}
+	// Set to true when the sink has been detached by the fanout.
+	detached bool
+	// mu protects err, which is written by the goroutine serving the sink.
+	mu  sync.Mutex
+	err error
+}
+
+// newFanout returns a fanout of the given emitters.
+func newFanout(emitters ...Emitter) *fanout {
+	f := &fanout{}
+	for _, e := range emitters {
+		s := &sink{
+			e:    e,
+			ch:   make(chan *Primitive, sinkBuffer),
+			done: make(chan struct{}),
+		}
+		f.sinks = append(f.sinks, s)
+		go s.serve()
+	}
+	return f
+}
+
+// serve emits the control flow primitives received by s until its channel is
+// closed. After the first failure, the remaining primitives are discarded.
+func (s *sink) serve() {
+	defer close(s.done)
+	for prim := range s.ch {
+		if s.failed() {
+			continue
+		}
+		if err := s.e.Emit(prim); err != nil {
+			s.fail(err)
+		}
+	}
+}
+
+// Emit emits the given control flow primitive to each attached sink.
+func (f *fanout) Emit(prim *Primitive) error {
+	for _, s := range f.sinks {
+		if s.detached {
+			continue
+		}
+		if s.failed() {
+			f.detach(s)
+			continue
+		}
+		select {
+		case s.ch <- prim:
+		case <-time.After(sinkTimeout):
+			s.fail(errutil.Newf("sink timed out after %v", sinkTimeout))
+			f.detach(s)
+		}
+	}
+	return nil
+}
+
+// Close flushes the attached sinks and waits for them to finish, giving up on
+// sinks which do not finish within sinkTimeout. It returns the first error
+// encountered by any sink.
+func (f *fanout) Close() error {
+	for _, s := range f.sinks {
+		f.detach(s)
+	}
+	for _, s := range f.sinks {
+		select {
+		case <-s.done:
+		case <-time.After(sinkTimeout):
+			s.fail(errutil.Newf("sink timed out after %v", sinkTimeout))
+		}
+	}
+	for _, s := range f.sinks {
+		if err := s.error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// detach detaches the given sink from the fanout.
+func (f *fanout) detach(s *sink) {
+	if !s.detached {
+		s.detached = true
+		close(s.ch)
+	}
+}
+
+// fail records the first error of the sink.
+func (s *sink) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// failed reports whether the sink has failed.
+func (s *sink) failed() bool {
+	return s.error() != nil
+}
+
+// error returns the first error of the sink, if any.
+func (s *sink) error() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"decomp.org/x/graphs/primitive"
+)
+
+// recorder records the names of emitted primitives.
+type recorder struct {
+	names []string
+}
+
+func (r *recorder) Emit(prim *Primitive) error {
+	r.names = append(r.names, prim.Node)
+	return nil
+}
+
+// failer fails to emit primitives.
+type failer struct{}
+
+func (failer) Emit(prim *Primitive) error {
+	return errors.New("broken sink")
+}
+
+func TestFanout(t *testing.T) {
+	r := &recorder{}
+	f := newFanout(failer{}, r)
+	for _, name := range []string{"list0", "if0"} {
+		f.Emit(&Primitive{Primitive: &primitive.Primitive{Node: name}})
+	}
+	if err := f.Close(); err == nil {
+		t.Errorf("expected error from failing sink")
+	}
+	want := []string{"list0", "if0"}
+	if !reflect.DeepEqual(r.names, want) {
+		t.Errorf("emitted primitives mismatch; expected %v, got %v", want, r.names)
+	}
+}
+
+func TestStream(t *testing.T) {
+	defer func(old Emitter) { primary = old }(primary)
+	golden := []struct {
+		path string
+		// Number of primitives located before the reduction succeeds or
+		// stalls.
+		want int
+	}{
+		{path: "testdata/foo.dot", want: 2},
+		{path: "testdata/irreducible.dot", want: 0},
+	}
+	for _, g := range golden {
+		// JSON array framing.
+		buf := &bytes.Buffer{}
+		array := newArrayEmitter(buf)
+		primary = array
+		restructure(g.path)
+		if err := array.Close(); err != nil {
+			t.Fatal(err)
+		}
+		var got []*Primitive
+		if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+			t.Errorf("%q: invalid JSON array %q; %v", g.path, buf, err)
+			continue
+		}
+		if len(got) != g.want {
+			t.Errorf("%q: primitive count mismatch; expected %d, got %d", g.path, g.want, len(got))
+			continue
+		}
+
+		// Newline-delimited JSON framing.
+		buf.Reset()
+		primary = newJSONEmitter(buf)
+		restructure(g.path)
+		var lines []string
+		if buf.Len() > 0 {
+			lines = strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+		}
+		if len(lines) != g.want {
+			t.Errorf("%q: line count mismatch; expected %d, got %d", g.path, g.want, len(lines))
+			continue
+		}
+		for i, line := range lines {
+			var prim Primitive
+			if err := json.Unmarshal([]byte(line), &prim); err != nil {
+				t.Errorf("%q: invalid JSON on line %d; %v", g.path, i+1, err)
+			} else if prim.Node != got[i].Node {
+				t.Errorf("%q: primitive %d mismatch; expected %q, got %q", g.path, i, got[i].Node, prim.Node)
+			}
+		}
+	}
+}
+
+func TestPrimary(t *testing.T) {
+	defer func(old Emitter, sinks []Emitter) { primary, emitters = old, sinks }(primary, emitters)
+	const dotPath = "testdata/foo.dot"
+	// The primary output is written synchronously, along with the sinks.
+	main, r := &recorder{}, &recorder{}
+	primary, emitters = main, []Emitter{r}
+	if _, err := restructure(dotPath); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"list0", "if0"}
+	if !reflect.DeepEqual(main.names, want) || !reflect.DeepEqual(r.names, want) {
+		t.Errorf("%q: emitted primitives mismatch; expected %v, got %v (primary) and %v (sink)", dotPath, want, main.names, r.names)
+	}
+	// A failure to write the primary output fails the reduction.
+	primary, emitters = failer{}, nil
+	if _, err := restructure(dotPath); err == nil || !strings.Contains(err.Error(), "broken sink") {
+		t.Errorf("%q: expected error from failing primary output, got %v", dotPath, err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"decomp.org/x/graphs/primitive"
+	"github.com/mewfork/dot"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// equivPrim is the name of the equivalence primitive.
+//
+// Nodes of a control flow graph may be considered the same for structuring
+// purposes, e.g. two nop blocks of the same kind. When a node-equivalence
+// relation is given, either by NodeEquivalence or by the "-equiv-attr" flag,
+// each class of equivalent nodes with identical successors is collapsed into a
+// single super-node prior to the reduction, so that primitives may be located
+// across the equivalent nodes. As iso.Search compares nodes by structure only,
+// the collapse takes place before the search rather than during it.
+//
+// Collapsing equivalent nodes risks over-merging; nodes which are equivalent by
+// the relation but differ in semantics (e.g. the two branches of a conditional
+// which happen to share an attribute value) are merged, and the structure
+// separating them is lost. Hence, equivalence is strictly opt-in, and only
+// nodes with the same set of successors, neither of which is the entry node,
+// are collapsed.
+//
+// In the node mapping of the primitive, the equivalent nodes are mapped to
+// "A", "B", etc, in node order (see role).
+const equivPrim = "equiv"
+
+// NodeEquivalence is the node-equivalence relation used to collapse equivalent
+// nodes prior to the reduction, or nil to disable the collapse. It reports
+// whether the nodes a and b of a control flow graph are considered the same for
+// structuring purposes. When nil, the relation specified by the "-equiv-attr"
+// flag is used, if any.
+var NodeEquivalence func(a, b *dot.Node) bool
+
+// equivalence returns the node-equivalence relation in effect, or nil if none.
+func equivalence() func(a, b *dot.Node) bool {
+	if NodeEquivalence != nil {
+		return NodeEquivalence
+	}
+	if len(flagEquivAttr) > 0 {
+		return sameAttr(flagEquivAttr)
+	}
+	return nil
+}
+
+// sameAttr returns a node-equivalence relation under which two nodes are
+// equivalent if they share the same non-empty value of the given attribute.
+func sameAttr(key string) func(a, b *dot.Node) bool {
+	return func(a, b *dot.Node) bool {
+		v := attr(a.Attrs, key)
+		return len(v) > 0 && v == attr(b.Attrs, key)
+	}
+}
+
+// findEquivalent locates the first class of equivalent nodes of graph, under
+// the relation equiv, and merges it into a single node. It returns nil if no
+// two nodes of graph may be collapsed.
+func findEquivalent(graph *dot.Graph, labels edgeLabels, equiv func(a, b *dot.Node) bool) (*Primitive, error) {
+	for i, node := range graph.Nodes.Nodes {
+		if !collapsible(node) {
+			continue
+		}
+		class := []*dot.Node{node}
+		for _, other := range graph.Nodes.Nodes[i+1:] {
+			if collapsible(other) && equiv(node, other) && sameSuccs(node, other) {
+				class = append(class, other)
+			}
+		}
+		if len(class) < 2 {
+			continue
+		}
+		m := make(map[string]string)
+		var names []string
+		for j, n := range class {
+			m[role(j)] = n.Name
+			names = append(names, n.Name)
+		}
+		name, err := mergeRegion(graph, names, equivPrim)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+		labels.merge(m, name)
+		prim := &Primitive{
+			Primitive: &primitive.Primitive{
+				Node:  name,
+				Prim:  equivPrim,
+				Nodes: m,
+			},
+			entry:     node.Name,
+			exit:      node.Name,
+			heuristic: true,
+		}
+		return prim, nil
+	}
+	return nil, nil
+}
+
+// collapsible reports whether the given node may be collapsed with equivalent
+// nodes; i.e. whether it is neither the entry node nor its own successor.
+func collapsible(node *dot.Node) bool {
+	if isEntry(node) || len(node.Preds) == 0 {
+		return false
+	}
+	for _, succ := range node.Succs {
+		if succ == node {
+			return false
+		}
+	}
+	return true
+}
+
+// sameSuccs reports whether the nodes a and b have the same set of successors,
+// and neither is a successor of the other.
+func sameSuccs(a, b *dot.Node) bool {
+	succs := make(map[*dot.Node]bool)
+	for _, succ := range a.Succs {
+		succs[succ] = true
+	}
+	have := make(map[*dot.Node]bool)
+	for _, succ := range b.Succs {
+		if !succs[succ] {
+			return false
+		}
+		have[succ] = true
+	}
+	return len(have) == len(succs) && !succs[a] && !succs[b]
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// An Error describes a failure of restructure, the reason of which is
+// distinguishable by its kind.
+type Error struct {
+	// Reason of failure.
+	Kind ErrorKind
+	// Error message.
+	Msg string
+	// Reasons for which the primitives failed to match the control flow graph
+	// of a stalled reduction, in order of priority, as requested by the
+	// "-mismatches" flag.
+	Mismatches []*Mismatch
+}
+
+// Error returns the error message.
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+// ErrorKind specifies the reason of a restructure failure.
+type ErrorKind int
+
+// Error kinds.
+const (
+	// KindUnreduced indicates that the control flow graph could not be reduced
+	// into a single node.
+	KindUnreduced ErrorKind = iota + 1
+	// KindPolicy indicates that a located control flow primitive is not
+	// permitted by the primitive-coverage policy.
+	KindPolicy
+	// KindDisconnected indicates that the control flow graph consists of
+	// several weakly connected components, and may never be reduced into a
+	// single node.
+	KindDisconnected
+	// KindIncomplete indicates that the located control flow primitives do not
+	// account for every node and edge of the control flow graph, as required
+	// by the "-assert-complete" flag.
+	KindIncomplete
+	// KindDepth indicates that the primitive tree of the located control flow
+	// primitives is nested deeper than permitted by the "-max-depth" flag.
+	KindDepth
+	// KindRoots indicates that the located control flow primitives of a fully
+	// reduced control flow graph form several disconnected primitive trees, as
+	// rejected by the "-assert-single-root" flag.
+	KindRoots
+	// KindValidation indicates that MergeValidator rejected the merge of a
+	// located control flow primitive.
+	KindValidation
+)
+
+// checkPolicy validates the located control flow primitives against the
+// primitive-coverage policy specified by the "-require-reduced" and
+// "-allow-prims" flags. The reduced argument specifies whether the control flow
+// graph was reduced into a single node; note that a stalled reduction is
+// always reported as a KindUnreduced error, unless partial results have been
+// requested.
+func checkPolicy(prims []*Primitive, reduced bool) error {
+	if flagRequireReduced && !reduced {
+		return &Error{Kind: KindUnreduced, Msg: "policy violation: control flow graph not fully reduced"}
+	}
+	if len(flagAllowPrims) == 0 {
+		return nil
+	}
+	allowed := make(map[string]bool)
+	for _, name := range strings.Split(flagAllowPrims, ",") {
+		allowed[name] = true
+	}
+	for _, prim := range prims {
+		if !allowed[prim.Prim] {
+			return &Error{Kind: KindPolicy, Msg: fmt.Sprintf("policy violation: primitive %q of node %q not permitted", prim.Prim, prim.Node)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/mewfork/dot"
+)
+
+// Exceptional edges lead from a protected node to the exception handler of the
+// node (e.g. the catch block of a try statement), and are declared using the
+// "exception" attribute, e.g.
+//
+//    B -> H [exception="true"]
+//
+// When requested by the "-exception-edges" flag, exceptional edges are removed
+// from the control flow graph before restructuring, so that they do not add
+// unexpected successors to the protected nodes. Handlers which are only
+// reachable through exceptional edges thus form separate regions of the graph,
+// and the reduction is complete when each region has been reduced into a single
+// node. The handler associations are output separately, as described by
+// Handler.
+
+// A Handler associates a protected node of a control flow graph with its
+// exception handler.
+type Handler struct {
+	// Protected node; the source node of the exceptional edge.
+	Node string `json:"node"`
+	// Exception handler; the destination node of the exceptional edge.
+	Handler string `json:"handler"`
+	// Super-node of the innermost located primitive containing the protected
+	// node, if any.
+	Region string `json:"region,omitempty"`
+	// Index of the innermost located primitive containing the protected node
+	// in the list of primitives, if any; super-node names may be reused.
+	RegionStep *int `json:"region_step,omitempty"`
+	// Super-node of the innermost located primitive containing the exception
+	// handler, if any.
+	HandlerRegion string `json:"handler_region,omitempty"`
+	// Index of the innermost located primitive containing the exception
+	// handler in the list of primitives, if any.
+	HandlerRegionStep *int `json:"handler_region_step,omitempty"`
+}
+
+// handlers holds the handler associations of the most recent call to
+// restructure.
+var handlers []*Handler
+
+// Handlers returns the handler associations of the exceptional edges removed
+// by the most recent call to restructure.
+func Handlers() []*Handler {
+	return handlers
+}
+
+// isException reports whether the given edge is exceptional.
+func isException(e *dot.Edge) bool {
+	return attr(e.Attrs, "exception") == "true"
+}
+
+// removeExceptionEdges returns a copy of graph with its exceptional edges
+// removed, and the handler associations of the removed edges.
+func removeExceptionEdges(graph *dot.Graph) (*dot.Graph, []*Handler, error) {
+	var edges []*dot.Edge
+	var hs []*Handler
+	for _, e := range graph.Edges.Edges {
+		if isException(e) {
+			hs = append(hs, &Handler{Node: unquote(e.Src), Handler: unquote(e.Dst)})
+			continue
+		}
+		edges = append(edges, e)
+	}
+	g, err := newGraph(graph.Name, graph.Nodes.Nodes, edges)
+	if err != nil {
+		return nil, nil, err
+	}
+	return g, hs, nil
+}
+
+// resolveHandlers records the innermost primitive containing the protected
+// node and the exception handler of each handler association, based on the
+// given control flow primitives in the order they were located.
+func resolveHandlers(hs []*Handler, prims []*Primitive) {
+	for _, h := range hs {
+		if i := innermost(h.Node, prims); i != -1 {
+			h.Region, h.RegionStep = prims[i].Node, &i
+		}
+		if i := innermost(h.Handler, prims); i != -1 {
+			h.HandlerRegion, h.HandlerRegionStep = prims[i].Node, &i
+		}
+	}
+}
+
+// innermost returns the index of the innermost primitive containing the given
+// node of the original control flow graph, or -1 if the node is not contained
+// within any primitive.
+func innermost(name string, prims []*Primitive) int {
+	for i, prim := range prims {
+		for _, n := range prim.Nodes {
+			if n == name {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// writeHandlers writes the handler associations as JSON to the given path.
+func writeHandlers(path string) error {
+	list := handlers
+	if list == nil {
+		list = []*Handler{}
+	}
+	buf, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf, 0644)
+}
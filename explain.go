@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"decomp.org/x/graphs"
+	"github.com/mewfork/dot"
+)
+
+// In explain mode (the "-explain" flag), each reduction step is accompanied by
+// the rationale of the decision; the node mapping of the located primitive, and
+// for each primitive of higher priority the first point at which it failed to
+// match. Unless Matcher implements MismatchSearcher, the points of mismatch are
+// determined by the local matcher of search, which follows the semantics of
+// iso.Search. The "-mismatches" flag records the same points of mismatch, in
+// structured form, in the Mismatches of each located primitive and of the
+// error of a stalled reduction.
+
+// Kinds of mismatches.
+const (
+	// The primitive contains nodes unreachable from its entry node, ignoring
+	// edge directions.
+	MismatchUnreachable = "unreachable"
+	// No node of the graph is left to map the role to.
+	MismatchCandidate = "candidate"
+	// The successors of the node mapped to the role mismatch.
+	MismatchSuccessor = "successor"
+	// The predecessors of the node mapped to the role mismatch.
+	MismatchPredecessor = "predecessor"
+	// An edge of the graph lacks the label required by the primitive.
+	MismatchLabel = "label"
+	// The node mapped to the role is not marked value-producing.
+	MismatchValue = "value"
+	// The local matcher located an isomorphism, which Matcher did not.
+	MismatchMatcher = "matcher"
+)
+
+// A Mismatch records the furthest point at which the search for an isomorphism
+// of a control flow primitive failed; i.e. the point at which the largest
+// number of nodes of the primitive had been mapped. A nil Mismatch records
+// nothing.
+type Mismatch struct {
+	// Name of the primitive.
+	Prim string `json:"prim"`
+	// Kind of the mismatch (e.g. "successor").
+	Kind string `json:"kind"`
+	// Role of the primitive at the point of mismatch; e.g. the role which could
+	// not be mapped, or the role of the node the successors of which mismatch.
+	Role string `json:"role,omitempty"`
+	// Node of the control flow graph at the point of mismatch; e.g. the node
+	// mapped to Role, or the mapped neighbour of an unmappable role.
+	Node string `json:"node,omitempty"`
+	// Edge of the control flow graph at the point of mismatch, if any; e.g. a
+	// missing, unexpected or mislabeled edge.
+	Edge *[2]string `json:"edge,omitempty"`
+	// Number of mapped nodes of the primitive at the point of mismatch.
+	Depth int `json:"depth"`
+	// Reason of the mismatch.
+	Reason string `json:"reason"`
+}
+
+// record records the given mismatch at the given depth, unless a mismatch at
+// the same depth or further has already been recorded. The kind, role, graph
+// node and edge of the mismatch are described by Mismatch; the names of the
+// graph node and edge are recorded unquoted (see unquoteNames).
+func (mm *Mismatch) record(depth int, kind, role, node string, edge *[2]string, format string, a ...interface{}) {
+	if mm == nil || (len(mm.Reason) > 0 && depth <= mm.Depth) {
+		return
+	}
+	mm.Kind, mm.Role, mm.Node, mm.Edge = kind, role, unquote(node), nil
+	if edge != nil {
+		mm.Edge = &[2]string{unquote(edge[0]), unquote(edge[1])}
+	}
+	mm.Depth = depth
+	mm.Reason = fmt.Sprintf(format, a...)
+}
+
+// explainMismatch returns the furthest point of mismatch of the search for an
+// isomorphism of sub in graph, considering every node of graph as candidate
+// entry node.
+func explainMismatch(graph *dot.Graph, sub *graphs.SubGraph, labels edgeLabels) *Mismatch {
+	if ms, ok := Matcher.(MismatchSearcher); ok && usesMatcher(sub) {
+		if mm := ms.Mismatch(graph, sub); mm != nil {
+			mm.Prim = sub.Name
+			return mm
+		}
+		return &Mismatch{Prim: sub.Name, Kind: MismatchMatcher, Reason: "isomorphism not located by Matcher"}
+	}
+	mm := &Mismatch{Prim: sub.Name}
+	for _, node := range graph.Nodes.Nodes {
+		if _, ok := isomorphism(graph, node, sub, labels, mm); ok {
+			// The local matcher and Matcher disagree.
+			return &Mismatch{Prim: sub.Name, Kind: MismatchMatcher, Reason: "no isomorphism located by Matcher"}
+		}
+	}
+	return mm
+}
+
+// usesMatcher reports whether the primitive sub is located by Matcher, rather
+// than by the local matcher of search (see findPrim).
+func usesMatcher(sub *graphs.SubGraph) bool {
+	switch {
+	case len(wildcards(sub)) > 0, flagPostdomFollow && isConditional(sub), hasEdgeLabels(sub) || hasValueNodes(sub):
+		return false
+	}
+	return true
+}
+
+// candidateMismatch returns the reason for which no graph node could be mapped
+// to the sub node s, given the partial mapping m, and the mapped neighbour of s
+// from which the candidates were taken, if any.
+func candidateMismatch(s *dot.Node, m map[string]*dot.Node) (node, reason string) {
+	for _, pred := range s.Preds {
+		if g, ok := m[pred.Name]; ok {
+			return g.Name, fmt.Sprintf("no successor of node %q (as %q) is left to map %q to", unquote(g.Name), pred.Name, s.Name)
+		}
+	}
+	for _, succ := range s.Succs {
+		if g, ok := m[succ.Name]; ok {
+			return g.Name, fmt.Sprintf("no predecessor of node %q (as %q) is left to map %q to", unquote(g.Name), succ.Name, s.Name)
+		}
+	}
+	return "", fmt.Sprintf("no node is left to map %q to", s.Name)
+}
+
+// degreeMismatch returns the reason for which the successors (or predecessors)
+// gs of the graph node g do not match the successors (or predecessors) ss of
+// the sub node s, under the mapping m, and the missing (or first unexpected)
+// edge. The kind of the neighbours is either "successor" or "predecessor".
+func degreeMismatch(kind string, s *dot.Node, ss []*dot.Node, g *dot.Node, gs []*dot.Node, m map[string]*dot.Node) (*[2]string, string) {
+	// edge returns the edge between g and its neighbour x.
+	edge := func(x string) *[2]string {
+		if kind == MismatchPredecessor {
+			return &[2]string{x, g.Name}
+		}
+		return &[2]string{g.Name, x}
+	}
+	have := make(map[*dot.Node]bool)
+	for _, x := range gs {
+		have[x] = true
+	}
+	want := make(map[*dot.Node]bool)
+	for _, x := range ss {
+		want[m[x.Name]] = true
+		if !have[m[x.Name]] {
+			return edge(m[x.Name].Name), fmt.Sprintf("node %q (as %q) lacks %s %q (as %q)", unquote(g.Name), s.Name, kind, unquote(m[x.Name].Name), x.Name)
+		}
+	}
+	var extra []string
+	for x := range have {
+		if !want[x] {
+			extra = append(extra, unquote(x.Name))
+		}
+	}
+	sort.Strings(extra)
+	var e *[2]string
+	if len(extra) > 0 {
+		e = edge(extra[0])
+	}
+	return e, fmt.Sprintf("node %q (as %q) has %d %s(s) but %q requires %d; unexpected %q", unquote(g.Name), s.Name, len(have), kind, s.Name, len(want), extra)
+}
+
+// mismatches returns the furthest points of mismatch of the given primitives,
+// in order of priority, which could not be located in graph. Variants of a
+// primitive share its name, and only the furthest mismatch among the variants
+// is reported.
+func mismatches(graph *dot.Graph, rejected []*graphs.SubGraph, labels edgeLabels) []*Mismatch {
+	var names []string
+	furthest := make(map[string]*Mismatch)
+	for _, sub := range rejected {
+		mm := explainMismatch(graph, sub, labels)
+		prev, ok := furthest[sub.Name]
+		if !ok {
+			names = append(names, sub.Name)
+		}
+		if !ok || len(prev.Reason) == 0 || mm.Depth > prev.Depth {
+			furthest[sub.Name] = mm
+		}
+	}
+	var list []*Mismatch
+	for _, name := range names {
+		list = append(list, furthest[name])
+	}
+	return list
+}
+
+// rejections returns the reasons of the given points of mismatch, for explain
+// mode.
+func rejections(mms []*Mismatch) []string {
+	var list []string
+	for _, mm := range mms {
+		list = append(list, fmt.Sprintf("%q: %s", mm.Prim, mm.Reason))
+	}
+	return list
+}
+
+// printExplanation prints the rationale of a reduction step to w; the node
+// mapping m of the located primitive sub, which was merged into node, and the
+// reasons for which the primitives of higher priority were rejected. A nil sub
+// denotes that no primitive could be located.
+func printExplanation(w io.Writer, sub *graphs.SubGraph, m map[string]string, node string, reasons []string) {
+	if sub == nil {
+		fmt.Fprintln(w, "No control flow primitive located:")
+	} else {
+		var snames []string
+		for sname := range m {
+			snames = append(snames, sname)
+		}
+		sort.Strings(snames)
+		var pairs []string
+		for _, sname := range snames {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", sname, unquote(m[sname])))
+		}
+		fmt.Fprintf(w, "Located %q at node %q (%s); merged into %q:\n", sub.Name, unquote(m[sub.Entry()]), strings.Join(pairs, ", "), node)
+	}
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "   rejected %s\n", reason)
+	}
+}
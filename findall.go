@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+
+	"github.com/mewfork/dot"
+)
+
+// FindAllPrims returns every location in graph at which each primitive of subs
+// matches, in the order of subs and the node order of graph, without merging
+// any nodes; the graph is not modified. For each primitive (and each variant of
+// a primitive with optional nodes), at most one match is reported per entry
+// node.
+//
+// The results are candidates, not a committed reduction; the matches may
+// overlap, and the super-node of each candidate primitive is left empty. They
+// expose the branching points of the greedy reduction of restructure, which
+// merges the first match of the first matching primitive. The candidates are
+// located by the local matcher of search, which follows the semantics of
+// iso.Search; primitives located without a template (e.g. switches) are not
+// included.
+func FindAllPrims(graph *dot.Graph) []*Primitive {
+	labels := newEdgeLabels(graph)
+	var prims []*Primitive
+	for _, sub := range subs {
+		for _, node := range graph.Nodes.Nodes {
+			m, ok := isomorphism(graph, node, sub, labels, nil)
+			if !ok {
+				continue
+			}
+			prim := newPrimitive(sub, m, "")
+			unquoteNames(prim)
+			if !containsMatch(prims, sub.Name, prim.Nodes) {
+				prims = append(prims, prim)
+			}
+		}
+	}
+	return prims
+}
+
+// containsMatch reports whether prims contains a primitive with the given name
+// and node mapping.
+func containsMatch(prims []*Primitive, name string, m map[string]string) bool {
+	for _, prim := range prims {
+		if prim.Prim == name && reflect.DeepEqual(prim.Nodes, m) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+)
+
+// fingerprint returns a structural hash of the given control flow primitives,
+// which is invariant to the names of the nodes in the original control flow
+// graph. Only the primitive types, their node roles and the nesting of
+// primitives contribute to the hash; two control flow graphs with identical
+// structure therefore have identical fingerprints, regardless of node names.
+//
+// The primitives are expected to be ordered as located by restructure, so that
+// each super-node is defined before it is referenced.
+func fingerprint(prims []*Primitive) string {
+	sum := sha1.Sum([]byte(canonical(prims)))
+	return hex.EncodeToString(sum[:])
+}
+
+// canonical returns the canonical form of the primitive tree of prims, as used
+// by fingerprint. Each primitive is written as "prim(role=child,...)" with its
+// roles sorted, where child is either the canonical form of a nested primitive
+// or "*" for a node of the original control flow graph. The canonical forms of
+// the root primitives (i.e. primitives not nested within any other primitive)
+// are separated by semicolons, in the order they were located.
+func canonical(prims []*Primitive) string {
+	canons, nested := canonicals(prims)
+	buf := &bytes.Buffer{}
+	for i := range prims {
+		if nested[i] {
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteString(";")
+		}
+		buf.WriteString(canons[i])
+	}
+	return buf.String()
+}
+
+// canonicals returns the canonical form of the primitive tree rooted at each
+// of the given primitives, as described by canonical, and the indices of the
+// primitives nested within another primitive.
+func canonicals(prims []*Primitive) (canons []string, nested map[int]bool) {
+	nodes := primTree(prims)
+	// canons maps from primitive index to its canonical form.
+	canons = make([]string, len(prims))
+	// index maps from primitive tree node to primitive index.
+	index := make(map[*primNode]int)
+	nested = make(map[int]bool)
+	for i, n := range nodes {
+		index[n] = i
+		if n.parent != nil {
+			nested[i] = true
+		}
+		buf := &bytes.Buffer{}
+		buf.WriteString(n.prim.Prim)
+		buf.WriteString("(")
+		for j, role := range n.roles() {
+			if j > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString(role)
+			buf.WriteString("=")
+			if child, ok := n.children[role]; ok {
+				buf.WriteString(canons[index[child]])
+			} else {
+				buf.WriteString("*")
+			}
+		}
+		buf.WriteString(")")
+		canons[i] = buf.String()
+	}
+	return canons, nested
+}
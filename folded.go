@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// foldedRoot is the name of the root frame of the folded stacks, which spans
+// the primitive trees of the control flow graph.
+const foldedRoot = "root"
+
+// writeFolded writes the primitive tree of the given control flow primitives to
+// w, as folded stacks for flame graph renderers (e.g. "root;if0;list0 2"). Each
+// primitive is a frame named after its super-node, nested within the frame of
+// the primitive which contains it, and one line is written per primitive
+// directly covering nodes of the original control flow graph. The value of a
+// line is the number of original nodes directly covered by the primitive, or
+// their total weight if the "-weight-attr" flag is set; as a flame graph sums
+// nested frames, the width of each frame is then the size (or weight) of the
+// region of its primitive. Lines are written in the order located.
+func writeFolded(w io.Writer, prims []*Primitive) error {
+	nodes := primTree(prims)
+	if err := checkDepth(nodes); err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		var value float64
+		if len(flagWeightAttr) > 0 {
+			value = n.prim.Weight
+			for _, child := range n.children {
+				value -= child.prim.Weight
+			}
+		} else {
+			value = float64(len(n.prim.Nodes) - len(n.children))
+		}
+		if value == 0 {
+			continue
+		}
+		// Walk the tree upwards to the root primitive.
+		var frames []string
+		for p := n; p != nil; p = p.parent {
+			frames = append(frames, foldedFrame(p.prim.Node))
+		}
+		frames = append(frames, foldedRoot)
+		for i, j := 0, len(frames)-1; i < j; i, j = i+1, j-1 {
+			frames[i], frames[j] = frames[j], frames[i]
+		}
+		if _, err := fmt.Fprintf(w, "%s %s\n", strings.Join(frames, ";"), strconv.FormatFloat(value, 'f', -1, 64)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// foldedFrame returns the given name as a frame of a folded stack, with the
+// frame separator and line breaks replaced.
+func foldedFrame(name string) string {
+	return strings.NewReplacer(";", "_", "\n", "_", "\r", "_").Replace(name)
+}
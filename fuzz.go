@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// In order-fuzzing mode (the "-fuzz-order" flag), the control flow graph is
+// restructured using N pseudo-random orderings of the primitive set, in
+// addition to the ordering in effect, to detect order-sensitivity of the
+// primitive set. An ordering reduces differently if it changes whether the
+// graph is fully reduced, or the structural fingerprint of the recovered
+// primitives (see fingerprint); i.e. the result itself, rather than the names
+// of the super-nodes. A primitive set which fully reduces a graph under some
+// orderings only likely contains primitives which overlap in ways unintended
+// by its design.
+//
+// The orderings are seeded by fuzzSeed, and are thus the same across runs.
+// Variants of a primitive (e.g. those of optional nodes) keep their relative
+// order.
+
+// Kinds of differences of order-fuzzing mode.
+const (
+	// The ordering changes whether the graph is fully reduced; this indicates
+	// a design problem of the primitive set.
+	fuzzReducibility = "reducibility"
+	// The ordering changes the structure of the recovered primitives, e.g. the
+	// nesting of lists, but not whether the graph is fully reduced.
+	fuzzStructure = "structure"
+)
+
+// fuzzSeed is the seed of the pseudo-random orderings of order-fuzzing mode.
+const fuzzSeed = 1
+
+// A fuzzReport is the report of order-fuzzing mode.
+type fuzzReport struct {
+	// Outcome of the ordering in effect.
+	Base *fuzzOutcome `json:"base"`
+	// Number of pseudo-random orderings tried.
+	Orderings int `json:"orderings"`
+	// Outcomes of the orderings which reduce differently than the ordering in
+	// effect, in the order tried.
+	Differences []*fuzzOutcome `json:"differences"`
+}
+
+// A fuzzOutcome is the outcome of restructuring a control flow graph using an
+// ordering of the primitive set.
+type fuzzOutcome struct {
+	// Primitive names in order of priority, as accepted by the "-order" flag.
+	Order []string `json:"order"`
+	// Fully reduced.
+	Reduced bool `json:"reduced"`
+	// Structural fingerprint of the recovered primitives, if fully reduced.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Kind of the difference to the ordering in effect (e.g. "reducibility"),
+	// if any.
+	Difference string `json:"difference,omitempty"`
+}
+
+// fuzzOrder restructures the given control flow graph using n pseudo-random
+// orderings of subs, and returns the report of the orderings which reduce
+// differently than subs. Errors other than stalled reductions abort the
+// search.
+func fuzzOrder(dotPath string, n int) (*fuzzReport, error) {
+	graph, err := parseGraph(dotPath)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	orig := subs
+	defer func() { subs = orig }()
+	// outcome restructures a copy of graph using the primitives of subs,
+	// ordered by the given names.
+	outcome := func(names []string) (*fuzzOutcome, error) {
+		set, err := reorder(orig, names)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+		g, err := cloneGraph(graph)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+		subs = set
+		out := &fuzzOutcome{Order: names}
+		prims, err := Restructure(g)
+		if err != nil {
+			if e, ok := err.(*Error); ok && e.Kind == KindUnreduced {
+				return out, nil
+			}
+			return nil, err
+		}
+		out.Reduced = true
+		out.Fingerprint = fingerprint(prims)
+		return out, nil
+	}
+	names := primNames(orig)
+	base, err := outcome(names)
+	if err != nil {
+		return nil, err
+	}
+	report := &fuzzReport{Base: base, Orderings: n, Differences: []*fuzzOutcome{}}
+	r := rand.New(rand.NewSource(fuzzSeed))
+	for i := 0; i < n; i++ {
+		var order []string
+		for _, j := range r.Perm(len(names)) {
+			order = append(order, names[j])
+		}
+		out, err := outcome(order)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case out.Reduced != base.Reduced:
+			out.Difference = fuzzReducibility
+		case out.Fingerprint != base.Fingerprint:
+			out.Difference = fuzzStructure
+		default:
+			continue
+		}
+		report.Differences = append(report.Differences, out)
+	}
+	return report, nil
+}
+
+// writeFuzz writes the given order-fuzzing report as JSON to w.
+func writeFuzz(w io.Writer, report *fuzzReport) error {
+	buf, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	_, err = w.Write(buf)
+	return err
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/mewfork/dot"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// excludeNodes returns a copy of graph with the given nodes removed.
+//
+// Edges incident to excluded nodes are rewired as follows. For every edge
+// p -> n, where p is a retained node and n is an excluded node, a new edge
+// p -> s is added for every retained node s which is reachable from n through
+// excluded nodes only. The new edges inherit the attributes (e.g. branch
+// labels) of the original edge p -> n, and duplicate edges are omitted. Edges
+// between excluded nodes are dropped. Consequently, a retained node reaches
+// another retained node in the new graph if and only if it did so in the
+// original graph; paths which only ever pass through excluded nodes (such as a
+// cycle consisting solely of excluded nodes) are not preserved.
+//
+// The entry node of the graph may not be excluded.
+func excludeNodes(graph *dot.Graph, names []string) (*dot.Graph, error) {
+	excluded := make(map[string]bool)
+	for _, name := range names {
+		node, ok := lookupNode(graph, name)
+		if !ok {
+			return nil, errutil.Newf("unable to exclude node %q; no such node", name)
+		}
+		if isEntry(node) {
+			return nil, errutil.Newf("unable to exclude entry node %q", name)
+		}
+		excluded[node.Name] = true
+	}
+
+	// succs maps from node name to the successors of the node, in edge order.
+	succs := make(map[string][]string)
+	for _, e := range graph.Edges.Edges {
+		succs[e.Src] = append(succs[e.Src], e.Dst)
+	}
+
+	// targets returns the retained nodes reachable from the excluded node n
+	// through excluded nodes only.
+	targets := func(n string) []string {
+		var ts []string
+		seen := map[string]bool{n: true}
+		var visit func(n string)
+		visit = func(n string) {
+			for _, s := range succs[n] {
+				if seen[s] {
+					continue
+				}
+				seen[s] = true
+				if excluded[s] {
+					visit(s)
+					continue
+				}
+				ts = append(ts, s)
+			}
+		}
+		visit(n)
+		return ts
+	}
+
+	var nodes []*dot.Node
+	for _, node := range graph.Nodes.Nodes {
+		if !excluded[node.Name] {
+			nodes = append(nodes, node)
+		}
+	}
+	var edges []*dot.Edge
+	added := make(map[[2]string]bool)
+	addEdge := func(e *dot.Edge) {
+		key := [2]string{e.Src, e.Dst}
+		if added[key] {
+			return
+		}
+		added[key] = true
+		edges = append(edges, e)
+	}
+	for _, e := range graph.Edges.Edges {
+		switch {
+		case excluded[e.Src]:
+			// Dropped or rewired through a retained predecessor.
+		case excluded[e.Dst]:
+			for _, t := range targets(e.Dst) {
+				addEdge(&dot.Edge{Src: e.Src, Dst: t, Attrs: e.Attrs})
+			}
+		default:
+			addEdge(e)
+		}
+	}
+	return newGraph(graph.Name, nodes, edges)
+}
+
+// removeVirtualRoot returns a copy of graph without the given virtual root; a
+// synthetic node with edges to each real entry node (e.g. as used for
+// interprocedural analysis), as specified by the "-virtual-root" flag. The
+// successors of the virtual root are labeled "entry" in its place.
+//
+// With several real entry nodes, the region reachable from each real entry
+// node is typically a weakly connected component of its own, which may be
+// restructured separately using the "-components" flag. A component reached
+// from several real entry nodes is a multi-entry region, which may not be
+// reduced into a single node.
+func removeVirtualRoot(graph *dot.Graph, name string) (*dot.Graph, error) {
+	root, ok := lookupNode(graph, name)
+	if !ok {
+		return nil, errutil.Newf("unable to remove virtual root %q; no such node", name)
+	}
+	if len(root.Preds) > 0 {
+		return nil, errutil.Newf("unable to remove virtual root %q; node has predecessors", name)
+	}
+	if len(root.Succs) == 0 {
+		return nil, errutil.Newf("unable to remove virtual root %q; node has no successors", name)
+	}
+	entries := make(map[string]bool)
+	for _, succ := range root.Succs {
+		entries[succ.Name] = true
+	}
+	var nodes []*dot.Node
+	for _, node := range graph.Nodes.Nodes {
+		if node == root {
+			continue
+		}
+		if entries[node.Name] && !isEntry(node) {
+			n := &dot.Node{Name: node.Name, Attrs: make(dot.Attrs)}
+			for key, val := range node.Attrs {
+				n.Attrs[key] = val
+			}
+			n.Attrs["label"] = "entry"
+			node = n
+		}
+		nodes = append(nodes, node)
+	}
+	var edges []*dot.Edge
+	for _, e := range graph.Edges.Edges {
+		if e.Src != name {
+			edges = append(edges, e)
+		}
+	}
+	return newGraph(graph.Name, nodes, edges)
+}
+
+// reverseGraph returns the reverse of the given control flow graph, as
+// specified by the "-reverse" flag; i.e. the graph with the direction of each
+// edge reversed, for recovering post-dominator-oriented structure by backward
+// analysis. The roles of the entry and exit nodes are swapped; the exit node of
+// graph, either labeled "exit" or the only node without successors, becomes
+// the entry node of the reverse graph, and the entry node becomes its exit.
+//
+// The reverse graph has a well-defined single entry node only if graph has a
+// single exit node, which is reachable from every node of graph; otherwise,
+// e.g. for graphs with several return blocks or an infinite loop, an error is
+// returned.
+func reverseGraph(graph *dot.Graph) (*dot.Graph, error) {
+	var exits, terminals []*dot.Node
+	for _, node := range graph.Nodes.Nodes {
+		if attr(node.Attrs, "label") == "exit" {
+			exits = append(exits, node)
+		}
+		if len(node.Succs) == 0 {
+			terminals = append(terminals, node)
+		}
+	}
+	if len(exits) == 0 {
+		exits = terminals
+	}
+	if len(exits) != 1 {
+		var names []string
+		for _, node := range exits {
+			names = append(names, node.Name)
+		}
+		return nil, errutil.Newf("unable to reverse graph %q; no single exit node to become the entry node, got %d (%q)", graph.Name, len(exits), names)
+	}
+	exit := exits[0]
+	// Locate the nodes from which the exit node is unreachable.
+	reaches := map[*dot.Node]bool{exit: true}
+	stack := []*dot.Node{exit}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, pred := range n.Preds {
+			if !reaches[pred] {
+				reaches[pred] = true
+				stack = append(stack, pred)
+			}
+		}
+	}
+	var unreached []string
+	for _, node := range graph.Nodes.Nodes {
+		if !reaches[node] {
+			unreached = append(unreached, node.Name)
+		}
+	}
+	if len(unreached) > 0 {
+		return nil, errutil.Newf("unable to reverse graph %q; exit node %q is unreachable from %q", graph.Name, exit.Name, unreached)
+	}
+	var nodes []*dot.Node
+	for _, node := range graph.Nodes.Nodes {
+		n := &dot.Node{Name: node.Name, Attrs: make(dot.Attrs)}
+		for key, val := range node.Attrs {
+			n.Attrs[key] = val
+		}
+		switch {
+		case node == exit:
+			n.Attrs["label"] = "entry"
+		case isEntry(node):
+			n.Attrs["label"] = "exit"
+		}
+		nodes = append(nodes, n)
+	}
+	var edges []*dot.Edge
+	for _, e := range graph.Edges.Edges {
+		edges = append(edges, &dot.Edge{Src: e.Dst, Dst: e.Src, Attrs: e.Attrs})
+	}
+	return newGraph(graph.Name, nodes, edges)
+}
+
+// newGraph returns a new graph with the given name, nodes and edges. The nodes
+// and edges are copied, and the predecessors and successors of each node are
+// recomputed from the edges.
+func newGraph(name string, nodes []*dot.Node, edges []*dot.Edge) (*dot.Graph, error) {
+	buf := &bytes.Buffer{}
+	if len(name) > 0 {
+		fmt.Fprintf(buf, "digraph %s {\n", quoteID(name))
+	} else {
+		buf.WriteString("digraph {\n")
+	}
+	// Nodes are declared before the edges, as the parser orders nodes by first
+	// mention; the node order of the graph is thus the order of nodes.
+	for _, node := range nodes {
+		fmt.Fprintf(buf, "\t%s%s\n", quoteID(node.Name), formatAttrs(node.Attrs))
+	}
+	for _, e := range edges {
+		fmt.Fprintf(buf, "\t%s -> %s%s\n", quoteID(e.Src), quoteID(e.Dst), formatAttrs(e.Attrs))
+	}
+	buf.WriteString("}\n")
+	graph, err := dot.Read(buf.Bytes())
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	return graph, nil
+}
+
+// FromEdges returns a control flow graph with the given nodes and directed
+// edges, for use with Restructure; the entry node is labeled "entry". Each node
+// referenced by an edge must be declared in nodes, and the entry node must
+// exist.
+func FromEdges(entry string, nodes []string, edges [][2]string) (*dot.Graph, error) {
+	declared := make(map[string]bool)
+	var ns []*dot.Node
+	for _, name := range nodes {
+		if len(name) == 0 {
+			return nil, errutil.New("invalid node; empty name")
+		}
+		if declared[name] {
+			return nil, errutil.Newf("invalid node %q; declared more than once", name)
+		}
+		declared[name] = true
+		node := &dot.Node{Name: name}
+		if name == entry {
+			node.Attrs = dot.Attrs{"label": "entry"}
+		}
+		ns = append(ns, node)
+	}
+	if !declared[entry] {
+		return nil, errutil.Newf("invalid entry node %q; no such node", entry)
+	}
+	var es []*dot.Edge
+	for _, e := range edges {
+		for _, name := range e {
+			if !declared[name] {
+				return nil, errutil.Newf("invalid edge %q -> %q; undeclared node %q", e[0], e[1], name)
+			}
+		}
+		es = append(es, &dot.Edge{Src: e[0], Dst: e[1]})
+	}
+	return newGraph("", ns, es)
+}
+
+// regionExits returns the edges of graph leaving the given region, sorted by
+// source and destination node name.
+func regionExits(graph *dot.Graph, region map[string]bool) [][2]string {
+	var exits [][2]string
+	for name := range region {
+		for _, succ := range graph.Nodes.Lookup[name].Succs {
+			if !region[succ.Name] {
+				exits = append(exits, [2]string{name, succ.Name})
+			}
+		}
+	}
+	sort.Sort(edgesByName(exits))
+	return exits
+}
+
+// edgesByName implements sort.Interface, sorting edges by source and
+// destination node name.
+type edgesByName [][2]string
+
+func (es edgesByName) Len() int { return len(es) }
+func (es edgesByName) Less(i, j int) bool {
+	if es[i][0] != es[j][0] {
+		return es[i][0] < es[j][0]
+	}
+	return es[i][1] < es[j][1]
+}
+func (es edgesByName) Swap(i, j int) { es[i], es[j] = es[j], es[i] }
+
+// cloneGraph returns a copy of the given graph, which may be modified (e.g. by
+// merge.Merge) without affecting the original graph. The nodes and edges of
+// the copy are in the same order as those of graph.
+func cloneGraph(graph *dot.Graph) (*dot.Graph, error) {
+	return newGraph(graph.Name, graph.Nodes.Nodes, graph.Edges.Edges)
+}
+
+// collapseParallelEdges collapses the parallel edges between each pair of nodes
+// of graph into a single structural edge, which keeps the attributes of the
+// first parallel edge. The labels of the parallel edges are tracked by
+// edgeLabels. The graph is modified in place, and left unmodified if it has no
+// parallel edges.
+func collapseParallelEdges(graph *dot.Graph) error {
+	seen := make(map[[2]string]bool)
+	var edges []*dot.Edge
+	for _, e := range graph.Edges.Edges {
+		key := [2]string{e.Src, e.Dst}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		edges = append(edges, e)
+	}
+	if len(edges) == len(graph.Edges.Edges) {
+		return nil
+	}
+	g, err := newGraph(graph.Name, graph.Nodes.Nodes, edges)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	*graph = *g
+	return nil
+}
+
+// mergeRegion merges the given nodes of graph into a single super-node, named
+// by the first unused name of the form "prefixN" (for N = 0, 1, ...), and
+// returns the name of the super-node. Edges within the region are dropped, and
+// edges into and out of the region are redirected to the super-node, keeping
+// their attributes; duplicate edges are omitted. The super-node is labeled
+// "entry" if the region contains the entry node of graph. The graph is
+// modified in place.
+//
+// Unlike merge.Merge, which requires a single exit node, mergeRegion preserves
+// every edge leaving the region.
+func mergeRegion(graph *dot.Graph, names []string, prefix string) (string, error) {
+	region := make(map[string]bool)
+	for _, name := range names {
+		region[name] = true
+	}
+	var name string
+	for i := 0; ; i++ {
+		name = fmt.Sprintf("%s%d", prefix, i)
+		if !nameTaken(graph, name) {
+			break
+		}
+	}
+	// The super-node is placed at the position of the first region node.
+	super := &dot.Node{Name: name}
+	var nodes []*dot.Node
+	placed := false
+	for _, node := range graph.Nodes.Nodes {
+		if !region[node.Name] {
+			nodes = append(nodes, node)
+			continue
+		}
+		if isEntry(node) {
+			super.Attrs = dot.Attrs{"label": "entry"}
+		}
+		if !placed {
+			nodes = append(nodes, super)
+			placed = true
+		}
+	}
+	var edges []*dot.Edge
+	added := make(map[[2]string]bool)
+	for _, e := range graph.Edges.Edges {
+		src, dst := e.Src, e.Dst
+		if region[src] && region[dst] {
+			continue
+		}
+		if region[src] {
+			src = name
+		}
+		if region[dst] {
+			dst = name
+		}
+		key := [2]string{src, dst}
+		if added[key] {
+			continue
+		}
+		added[key] = true
+		edges = append(edges, &dot.Edge{Src: src, Dst: dst, Attrs: e.Attrs})
+	}
+	g, err := newGraph(graph.Name, nodes, edges)
+	if err != nil {
+		return "", errutil.Err(err)
+	}
+	*graph = *g
+	return name, nil
+}
+
+// nameTaken reports whether the given name is used by a node of graph, either
+// as is or quoted; i.e. whether a node of the same unquoted name exists.
+func nameTaken(graph *dot.Graph, name string) bool {
+	_, ok := lookupNode(graph, name)
+	return ok
+}
+
+// lookupNode returns the node of graph with the given unquoted name, which is
+// either used as is or quoted by the node (see unquoteNames).
+func lookupNode(graph *dot.Graph, name string) (*dot.Node, bool) {
+	if node, ok := graph.Nodes.Lookup[name]; ok {
+		return node, true
+	}
+	node, ok := graph.Nodes.Lookup[strconv.Quote(name)]
+	return node, ok
+}
+
+// formatAttrs returns the DOT attribute list of attrs, or the empty string if
+// attrs is empty.
+func formatAttrs(attrs dot.Attrs) string {
+	if len(attrs) == 0 {
+		return ""
+	}
+	var keys []string
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	buf := &bytes.Buffer{}
+	buf.WriteString(" [")
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(buf, "%s=%s", quoteID(key), quoteID(attrs[key]))
+	}
+	buf.WriteString("]")
+	return buf.String()
+}
+
+// quoteID returns s as a DOT identifier, quoting it unless it is already a
+// valid identifier or quoted string.
+func quoteID(s string) string {
+	if isID(s) {
+		return s
+	}
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return s
+	}
+	return strconv.Quote(s)
+}
+
+// isID reports whether s is a valid unquoted DOT identifier; i.e. a string of
+// alphabetic characters, underscores and digits not beginning with a digit, or
+// a numeral.
+func isID(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	if isNumeral(s) {
+		return true
+	}
+	for i, r := range s {
+		switch {
+		case r == '_', 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z':
+		case '0' <= r && r <= '9':
+			if i == 0 {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isNumeral reports whether s is a DOT numeral consisting of digits and at
+// most one decimal point.
+func isNumeral(s string) bool {
+	digits, dots := 0, 0
+	for _, r := range s {
+		switch {
+		case '0' <= r && r <= '9':
+			digits++
+		case r == '.':
+			dots++
+		default:
+			return false
+		}
+	}
+	return digits > 0 && dots <= 1
+}
+
+// unquote returns s with surrounding double quotes removed, if present.
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		if t, err := strconv.Unquote(s); err == nil {
+			return t
+		}
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// attr returns the unquoted value of the given attribute, or the empty string
+// if not present.
+func attr(attrs dot.Attrs, key string) string {
+	return unquote(attrs[key])
+}
+
+// isEntry reports whether the given node is the entry node of its graph.
+func isEntry(node *dot.Node) bool {
+	return attr(node.Attrs, "label") == "entry"
+}
+
+// sccs returns the strongly connected components of the given graph, in
+// reverse topological order, using Tarjan's algorithm.
+func sccs(graph *dot.Graph) [][]*dot.Node {
+	var (
+		comps   [][]*dot.Node
+		stack   []*dot.Node
+		index   = make(map[*dot.Node]int)
+		lowlink = make(map[*dot.Node]int)
+		onStack = make(map[*dot.Node]bool)
+	)
+	var visit func(n *dot.Node)
+	visit = func(n *dot.Node) {
+		index[n] = len(index)
+		lowlink[n] = index[n]
+		stack = append(stack, n)
+		onStack[n] = true
+		for _, succ := range n.Succs {
+			if _, ok := index[succ]; !ok {
+				visit(succ)
+				if lowlink[succ] < lowlink[n] {
+					lowlink[n] = lowlink[succ]
+				}
+			} else if onStack[succ] && index[succ] < lowlink[n] {
+				lowlink[n] = index[succ]
+			}
+		}
+		if lowlink[n] != index[n] {
+			return
+		}
+		var comp []*dot.Node
+		for {
+			x := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[x] = false
+			comp = append(comp, x)
+			if x == n {
+				break
+			}
+		}
+		comps = append(comps, comp)
+	}
+	for _, node := range graph.Nodes.Nodes {
+		if _, ok := index[node]; !ok {
+			visit(node)
+		}
+	}
+	return comps
+}
+
+// sccEntries returns the entry nodes of the given strongly connected
+// component; i.e. the nodes with a predecessor outside of the component, or
+// the entry node of the graph. The entries are returned in the order of comp.
+func sccEntries(comp []*dot.Node) []*dot.Node {
+	in := make(map[*dot.Node]bool)
+	for _, n := range comp {
+		in[n] = true
+	}
+	var entries []*dot.Node
+	for _, n := range comp {
+		if isEntry(n) {
+			entries = append(entries, n)
+			continue
+		}
+		for _, pred := range n.Preds {
+			if !in[pred] {
+				entries = append(entries, n)
+				break
+			}
+		}
+	}
+	return entries
+}
+
+// isCyclic reports whether the given strongly connected component contains a
+// cycle; i.e. whether it has more than one node or a self-loop.
+func isCyclic(comp []*dot.Node) bool {
+	if len(comp) > 1 {
+		return true
+	}
+	for _, succ := range comp[0].Succs {
+		if succ == comp[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// componentCount returns the number of weakly connected components of the
+// given graph; i.e. the number of components when ignoring edge directions.
+func componentCount(graph *dot.Graph) int {
+	return len(components(graph))
+}
+
+// components returns the weakly connected components of the given graph,
+// ordered by their first node in the node order of graph. The nodes of each
+// component are in the node order of graph.
+func components(graph *dot.Graph) [][]*dot.Node {
+	comp := make(map[*dot.Node]int)
+	n := 0
+	for _, node := range graph.Nodes.Nodes {
+		if _, ok := comp[node]; ok {
+			continue
+		}
+		comp[node] = n
+		stack := []*dot.Node{node}
+		for len(stack) > 0 {
+			x := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			for _, ns := range [][]*dot.Node{x.Succs, x.Preds} {
+				for _, y := range ns {
+					if _, ok := comp[y]; !ok {
+						comp[y] = n
+						stack = append(stack, y)
+					}
+				}
+			}
+		}
+		n++
+	}
+	comps := make([][]*dot.Node, n)
+	for _, node := range graph.Nodes.Nodes {
+		comps[comp[node]] = append(comps[comp[node]], node)
+	}
+	return comps
+}
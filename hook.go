@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mewfork/dot"
+)
+
+// PrimHook, if non-nil, is invoked for each located control flow primitive,
+// after it has been created and annotated but before it is recorded, emitted
+// and reported to Progress. It allows library users to post-process primitives
+// at the point of discovery; e.g. to suffix the primitive name of loops with
+// their estimated trip count, as specified by a node attribute. The hook may
+// rewrite the Prim, Node and Nodes of the primitive.
+//
+// The graph is a copy of the control flow graph prior to its reduction, so the
+// attributes of every original node are accessible; the graph may not be
+// modified. The primitive refers to original nodes by their unquoted names,
+// whereas quoted node names of the graph keep their quotes (e.g. "\"a:b\"").
+// If the hook renames the super-node of a primitive, the references of later
+// primitives to the super-node are renamed accordingly.
+var PrimHook func(p *Primitive, graph *dot.Graph)
+
+// MergeValidator, if non-nil, is invoked after each merge of the reduction,
+// with the control flow graph under reduction, into which the region of the
+// located control flow primitive has just been merged, and the primitive. It
+// allows library users to enforce invariants of the graph during development;
+// e.g. that the in-degree of the super-node equals that of the entry node of
+// the region. If the validator returns an error, the reduction is aborted with
+// an error of kind KindValidation, which identifies the failed reduction step.
+//
+// The primitive is passed prior to its annotation, and refers to the nodes of
+// the graph by their names in the graph. Neither the graph nor the primitive
+// may be modified. For the exhaustive strategy, each tentative merge of its
+// search is validated.
+var MergeValidator func(graph *dot.Graph, prim *Primitive) error
+
+// validateMerge invokes MergeValidator, if set, for the merge of the given
+// primitive into graph at the given reduction step.
+func validateMerge(graph *dot.Graph, prim *Primitive, step int) error {
+	if MergeValidator == nil {
+		return nil
+	}
+	if err := MergeValidator(graph, prim); err != nil {
+		return &Error{Kind: KindValidation, Msg: fmt.Sprintf("merge validation failed at reduction step %d (primitive %q merged into %q); %v", step, prim.Prim, prim.Node, err)}
+	}
+	return nil
+}
+
+// aliases maps from super-node name, as assigned by the reduction, to the name
+// assigned by PrimHook; i.e. to the name of the most recent super-node of that
+// name.
+type aliases map[string]string
+
+// resolve returns the name of the given node, as assigned by PrimHook.
+func (a aliases) resolve(name string) string {
+	if alias, ok := a[name]; ok {
+		return alias
+	}
+	return name
+}
+
+// apply renames the super-nodes referenced by the given primitive to the names
+// assigned by PrimHook.
+func (a aliases) apply(prim *Primitive) {
+	if len(a) == 0 {
+		return
+	}
+	nodes := make(map[string]string)
+	for role, name := range prim.Nodes {
+		nodes[role] = a.resolve(name)
+	}
+	prim.Nodes = nodes
+	prim.entry, prim.exit = a.resolve(prim.entry), a.resolve(prim.exit)
+	for i, e := range prim.Exits {
+		prim.Exits[i] = [2]string{a.resolve(e[0]), a.resolve(e[1])}
+	}
+	for i, e := range prim.ResidualEdges {
+		prim.ResidualEdges[i] = [2]string{a.resolve(e[0]), a.resolve(e[1])}
+	}
+	if len(prim.Continue) > 0 {
+		prim.Continue = a.resolve(prim.Continue)
+	}
+	if ports := prim.Ports; ports != nil {
+		for _, names := range [][]string{ports.Preds, ports.Succs} {
+			for i, name := range names {
+				names[i] = a.resolve(name)
+			}
+		}
+	}
+	for _, b := range prim.Breaks {
+		b.Edge = [2]string{a.resolve(b.Edge[0]), a.resolve(b.Edge[1])}
+		if len(b.Loop) > 0 {
+			b.Loop = a.resolve(b.Loop)
+		}
+	}
+	if prim.Attrs != nil {
+		attrs := make(map[string]map[string]string)
+		for name, as := range prim.Attrs {
+			attrs[a.resolve(name)] = as
+		}
+		prim.Attrs = attrs
+	}
+	if prim.Positions != nil {
+		positions := make(map[string]int)
+		for name, pos := range prim.Positions {
+			positions[a.resolve(name)] = pos
+		}
+		prim.Positions = positions
+	}
+}
+
+// hook invokes PrimHook on the given primitive, and records the renaming of its
+// super-node, if any. The super-nodes referenced by the primitive are renamed
+// first, as described by apply.
+func (a aliases) hook(prim *Primitive, graph *dot.Graph) {
+	a.apply(prim)
+	node := prim.Node
+	PrimHook(prim, graph)
+	if prim.Node != node {
+		a[node] = prim.Node
+	} else {
+		// A later super-node of the same name is not renamed.
+		delete(a, node)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/mewfork/dot"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// Input formats of control flow graphs, as specified by the "-input" flag.
+const (
+	inputDOT  = "dot"
+	inputJSON = "json"
+)
+
+// A jsonGraph is a control flow graph in JSON format, as accepted by the
+// "-input json" flag; e.g.
+//
+//    {
+//       "name": "foo",
+//       "entry": "E",
+//       "nodes": [{"name": "E"}, {"name": "F", "attrs": {"line": "3"}}],
+//       "edges": [{"src": "E", "dst": "F", "attrs": {"label": "T"}}]
+//    }
+//
+// The name is optional. Each node referenced by an edge must be declared in
+// nodes, and the entry node, which is labeled "entry", must exist. If no entry
+// node is specified, the entry node is located as in DOT input; i.e. the node
+// labeled "entry", or the only node without predecessors.
+type jsonGraph struct {
+	// Graph name.
+	Name string `json:"name"`
+	// Name of the entry node.
+	Entry string `json:"entry"`
+	// Nodes, in node order.
+	Nodes []*jsonNode `json:"nodes"`
+	// Directed edges.
+	Edges []*jsonEdge `json:"edges"`
+}
+
+// A jsonNode is a node of a control flow graph in JSON format.
+type jsonNode struct {
+	// Node name.
+	Name string `json:"name"`
+	// Node attributes.
+	Attrs map[string]string `json:"attrs,omitempty"`
+}
+
+// A jsonEdge is a directed edge of a control flow graph in JSON format.
+type jsonEdge struct {
+	// Names of the source and destination nodes.
+	Src string `json:"src"`
+	Dst string `json:"dst"`
+	// Edge attributes (e.g. "label").
+	Attrs map[string]string `json:"attrs,omitempty"`
+}
+
+// parseJSONGraph parses the given control flow graph in JSON format.
+func parseJSONGraph(buf []byte) (*dot.Graph, error) {
+	var g jsonGraph
+	if err := json.Unmarshal(buf, &g); err != nil {
+		return nil, errutil.Err(err)
+	}
+	declared := make(map[string]bool)
+	var nodes []*dot.Node
+	for _, n := range g.Nodes {
+		if len(n.Name) == 0 {
+			return nil, errutil.New("invalid node; empty name")
+		}
+		if declared[n.Name] {
+			return nil, errutil.Newf("invalid node %q; declared more than once", n.Name)
+		}
+		declared[n.Name] = true
+		node := &dot.Node{Name: n.Name, Attrs: make(dot.Attrs)}
+		for key, val := range n.Attrs {
+			node.Attrs[key] = val
+		}
+		if n.Name == g.Entry {
+			node.Attrs["label"] = "entry"
+		}
+		nodes = append(nodes, node)
+	}
+	if len(g.Entry) > 0 && !declared[g.Entry] {
+		return nil, errutil.Newf("invalid entry node %q; no such node", g.Entry)
+	}
+	var edges []*dot.Edge
+	for _, e := range g.Edges {
+		for _, name := range []string{e.Src, e.Dst} {
+			if !declared[name] {
+				return nil, errutil.Newf("invalid edge %q -> %q; undeclared node %q", e.Src, e.Dst, name)
+			}
+		}
+		edge := &dot.Edge{Src: e.Src, Dst: e.Dst, Attrs: make(dot.Attrs)}
+		for key, val := range e.Attrs {
+			edge.Attrs[key] = val
+		}
+		edges = append(edges, edge)
+	}
+	return newGraph(g.Name, nodes, edges)
+}
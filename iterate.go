@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/mewfork/dot"
+)
+
+// Iterate returns an iterator over the control flow primitives of the given
+// parsed control flow graph, as located by the reduction of Restructure. Each
+// call of the iterator advances the reduction by a single step and returns the
+// located primitive, so a consumer may stop early without restructuring the
+// rest of the graph. The graph is prepared and reduced in place, as by
+// Restructure.
+//
+// The iterator returns false once the graph has been fully reduced. When the
+// reduction fails (e.g. stalls), the error is returned along with true, and
+// every subsequent call returns false. Located primitives are not emitted to
+// the sinks of emitters, but are annotated as by Restructure and reported to
+// Progress.
+func Iterate(graph *dot.Graph) func() (*Primitive, error, bool) {
+	var (
+		r *reduction
+		// Coverage of the reduction, as requested by the "-assert-complete"
+		// flag.
+		cov *coverage
+		// Number of nodes of the graph prior to its reduction.
+		nodes int
+		done  bool
+	)
+	// start prepares the graph for its reduction.
+	start := func() error {
+		g, err := prepareGraph(graph)
+		if err != nil {
+			return err
+		}
+		if flagAssertComplete {
+			cov = newCoverage(g)
+		}
+		nodes = len(g.Nodes.Nodes)
+		r, err = newReduction(g, reductionSet(), nil)
+		return err
+	}
+	return func() (*Primitive, error, bool) {
+		if done {
+			return nil, nil, false
+		}
+		if r == nil {
+			if err := start(); err != nil {
+				done = true
+				return nil, err, true
+			}
+		}
+		prim, err := r.next()
+		if err != nil || prim == nil {
+			done = true
+			if err := concludeGraph(r.graph, nodes, r.prims, cov, err); err != nil {
+				return nil, err, true
+			}
+			return nil, nil, false
+		}
+		return prim, nil, true
+	}
+}
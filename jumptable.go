@@ -0,0 +1,97 @@
+package main
+
+import (
+	"decomp.org/x/graphs/primitive"
+	"github.com/mewfork/dot"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// jumpTable is the name of the jump table primitive.
+//
+// A jump table is a dispatcher node with three or more successors (its
+// targets), as produced by computed gotos and interpreter-style dispatch loops.
+// Unlike a switch, which requires its cases to converge on a common follow
+// node, the targets of a jump table may branch anywhere, including back to the
+// dispatcher. Each target must however be entered exclusively from the
+// dispatcher. As the targets do not converge, jump tables may not be described
+// by a primitive template. Instead, they are located after primitive templates,
+// switches (see switchPrim) and multi-exit loops, as the last resort of the
+// reduction.
+//
+// The dispatcher and its targets are merged into a single node. In the node
+// mapping of the primitive, the dispatcher is mapped to "A" and the targets to
+// "B", "C", etc., in successor order. The edges leaving the merged region are
+// recorded in Exits.
+const jumpTable = "jump_table"
+
+// minJumpTargets specifies the minimum number of targets of a jump table; a
+// node with two successors is a 2-way conditional.
+const minJumpTargets = 3
+
+// findJumpTable locates the first jump table of graph, in node order, and
+// merges its nodes into a single node. It returns nil if graph contains no
+// jump table.
+func findJumpTable(graph *dot.Graph, labels edgeLabels) (*Primitive, error) {
+	return findFanout(graph, labels, jumpTable, isJumpTable)
+}
+
+// findFanout locates the first dispatcher of graph, in node order, as
+// reported by match, and merges the dispatcher and its targets into a single
+// node of the given primitive type. It returns nil if graph contains no
+// dispatcher.
+func findFanout(graph *dot.Graph, labels edgeLabels, prim string, match func(node *dot.Node) bool) (*Primitive, error) {
+	for _, node := range graph.Nodes.Nodes {
+		if !match(node) {
+			continue
+		}
+		m := map[string]string{"A": node.Name}
+		region := map[string]bool{node.Name: true}
+		names := []string{node.Name}
+		for _, succ := range node.Succs {
+			m[role(len(m))] = succ.Name
+			region[succ.Name] = true
+			names = append(names, succ.Name)
+		}
+		exits := regionExits(graph, region)
+		name, err := mergeRegion(graph, names, prim)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+		labels.merge(m, name)
+		return &Primitive{
+			Primitive: &primitive.Primitive{
+				Node:  name,
+				Prim:  prim,
+				Nodes: m,
+			},
+			Exits: exits,
+			entry: node.Name,
+		}, nil
+	}
+	return nil, nil
+}
+
+// isJumpTable reports whether the given node is the dispatcher of a jump
+// table.
+func isJumpTable(node *dot.Node) bool {
+	// Indirect jump nodes are located as dispatches (see dispatchPrim).
+	return !isIndirect(node) && isFanout(node, minJumpTargets)
+}
+
+// isFanout reports whether the given node has at least min successors, each of
+// which is entered exclusively from the node.
+func isFanout(node *dot.Node, min int) bool {
+	if len(node.Succs) < min {
+		return false
+	}
+	for _, succ := range node.Succs {
+		if succ == node || isEntry(succ) {
+			return false
+		}
+		if len(succ.Preds) != 1 {
+			// Targets must be entered exclusively from the dispatcher.
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"decomp.org/x/graphs"
+	"github.com/mewfork/dot"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// In lint mode (the "-lint-prims" flag), the primitive set is analyzed without
+// processing any control flow graph, and a report of the problems found is
+// output. The primitives are loaded as for the reduction, from the "-prims" or
+// "-prims-dir" flag or the embedded default primitives, and ordered by the
+// "-order" and "-priorities" flags. Problems which would otherwise abort the
+// loading of the primitive set (e.g. a primitive without an entry node) are
+// reported as findings.
+
+// Kinds of lint findings.
+const (
+	// The primitive could not be parsed, or is otherwise malformed (e.g. an
+	// invalid wildcard node).
+	lintInvalid = "invalid"
+	// No node of the primitive is labeled "entry", or several are.
+	lintNoEntry = "no-entry"
+	// No node of the primitive is labeled "exit", or several are.
+	lintNoExit = "no-exit"
+	// Another primitive of the same name precedes the primitive.
+	lintDuplicate = "duplicate"
+	// The primitive can never match a control flow graph, the nodes of which
+	// are reachable from its entry node.
+	lintUnmatchable = "unmatchable"
+	// Wherever the primitive would match, a primitive of higher priority
+	// matches first; the primitive is never located.
+	lintShadowed = "shadowed"
+)
+
+// A lintReport is the report of the primitive-set linter.
+type lintReport struct {
+	// Names of the linted primitives, in order of priority.
+	Prims []string `json:"prims"`
+	// Problems found.
+	Findings []*lintFinding `json:"findings"`
+}
+
+// A lintFinding is a problem of the primitive set found by the linter.
+type lintFinding struct {
+	// Path of the primitive.
+	Path string `json:"path"`
+	// Name of the primitive, if known.
+	Prim string `json:"prim,omitempty"`
+	// Kind of the problem (e.g. "shadowed").
+	Kind string `json:"kind"`
+	// Description of the problem.
+	Message string `json:"message"`
+	// Names of the primitives of higher priority shadowing the primitive, for
+	// shadowed primitives.
+	ShadowedBy []string `json:"shadowed_by,omitempty"`
+}
+
+// lintPrims loads and analyzes the primitive set, and returns the report of the
+// problems found.
+//
+// A primitive is unmatchable if any of its nodes is unreachable from its entry
+// node, as every node of a matched region has the same predecessors as in the
+// primitive, and shadowed if, for each of its variants, a primitive of higher
+// priority matches within the variant when embedded in a larger graph; i.e.
+// with additional predecessors of its entry node and successors of its exit
+// node. Primitives with wildcard nodes are not checked for shadowing.
+func lintPrims() (*lintReport, error) {
+	report := &lintReport{Prims: []string{}, Findings: []*lintFinding{}}
+	add := func(path, prim, kind, format string, a ...interface{}) *lintFinding {
+		f := &lintFinding{Path: path, Prim: prim, Kind: kind, Message: fmt.Sprintf(format, a...)}
+		report.Findings = append(report.Findings, f)
+		return f
+	}
+	paths, read := lintSources()
+	var set []*graphs.SubGraph
+	// subPaths maps from primitive name to the path of the primitive.
+	subPaths := make(map[string]string)
+	for _, path := range paths {
+		graph, err := read(path)
+		if err != nil {
+			add(path, "", lintInvalid, "%v", err)
+			continue
+		}
+		name := graph.Name
+		if prev, ok := subPaths[name]; ok {
+			add(path, name, lintDuplicate, "primitive %q already defined by %q", name, prev)
+			continue
+		}
+		entries, exits := labeledNodes(graph, "entry"), labeledNodes(graph, "exit")
+		switch len(entries) {
+		case 0:
+			add(path, name, lintNoEntry, "no node labeled %q", "entry")
+			continue
+		case 1:
+		default:
+			add(path, name, lintNoEntry, "several nodes labeled %q: %q", "entry", entries)
+			continue
+		}
+		switch len(exits) {
+		case 0:
+			add(path, name, lintNoExit, "no node labeled %q", "exit")
+		case 1:
+		default:
+			add(path, name, lintNoExit, "several nodes labeled %q: %q", "exit", exits)
+		}
+		sub, err := graphs.NewSubGraph(graph)
+		if err != nil {
+			add(path, name, lintInvalid, "%v", err)
+			continue
+		}
+		if err := checkWildcards(sub); err != nil {
+			add(path, name, lintInvalid, "%v", err)
+			continue
+		}
+		if unreachable := unreachableNodes(graph, entries[0]); len(unreachable) > 0 {
+			add(path, name, lintUnmatchable, "nodes %q unreachable from entry node %q", unreachable, entries[0])
+			continue
+		}
+		variants, err := expandOptional(sub)
+		if err != nil {
+			add(path, name, lintInvalid, "%v", err)
+			continue
+		}
+		subPaths[name] = path
+		set = append(set, variants...)
+	}
+	set, err := orderSubs(set)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	report.Prims = append(report.Prims, primNames(set)...)
+
+	// Check the primitives for shadowing, in order of priority.
+	for _, name := range primNames(set) {
+		var shadowedBy []string
+		seen := make(map[string]bool)
+		shadowed := true
+		for _, sub := range set {
+			if sub.Name != name {
+				continue
+			}
+			by, ok := shadower(set, sub)
+			if !ok {
+				shadowed = false
+				break
+			}
+			if !seen[by] {
+				seen[by] = true
+				shadowedBy = append(shadowedBy, by)
+			}
+		}
+		if shadowed {
+			f := add(subPaths[name], name, lintShadowed, "always shadowed by primitives of higher priority %q", shadowedBy)
+			f.ShadowedBy = shadowedBy
+		}
+	}
+	return report, nil
+}
+
+// lintSources returns the paths of the primitives to lint, and a function which
+// parses the graph of a primitive, as specified by the command line flags (see
+// init).
+func lintSources() ([]string, func(path string) (*dot.Graph, error)) {
+	switch {
+	case len(flagPrimitives) > 0:
+		return strings.Split(flagPrimitives, ","), dot.ParseFile
+	case len(flagPrimsDir) > 0:
+		return defaultSubPaths(flagPrimsDir), dot.ParseFile
+	default:
+		return defaultSubPaths("primitives"), readEmbeddedGraph
+	}
+}
+
+// labeledNodes returns the names of the nodes of graph with the given label, in
+// node order.
+func labeledNodes(graph *dot.Graph, label string) []string {
+	var names []string
+	for _, node := range graph.Nodes.Nodes {
+		if attr(node.Attrs, "label") == label {
+			names = append(names, node.Name)
+		}
+	}
+	return names
+}
+
+// unreachableNodes returns the names of the nodes of graph unreachable from the
+// given entry node, in node order.
+func unreachableNodes(graph *dot.Graph, entry string) []string {
+	start, ok := graph.Nodes.Lookup[entry]
+	if !ok {
+		return nil
+	}
+	seen := map[*dot.Node]bool{start: true}
+	stack := []*dot.Node{start}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, succ := range n.Succs {
+			if !seen[succ] {
+				seen[succ] = true
+				stack = append(stack, succ)
+			}
+		}
+	}
+	var names []string
+	for _, node := range graph.Nodes.Nodes {
+		if !seen[node] {
+			names = append(names, node.Name)
+		}
+	}
+	return names
+}
+
+// shadower returns the name of the first primitive of set, of higher priority
+// than sub and of another name, which matches within sub when embedded in a
+// larger graph. The boolean return value indicates success.
+func shadower(set []*graphs.SubGraph, sub *graphs.SubGraph) (string, bool) {
+	if len(wildcards(sub)) > 0 {
+		return "", false
+	}
+	graph, outside, err := embedSub(sub)
+	if err != nil {
+		return "", false
+	}
+	labels := newEdgeLabels(graph)
+	for _, other := range set {
+		if other == sub {
+			break
+		}
+		if other.Name == sub.Name || len(wildcards(other)) > 0 {
+			continue
+		}
+		for _, node := range graph.Nodes.Nodes {
+			if outside[node.Name] {
+				continue
+			}
+			m, ok := isomorphism(graph, node, other, labels, nil)
+			if ok && !mapsAny(m, outside) {
+				return other.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// embedSub returns the graph of sub embedded in a larger graph; with a new
+// entry node preceding the entry node of sub, and a new node succeeding the
+// exit node of sub. The names of the new nodes are returned in outside.
+func embedSub(sub *graphs.SubGraph) (*dot.Graph, map[string]bool, error) {
+	used := make(map[string]bool)
+	for _, node := range sub.Nodes.Nodes {
+		used[node.Name] = true
+	}
+	fresh := func(name string) string {
+		for used[name] {
+			name += "_"
+		}
+		used[name] = true
+		return name
+	}
+	pre, post := fresh("pre"), fresh("post")
+	outside := map[string]bool{pre: true}
+	nodes := []*dot.Node{{Name: pre, Attrs: dot.Attrs{"label": "entry"}}}
+	for _, node := range sub.Nodes.Nodes {
+		attrs := make(dot.Attrs)
+		for key, val := range node.Attrs {
+			if key != "label" {
+				attrs[key] = val
+			}
+		}
+		nodes = append(nodes, &dot.Node{Name: node.Name, Attrs: attrs})
+	}
+	edges := append([]*dot.Edge{{Src: pre, Dst: sub.Entry()}}, sub.Edges.Edges...)
+	if len(sub.Exit()) > 0 {
+		outside[post] = true
+		nodes = append(nodes, &dot.Node{Name: post})
+		edges = append(edges, &dot.Edge{Src: sub.Exit(), Dst: post})
+	}
+	graph, err := newGraph(sub.Name, nodes, edges)
+	if err != nil {
+		return nil, nil, errutil.Err(err)
+	}
+	return graph, outside, nil
+}
+
+// mapsAny reports whether the node mapping m maps any node to the given nodes.
+func mapsAny(m map[string]string, nodes map[string]bool) bool {
+	for _, name := range m {
+		if nodes[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// writeLint writes the given lint report as JSON to w.
+func writeLint(w io.Writer, report *lintReport) error {
+	buf, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	_, err = w.Write(buf)
+	return err
+}
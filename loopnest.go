@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+
+	"decomp.org/x/graphs/primitive"
+)
+
+// loopNestPrim is the name of the loop nest primitive.
+//
+// A loop nest is a composite primitive, which groups a loop primitive with the
+// loop primitives nested within its body, directly or within other primitives,
+// as requested by the "-loop-nests" flag. Loop nests are located by a post-pass
+// over the located primitives, and one loop nest is appended for each
+// outermost loop containing other loops; the loop primitives themselves are
+// kept, so that the references among the primitives remain intact.
+//
+// In the node mapping of the primitive, the super-nodes of the loops of the
+// nest are mapped to "A", "B", etc, in pre-order of the primitive tree; i.e.
+// each loop precedes the loops nested within it, and sibling loops are ordered
+// by role. For a perfect nest, the roles thus enumerate the nesting levels
+// from the outermost loop inwards. Levels maps from the super-node of each loop
+// to its nesting level; 0 for the outermost loop.
+//
+// As the loop nest is not merged into the control flow graph, its super-node
+// is not referenced by any other primitive. Its name honours the "-name-prefix"
+// and "-name-offset" flags.
+const loopNestPrim = "loop_nest"
+
+// loopNests returns the given control flow primitives, followed by the loop
+// nests of their loop primitives. The primitives are expected to be ordered as
+// located by restructure, and are not modified.
+func loopNests(prims []*Primitive) []*Primitive {
+	loops := loopPrimNames()
+	used := make(map[string]bool)
+	for _, prim := range prims {
+		used[prim.Node] = true
+	}
+	out := append([]*Primitive(nil), prims...)
+	for _, n := range primTree(prims) {
+		if !loops[n.prim.Prim] || hasLoopAncestor(n, loops) {
+			continue
+		}
+		// Enumerate the loops of the nest in pre-order.
+		type item struct {
+			n     *primNode
+			level int
+		}
+		levels := make(map[string]int)
+		var names []string
+		// The loop nest is heuristic if any of its loops is.
+		var conf Confidence
+		stack := []item{{n: n}}
+		for len(stack) > 0 {
+			it := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			level := it.level
+			if loops[it.n.prim.Prim] {
+				levels[it.n.prim.Node] = level
+				names = append(names, it.n.prim.Node)
+				if conf != ConfidenceHeuristic {
+					conf = it.n.prim.Confidence
+				}
+				level++
+			}
+			roles := it.n.roles()
+			for i := len(roles) - 1; i >= 0; i-- {
+				if child, ok := it.n.children[roles[i]]; ok {
+					stack = append(stack, item{n: child, level: level})
+				}
+			}
+		}
+		if len(names) < 2 {
+			continue
+		}
+		m := make(map[string]string)
+		for i, name := range names {
+			m[role(i)] = name
+		}
+		var node string
+		for i := flagNameOffset; ; i++ {
+			node = fmt.Sprintf("%s%s%d", flagNamePrefix, loopNestPrim, i)
+			if !used[node] {
+				break
+			}
+		}
+		used[node] = true
+		nest := &Primitive{
+			Primitive: &primitive.Primitive{
+				Node:  node,
+				Prim:  loopNestPrim,
+				Nodes: m,
+			},
+			Levels:     levels,
+			Confidence: conf,
+		}
+		out = append(out, nest)
+	}
+	return out
+}
+
+// hasLoopAncestor reports whether the primitive of the given tree node is
+// nested within a loop primitive.
+func hasLoopAncestor(n *primNode, loops map[string]bool) bool {
+	for p := n.parent; p != nil; p = p.parent {
+		if loops[p.prim.Prim] {
+			return true
+		}
+	}
+	return false
+}
+
+// loopPrimNames returns the names of the loop primitives; i.e. of the cyclic
+// primitives of subs, and of the loop primitives located without a template.
+func loopPrimNames() map[string]bool {
+	loops := map[string]bool{
+		multiExitLoop:   true,
+		naturalLoopPrim: true,
+	}
+	for _, name := range primNames(loopSubs(subs)) {
+		loops[name] = true
+	}
+	return loops
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"sort"
+
+	"decomp.org/x/graphs"
+	"github.com/mewfork/dot"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// Natural loop analysis complements the template approach to locating loops.
+// Control flow primitives are located by subgraph isomorphism search, with the
+// exception of multi-exit loops (see multiExitLoop); the natural loops of the
+// graph, as identified by back-edges of its dominator tree, are otherwise only
+// used to validate the located loop primitives and to explain stalled
+// reductions. In verbose mode (or when diagnostics are
+// requested), a warning is reported for each located loop primitive which does
+// not correspond to a natural loop of the graph, and for each natural loop
+// which remains when no further primitive may be located.
+
+// A loop is a natural loop of a control flow graph.
+type loop struct {
+	// Loop header; the target of the back-edges of the loop.
+	header string
+	// Nodes of the loop, including the header.
+	nodes map[string]bool
+}
+
+// naturalLoops returns the natural loops of the given graph, one per loop
+// header, sorted by header name. Back-edges are identified as edges whose
+// target dominates their source, and back-edges sharing a header are combined
+// into a single loop.
+func naturalLoops(graph *dot.Graph, entry *dot.Node) []*loop {
+	doms := dominators(entry)
+	headers := make(map[string]*loop)
+	for _, node := range graph.Nodes.Nodes {
+		if _, ok := doms[node]; !ok {
+			// Skip unreachable node.
+			continue
+		}
+		for _, succ := range node.Succs {
+			if !dominates(doms, succ, node) {
+				continue
+			}
+			// Back-edge from node to succ.
+			l, ok := headers[succ.Name]
+			if !ok {
+				l = &loop{header: succ.Name, nodes: map[string]bool{succ.Name: true}}
+				headers[succ.Name] = l
+			}
+			// Add the nodes reaching the tail of the back-edge without passing
+			// through the header.
+			stack := []*dot.Node{node}
+			for len(stack) > 0 {
+				n := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				if l.nodes[n.Name] {
+					continue
+				}
+				l.nodes[n.Name] = true
+				stack = append(stack, n.Preds...)
+			}
+		}
+	}
+	var loops []*loop
+	for _, l := range headers {
+		loops = append(loops, l)
+	}
+	sort.Sort(loopsByHeader(loops))
+	return loops
+}
+
+// loopsByHeader implements sort.Interface, sorting loops by header name.
+type loopsByHeader []*loop
+
+func (ls loopsByHeader) Len() int           { return len(ls) }
+func (ls loopsByHeader) Less(i, j int) bool { return ls[i].header < ls[j].header }
+func (ls loopsByHeader) Swap(i, j int)      { ls[i], ls[j] = ls[j], ls[i] }
+
+// dominators returns the immediate dominator of each node reachable from
+// entry; the immediate dominator of entry is entry itself. It uses the
+// iterative algorithm of Cooper, Harvey and Kennedy.
+func dominators(entry *dot.Node) map[*dot.Node]*dot.Node {
+	// Compute the reverse post-order of the nodes reachable from entry.
+	var post []*dot.Node
+	visited := make(map[*dot.Node]bool)
+	var visit func(n *dot.Node)
+	visit = func(n *dot.Node) {
+		visited[n] = true
+		for _, succ := range n.Succs {
+			if !visited[succ] {
+				visit(succ)
+			}
+		}
+		post = append(post, n)
+	}
+	visit(entry)
+	order := make(map[*dot.Node]int)
+	for i, n := range post {
+		order[n] = i
+	}
+
+	idom := map[*dot.Node]*dot.Node{entry: entry}
+	intersect := func(a, b *dot.Node) *dot.Node {
+		for a != b {
+			for order[a] < order[b] {
+				a = idom[a]
+			}
+			for order[b] < order[a] {
+				b = idom[b]
+			}
+		}
+		return a
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := len(post) - 1; i >= 0; i-- {
+			n := post[i]
+			if n == entry {
+				continue
+			}
+			var newIdom *dot.Node
+			for _, pred := range n.Preds {
+				if _, ok := idom[pred]; !ok {
+					continue
+				}
+				if newIdom == nil {
+					newIdom = pred
+					continue
+				}
+				newIdom = intersect(pred, newIdom)
+			}
+			if idom[n] != newIdom {
+				idom[n] = newIdom
+				changed = true
+			}
+		}
+	}
+	return idom
+}
+
+// dominates reports whether a dominates b, based on the given immediate
+// dominators.
+func dominates(idom map[*dot.Node]*dot.Node, a, b *dot.Node) bool {
+	for {
+		if a == b {
+			return true
+		}
+		next, ok := idom[b]
+		if !ok || next == b {
+			return false
+		}
+		b = next
+	}
+}
+
+// entryNode returns the entry node of the given graph; i.e. the node labeled
+// "entry", or the only node without predecessors.
+func entryNode(graph *dot.Graph) (*dot.Node, error) {
+	var roots []*dot.Node
+	for _, node := range graph.Nodes.Nodes {
+		if isEntry(node) {
+			return node, nil
+		}
+		if len(node.Preds) == 0 {
+			roots = append(roots, node)
+		}
+	}
+	if len(roots) != 1 {
+		return nil, errutil.Newf("unable to locate entry node of graph %q", graph.Name)
+	}
+	return roots[0], nil
+}
+
+// checkLoop validates that the loop primitive sub, located at the node mapping
+// m, corresponds to a natural loop in graph, and reports a warning otherwise.
+// Primitives which do not contain a loop are ignored.
+func checkLoop(graph *dot.Graph, sub *graphs.SubGraph, m map[string]string) {
+	subEntry, err := entryNode(sub.Graph)
+	if err != nil {
+		return
+	}
+	entry, err := entryNode(graph)
+	if err != nil {
+		return
+	}
+	loops := make(map[string]*loop)
+	for _, l := range naturalLoops(graph, entry) {
+		loops[l.header] = l
+	}
+	for _, subLoop := range naturalLoops(sub.Graph, subEntry) {
+		header := m[subLoop.header]
+		l, ok := loops[header]
+		if !ok {
+			warnf("loop-mismatch", []string{header}, "loop primitive %q located at node %q does not correspond to a natural loop", sub.Name, unquote(header))
+			continue
+		}
+		var names []string
+		for name := range subLoop.nodes {
+			names = append(names, m[name])
+		}
+		if len(names) != len(l.nodes) || !containsAll(l.nodes, names) {
+			warnf("loop-mismatch", []string{header}, "loop primitive %q located at node %q does not cover the natural loop with header %q", sub.Name, unquote(header), unquote(header))
+		}
+	}
+}
+
+// checkResidualLoops reports a warning for each natural loop which remains in
+// graph when no further primitive may be located.
+func checkResidualLoops(graph *dot.Graph) {
+	entry, err := entryNode(graph)
+	if err != nil {
+		return
+	}
+	for _, l := range naturalLoops(graph, entry) {
+		var names []string
+		for name := range l.nodes {
+			names = append(names, unquote(name))
+		}
+		sort.Strings(names)
+		warnf("residual-loop", names, "natural loop with header %q and nodes %q remains unstructured", unquote(l.header), names)
+	}
+}
+
+// containsAll reports whether set contains all of the given names.
+func containsAll(set map[string]bool, names []string) bool {
+	for _, name := range names {
+		if !set[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkIrreducibleLoops reports a warning for each irreducible loop which
+// remains in graph when no further primitive may be located; i.e. for each
+// cyclic strongly connected component with more than one entry node. Such
+// loops are the classic source of irreducibility, and may not be structured
+// without node splitting (see the "split-shared-headers" transform).
+func checkIrreducibleLoops(graph *dot.Graph) {
+	for _, comp := range sccs(graph) {
+		if !isCyclic(comp) {
+			continue
+		}
+		entries := sccEntries(comp)
+		if len(entries) < 2 {
+			continue
+		}
+		var headers, names []string
+		for _, n := range entries {
+			headers = append(headers, unquote(n.Name))
+		}
+		for _, n := range comp {
+			names = append(names, unquote(n.Name))
+		}
+		sort.Strings(headers)
+		sort.Strings(names)
+		warnf("irreducible-loop", names, "irreducible loop with multiple headers: %q", headers)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"decomp.org/x/graphs"
+	"decomp.org/x/graphs/primitive"
+	"github.com/mewfork/dot"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// In loops-only mode (the "-loops-only" flag), only the loops of a control flow
+// graph are structured, and conditionals are left as raw nodes; the output is
+// the loop nesting forest of the graph. Only the loop primitives of subs (i.e.
+// the cyclic ones) are located, followed by multi-exit loops and natural loops.
+// As conditionals are never reduced, the reduction is expected to stall, and
+// the primitives located before it stalled are returned without error.
+
+// naturalLoopPrim is the name of the natural loop primitive.
+//
+// A natural loop primitive is a natural loop with a single entry node (its
+// header), which is located in loops-only mode when no loop primitive template
+// may be located; e.g. a loop the body of which contains a conditional. The
+// innermost loops are located first, so that the inner loops of a loop have
+// been merged into single nodes by the time it is located.
+//
+// The nodes of a natural loop are merged into a single node, while its follow
+// nodes remain in the graph. In the node mapping of the primitive, the header
+// is mapped to "A" and the remaining loop nodes to "B", "C", etc., in the node
+// order of the graph. The exit edges are recorded in Exits.
+const naturalLoopPrim = "loop"
+
+// loopRegionFinders is an ordered list of the region finders used in loops-only
+// mode (see regionFinders).
+var loopRegionFinders = []regionFinder{
+	{prim: multiExitLoop, find: findMultiExitLoop},
+	{prim: naturalLoopPrim, find: findNaturalLoop},
+}
+
+// activeRegionFinders returns the region finders of the reduction; those of
+// loops-only mode if requested by the "-loops-only" flag, and regionFinders
+// otherwise.
+func activeRegionFinders() []regionFinder {
+	if flagLoopsOnly {
+		return loopRegionFinders
+	}
+	return regionFinders
+}
+
+// isLoopPrim reports whether the given primitive contains a loop.
+func isLoopPrim(sub *graphs.SubGraph) bool {
+	for _, comp := range sccs(sub.Graph) {
+		if isCyclic(comp) {
+			return true
+		}
+	}
+	return false
+}
+
+// loopSubs returns the loop primitives of subs, in order.
+func loopSubs(subs []*graphs.SubGraph) []*graphs.SubGraph {
+	var loops []*graphs.SubGraph
+	for _, sub := range subs {
+		if isLoopPrim(sub) {
+			loops = append(loops, sub)
+		}
+	}
+	return loops
+}
+
+// findNaturalLoop locates the innermost single-entry natural loop of graph,
+// i.e. the one with the fewest nodes, and merges its nodes into a single node.
+// It returns nil if graph contains no single-entry natural loop.
+func findNaturalLoop(graph *dot.Graph, labels edgeLabels) (*Primitive, error) {
+	entry, err := entryNode(graph)
+	if err != nil {
+		return nil, nil
+	}
+	var best *loop
+	for _, l := range naturalLoops(graph, entry) {
+		if !isSingleEntry(graph, l) {
+			continue
+		}
+		if best == nil || len(l.nodes) < len(best.nodes) {
+			best = l
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+
+	// Map the header to "A" and the remaining loop nodes to "B", "C", etc.
+	m := map[string]string{"A": best.header}
+	var names []string
+	for _, node := range graph.Nodes.Nodes {
+		if !best.nodes[node.Name] {
+			continue
+		}
+		names = append(names, node.Name)
+		if node.Name != best.header {
+			m[role(len(m))] = node.Name
+		}
+	}
+	exits := regionExits(graph, best.nodes)
+	node, err := mergeRegion(graph, names, naturalLoopPrim)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	labels.merge(m, node)
+	prim := &Primitive{
+		Primitive: &primitive.Primitive{
+			Node:  node,
+			Prim:  naturalLoopPrim,
+			Nodes: m,
+		},
+		Exits:     exits,
+		entry:     best.header,
+		heuristic: true,
+	}
+	return prim, nil
+}
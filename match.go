@@ -0,0 +1,330 @@
+package main
+
+import (
+	"sort"
+
+	"decomp.org/x/graphs"
+	"github.com/mewfork/dot"
+)
+
+// edgeLabels maps from edges, as identified by the names of their source and
+// destination nodes, to edge labels. It tracks the labels of the edges of a
+// control flow graph under reduction, as the labels of edges introduced by
+// merge.Merge are otherwise lost.
+//
+// Parallel edges between the same pair of nodes (e.g. two case values of a
+// switch landing on the same block) form a single structural edge, which
+// carries the labels of each parallel edge, in edge order.
+type edgeLabels map[[2]string][]string
+
+// newEdgeLabels returns the edge labels of the given graph.
+func newEdgeLabels(graph *dot.Graph) edgeLabels {
+	labels := make(edgeLabels)
+	for _, e := range graph.Edges.Edges {
+		if label := attr(e.Attrs, "label"); len(label) > 0 {
+			labels.add([2]string{e.Src, e.Dst}, label)
+		}
+	}
+	return labels
+}
+
+// add adds the given label to the edge key, unless already present.
+func (labels edgeLabels) add(key [2]string, label string) {
+	if !labels.has(key, label) {
+		labels[key] = append(labels[key], label)
+	}
+}
+
+// has reports whether the edge key carries the given label.
+func (labels edgeLabels) has(key [2]string, label string) bool {
+	for _, l := range labels[key] {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// parallelLabels returns the label sets of the edges between the nodes of the
+// node mapping m which carry more than one label; i.e. of parallel labeled
+// edges, sorted by edge.
+func parallelLabels(m map[string]string, labels edgeLabels) []*LabelSet {
+	var edges [][2]string
+	for src, gsrc := range m {
+		for dst, gdst := range m {
+			if len(labels[[2]string{gsrc, gdst}]) > 1 {
+				edges = append(edges, [2]string{src, dst})
+			}
+		}
+	}
+	sort.Sort(edgesByName(edges))
+	var sets []*LabelSet
+	for _, e := range edges {
+		set := labels[[2]string{m[e[0]], m[e[1]]}]
+		sets = append(sets, &LabelSet{Edge: e, Labels: append([]string(nil), set...)})
+	}
+	return sets
+}
+
+// merge updates the edge labels to reflect the merge of the nodes of the node
+// mapping m into the single node named node. Edges into and out of the merged
+// region keep their labels, edges within the region are dropped.
+func (labels edgeLabels) merge(m map[string]string, node string) {
+	region := make(map[string]bool)
+	for _, name := range m {
+		region[name] = true
+	}
+	// Iterate in sorted order, for a deterministic order of the labels of
+	// edges combined by the merge.
+	var keys [][2]string
+	for key := range labels {
+		if region[key[0]] || region[key[1]] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Sort(edgesByName(keys))
+	merged := make(edgeLabels)
+	for _, key := range keys {
+		src, dst := key[0], key[1]
+		set := labels[key]
+		delete(labels, key)
+		switch {
+		case region[src] && region[dst]:
+			// Drop edge within region.
+		case region[src]:
+			for _, label := range set {
+				merged.add([2]string{node, dst}, label)
+			}
+		default:
+			for _, label := range set {
+				merged.add([2]string{src, node}, label)
+			}
+		}
+	}
+	for key, set := range merged {
+		for _, label := range set {
+			labels.add(key, label)
+		}
+	}
+}
+
+// clone returns a copy of the edge labels.
+func (labels edgeLabels) clone() edgeLabels {
+	c := make(edgeLabels, len(labels))
+	for key, set := range labels {
+		c[key] = append([]string(nil), set...)
+	}
+	return c
+}
+
+// hasEdgeLabels reports whether any edge of the given primitive is labeled.
+func hasEdgeLabels(sub *graphs.SubGraph) bool {
+	return len(newEdgeLabels(sub.Graph)) > 0
+}
+
+// isValue reports whether the given node is marked as value-producing; i.e. a
+// basic block without side effects, which computes the value of an expression.
+func isValue(node *dot.Node) bool {
+	return attr(node.Attrs, "value") == "true"
+}
+
+// hasValueNodes reports whether any node of the given primitive is marked as
+// value-producing.
+func hasValueNodes(sub *graphs.SubGraph) bool {
+	for _, node := range sub.Nodes.Nodes {
+		if isValue(node) {
+			return true
+		}
+	}
+	return false
+}
+
+// search locates an isomorphism of sub in graph, honouring the edge labels of
+// sub; a labeled edge of sub only matches an edge of graph carrying the label,
+// as tracked by labels. Unlabeled edges of sub match any edge. Similarly, a
+// node of sub marked as value-producing only matches a node of graph marked as
+// such.
+//
+// Apart from edge labels, the semantics of an isomorphism follow those of
+// iso.Search. The entry node of sub may map to any node of graph, and every
+// other node of sub must map to a node which is not the entry node of graph.
+// Each node of sub must map to a node with the same predecessors and
+// successors, under the mapping, with two exceptions; the entry node may have
+// additional predecessors and the exit node may have additional successors in
+// graph.
+//
+// Candidate entry nodes are tried in the node order of graph, and the first
+// isomorphism found is returned.
+func search(graph *dot.Graph, sub *graphs.SubGraph, labels edgeLabels) (map[string]string, bool) {
+	for _, node := range graph.Nodes.Nodes {
+		if m, ok := isomorphism(graph, node, sub, labels, nil); ok {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// isomorphism locates an isomorphism of sub in graph, with the entry node of
+// sub mapped to entry. See search for the semantics of an isomorphism. If mm is
+// non-nil, the furthest point of mismatch is recorded in mm when no
+// isomorphism is located.
+func isomorphism(graph *dot.Graph, entry *dot.Node, sub *graphs.SubGraph, labels edgeLabels, mm *Mismatch) (map[string]string, bool) {
+	subLabels := newEdgeLabels(sub.Graph)
+	order := searchOrder(sub)
+	if len(order) != len(sub.Nodes.Nodes) {
+		// Nodes unreachable from the entry (ignoring edge directions) are not
+		// supported.
+		mm.record(0, MismatchUnreachable, "", "", nil, "primitive %q contains nodes unreachable from its entry node", sub.Name)
+		return nil, false
+	}
+	// m maps from sub node name to graph node.
+	m := make(map[string]*dot.Node)
+	used := make(map[*dot.Node]bool)
+	// index maps from graph node to its position in the node order of graph,
+	// for ordering the copies of wildcard nodes.
+	var index map[*dot.Node]int
+	for _, s := range order {
+		if _, ok := s.Attrs[wildcardAfter]; ok {
+			index = make(map[*dot.Node]int)
+			for i, node := range graph.Nodes.Nodes {
+				index[node] = i
+			}
+			break
+		}
+	}
+
+	// valid reports whether the complete mapping is an isomorphism.
+	valid := func() bool {
+		for _, s := range order {
+			g := m[s.Name]
+			if isValue(s) && !isValue(g) {
+				mm.record(len(order), MismatchValue, s.Name, g.Name, nil, "node %q (as %q) is not marked value-producing", unquote(g.Name), s.Name)
+				return false
+			}
+			if !sameNodes(s.Succs, g.Succs, m, s.Name == sub.Exit()) {
+				if mm != nil {
+					edge, reason := degreeMismatch(MismatchSuccessor, s, s.Succs, g, g.Succs, m)
+					mm.record(len(order), MismatchSuccessor, s.Name, g.Name, edge, "%s", reason)
+				}
+				return false
+			}
+			if !sameNodes(s.Preds, g.Preds, m, s.Name == sub.Entry()) {
+				if mm != nil {
+					edge, reason := degreeMismatch(MismatchPredecessor, s, s.Preds, g, g.Preds, m)
+					mm.record(len(order), MismatchPredecessor, s.Name, g.Name, edge, "%s", reason)
+				}
+				return false
+			}
+			for _, succ := range s.Succs {
+				dst := m[succ.Name]
+				for _, label := range subLabels[[2]string{s.Name, succ.Name}] {
+					key := [2]string{g.Name, dst.Name}
+					if !labels.has(key, label) {
+						mm.record(len(order), MismatchLabel, s.Name, g.Name, &key, "edge %q -> %q is labeled %q; %q -> %q requires label %q", unquote(g.Name), unquote(dst.Name), labels[key], s.Name, succ.Name, label)
+						return false
+					}
+				}
+			}
+		}
+		return true
+	}
+
+	var try func(i int) bool
+	try = func(i int) bool {
+		if i == len(order) {
+			return valid()
+		}
+		s := order[i]
+		for _, c := range candidates(s, m, entry, i == 0) {
+			if used[c] || (i != 0 && isEntry(c)) {
+				continue
+			}
+			if prev, ok := m[attr(s.Attrs, wildcardAfter)]; ok && index[c] < index[prev] {
+				// Copies of wildcard nodes are mapped in node order.
+				continue
+			}
+			m[s.Name] = c
+			used[c] = true
+			if try(i + 1) {
+				return true
+			}
+			delete(m, s.Name)
+			delete(used, c)
+		}
+		if mm != nil {
+			node, reason := candidateMismatch(s, m)
+			mm.record(i, MismatchCandidate, s.Name, node, nil, "%s", reason)
+		}
+		return false
+	}
+	if !try(0) {
+		return nil, false
+	}
+	names := make(map[string]string)
+	for sname, g := range m {
+		names[sname] = g.Name
+	}
+	return names, true
+}
+
+// candidates returns the candidate graph nodes of the sub node s, given the
+// partial mapping m. The candidates of a node are the successors (or
+// predecessors) in graph of a mapped predecessor (or successor) of the node.
+func candidates(s *dot.Node, m map[string]*dot.Node, entry *dot.Node, first bool) []*dot.Node {
+	if first {
+		return []*dot.Node{entry}
+	}
+	for _, pred := range s.Preds {
+		if g, ok := m[pred.Name]; ok {
+			return g.Succs
+		}
+	}
+	for _, succ := range s.Succs {
+		if g, ok := m[succ.Name]; ok {
+			return g.Preds
+		}
+	}
+	return nil
+}
+
+// searchOrder returns the nodes of sub in breadth-first order from its entry
+// node, following edges in both directions.
+func searchOrder(sub *graphs.SubGraph) []*dot.Node {
+	start, ok := sub.Nodes.Lookup[sub.Entry()]
+	if !ok {
+		return nil
+	}
+	seen := map[*dot.Node]bool{start: true}
+	queue := []*dot.Node{start}
+	for i := 0; i < len(queue); i++ {
+		n := queue[i]
+		for _, ns := range [][]*dot.Node{n.Succs, n.Preds} {
+			for _, x := range ns {
+				if !seen[x] {
+					seen[x] = true
+					queue = append(queue, x)
+				}
+			}
+		}
+	}
+	return queue
+}
+
+// sameNodes reports whether the image of the sub nodes ss under m is equal to
+// the set of graph nodes gs, or a subset of gs if loose is true.
+func sameNodes(ss, gs []*dot.Node, m map[string]*dot.Node, loose bool) bool {
+	want := make(map[*dot.Node]bool)
+	for _, s := range ss {
+		want[m[s.Name]] = true
+	}
+	have := make(map[*dot.Node]bool)
+	for _, g := range gs {
+		have[g] = true
+	}
+	for g := range want {
+		if !have[g] {
+			return false
+		}
+	}
+	return loose || len(want) == len(have)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// A Document is the output of restructure with metadata; the located control
+// flow primitives, along with provenance metadata of the run (e.g. the tool
+// version, a hash of the input and the date), as written by the "json" output
+// format when metadata is specified by the "-meta" flag, or a reverse map is
+// requested by the "-reverse-map" flag. Library users may marshal a Document to
+// produce the same output.
+type Document struct {
+	// Metadata of the run.
+	Meta map[string]string `json:"meta,omitempty"`
+	// Located control flow primitives.
+	Prims []*Primitive `json:"prims"`
+	// Reverse mapping from original node name to owning primitive (see
+	// reverseMap).
+	ReverseMap map[string]*Owner `json:"reverse_map,omitempty"`
+}
+
+// metaFlag is a repeatable command line flag of key=value metadata pairs, as
+// used by the "-meta" flag.
+type metaFlag map[string]string
+
+// String returns the metadata pairs, in sorted key order.
+func (f metaFlag) String() string {
+	var keys []string
+	for key := range f {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+f[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Set adds the given key=value metadata pair.
+func (f metaFlag) Set(s string) error {
+	pos := strings.Index(s, "=")
+	if pos <= 0 {
+		return errutil.Newf("invalid metadata %q; expected key=value", s)
+	}
+	f[s[:pos]] = s[pos+1:]
+	return nil
+}
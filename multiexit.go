@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+
+	"decomp.org/x/graphs/primitive"
+	"github.com/mewfork/dot"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// multiExitLoop is the name of the multi-exit loop primitive.
+//
+// A multi-exit loop is a natural loop with a single entry node (its header),
+// whose exit edges lead to two or more distinct follow nodes; e.g. a loop which
+// may break to one node and fall out of its condition to another. As the loop
+// does not converge on a single follow node, it may not be described by a
+// primitive template (which has a single exit node). Instead, multi-exit loops
+// are located from the natural loops of the graph, once no primitive template
+// may be located.
+//
+// The nodes of a multi-exit loop are merged into a single node, while its
+// follow nodes remain in the graph. In the node mapping of the primitive, the
+// header is mapped to "A" and the remaining loop nodes to "B", "C", etc., in
+// the node order of the graph. The exit edges are recorded in Exits.
+const multiExitLoop = "multi_exit_loop"
+
+// findMultiExitLoop locates the innermost multi-exit loop of graph, i.e. the
+// one with the fewest nodes, and merges its nodes into a single node. It
+// returns nil if graph contains no multi-exit loop.
+func findMultiExitLoop(graph *dot.Graph, labels edgeLabels) (*Primitive, error) {
+	entry, err := entryNode(graph)
+	if err != nil {
+		return nil, nil
+	}
+	var best *loop
+	var bestExits [][2]string
+	for _, l := range naturalLoops(graph, entry) {
+		exits, ok := loopExits(graph, l)
+		if !ok {
+			continue
+		}
+		if best == nil || len(l.nodes) < len(best.nodes) {
+			best, bestExits = l, exits
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+
+	// Map the header to "A" and the remaining loop nodes to "B", "C", etc.
+	m := map[string]string{"A": best.header}
+	var names []string
+	for _, node := range graph.Nodes.Nodes {
+		if !best.nodes[node.Name] {
+			continue
+		}
+		names = append(names, node.Name)
+		if node.Name != best.header {
+			m[role(len(m))] = node.Name
+		}
+	}
+	node, err := mergeRegion(graph, names, multiExitLoop)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	labels.merge(m, node)
+	prim := &Primitive{
+		Primitive: &primitive.Primitive{
+			Node:  node,
+			Prim:  multiExitLoop,
+			Nodes: m,
+		},
+		Exits:     bestExits,
+		entry:     best.header,
+		heuristic: true,
+	}
+	return prim, nil
+}
+
+// loopExits returns the exit edges of the given natural loop, sorted by source
+// and destination node name. The boolean return value is false unless the
+// loop is a multi-exit loop; i.e. unless the header is the only loop node with
+// predecessors outside of the loop, and the exit edges lead to at least two
+// distinct follow nodes.
+func loopExits(graph *dot.Graph, l *loop) ([][2]string, bool) {
+	if !isSingleEntry(graph, l) {
+		return nil, false
+	}
+	exits := regionExits(graph, l.nodes)
+	follows := make(map[string]bool)
+	for _, e := range exits {
+		follows[e[1]] = true
+	}
+	if len(follows) < 2 {
+		return nil, false
+	}
+	return exits, true
+}
+
+// isSingleEntry reports whether the header of the given natural loop is the
+// only loop node with predecessors outside of the loop.
+func isSingleEntry(graph *dot.Graph, l *loop) bool {
+	for name := range l.nodes {
+		if name == l.header {
+			continue
+		}
+		for _, pred := range graph.Nodes.Lookup[name].Preds {
+			if !l.nodes[pred.Name] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// role returns the node role of the i:th node of a primitive; i.e. "A", "B",
+// ..., "Z", followed by "A1", "B1", etc.
+func role(i int) string {
+	name := string(rune('A' + i%26))
+	if i >= 26 {
+		name += fmt.Sprint(i / 26)
+	}
+	return name
+}
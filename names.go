@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mewfork/dot"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// A namer assigns unique names to the super-nodes of a reduction, as specified
+// by the "-name-prefix" and "-name-offset" flags. The super-nodes created by
+// merge.Merge are named after their primitive with a per-graph counter (e.g.
+// "list0"), and names are reused once a super-node has been merged, so the
+// names of different graphs collide. A namer instead names each super-node by
+// the prefix, the primitive name and a per-primitive counter starting at the
+// offset (e.g. "f1_list0"), and never reuses a name within a graph.
+type namer struct {
+	// Prefix and counter offset of super-node names.
+	prefix string
+	offset int
+	// counts maps from primitive name to the number of super-nodes named.
+	counts map[string]int
+	// names maps from super-node name, as assigned by merge, to the unique name
+	// of the most recent super-node of that name.
+	names map[string]string
+	// taken tracks the node names in use; the names of the original nodes and
+	// the unique names assigned.
+	taken map[string]bool
+}
+
+// newNamer returns a namer of the super-nodes of the given graph, using the
+// given prefix and counter offset.
+func newNamer(graph *dot.Graph, prefix string, offset int) *namer {
+	n := &namer{
+		prefix: prefix,
+		offset: offset,
+		counts: make(map[string]int),
+		names:  make(map[string]string),
+		taken:  make(map[string]bool),
+	}
+	for _, node := range graph.Nodes.Nodes {
+		n.taken[unquote(node.Name)] = true
+	}
+	return n
+}
+
+// resolve returns the unique name of the given node.
+func (n *namer) resolve(name string) string {
+	if unique, ok := n.names[name]; ok {
+		return unique
+	}
+	return name
+}
+
+// rename renames the super-node of the given primitive, and the super-nodes
+// referenced by it, to their unique names. Primitives must be renamed in the
+// order located, so that each super-node is renamed before it is referenced.
+func (n *namer) rename(prim *Primitive) {
+	nodes := make(map[string]string)
+	for role, name := range prim.Nodes {
+		nodes[role] = n.resolve(name)
+	}
+	prim.Nodes = nodes
+	prim.entry, prim.exit = n.resolve(prim.entry), n.resolve(prim.exit)
+	for i, e := range prim.Exits {
+		prim.Exits[i] = [2]string{n.resolve(e[0]), n.resolve(e[1])}
+	}
+	for i, e := range prim.ResidualEdges {
+		prim.ResidualEdges[i] = [2]string{n.resolve(e[0]), n.resolve(e[1])}
+	}
+	if len(prim.Continue) > 0 {
+		prim.Continue = n.resolve(prim.Continue)
+	}
+	if ports := prim.Ports; ports != nil {
+		for _, names := range [][]string{ports.Preds, ports.Succs} {
+			for i, name := range names {
+				names[i] = n.resolve(name)
+			}
+		}
+	}
+	for _, b := range prim.Breaks {
+		b.Edge = [2]string{n.resolve(b.Edge[0]), n.resolve(b.Edge[1])}
+		if len(b.Loop) > 0 {
+			b.Loop = n.resolve(b.Loop)
+		}
+	}
+	var unique string
+	for {
+		unique = fmt.Sprintf("%s%s%d", n.prefix, prim.Prim, n.offset+n.counts[prim.Prim])
+		n.counts[prim.Prim]++
+		if !n.taken[unique] {
+			break
+		}
+	}
+	n.taken[unique] = true
+	n.names[prim.Node] = unique
+	prim.Node = unique
+}
+
+// unquoteNames replaces the quoted names of the original nodes referenced by
+// the given primitive (e.g. "\"0x401000\"") with their unquoted forms. The
+// parser keeps the quotes of quoted node names, which are thus part of the node
+// names of the graph under reduction; the names of the primitives are however
+// output as plain strings, e.g. as keys and values of JSON objects. Super-node
+// names are never quoted.
+func unquoteNames(prim *Primitive) {
+	for role, name := range prim.Nodes {
+		prim.Nodes[role] = unquote(name)
+	}
+	prim.entry, prim.exit = unquote(prim.entry), unquote(prim.exit)
+	for _, es := range [][][2]string{prim.Exits, prim.ResidualEdges} {
+		for i, e := range es {
+			es[i] = [2]string{unquote(e[0]), unquote(e[1])}
+		}
+	}
+	prim.Continue = unquote(prim.Continue)
+	for _, b := range prim.Breaks {
+		b.Edge = [2]string{unquote(b.Edge[0]), unquote(b.Edge[1])}
+		b.Loop = unquote(b.Loop)
+	}
+}
+
+// renameGraph renames the super-nodes of the given graph to their unique names.
+// The graph is modified in place.
+func (n *namer) renameGraph(graph *dot.Graph) error {
+	var nodes []*dot.Node
+	for _, node := range graph.Nodes.Nodes {
+		nodes = append(nodes, &dot.Node{Name: n.resolve(node.Name), Attrs: node.Attrs})
+	}
+	var edges []*dot.Edge
+	for _, e := range graph.Edges.Edges {
+		edges = append(edges, &dot.Edge{Src: n.resolve(e.Src), Dst: n.resolve(e.Dst), Attrs: e.Attrs})
+	}
+	g, err := newGraph(graph.Name, nodes, edges)
+	if err != nil {
+		return errutil.Err(err)
+	}
+	*graph = *g
+	return nil
+}
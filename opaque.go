@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sort"
+
+	"decomp.org/x/graphs/primitive"
+	"github.com/mewfork/dot"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// opaquePrim is the name of the opaque primitive.
+//
+// When the reduction stalls, the "-collapse-residual" flag collapses the
+// residual graph into a single opaque primitive, so that the reduction always
+// completes with one clearly-marked island of unstructured control flow; or
+// one opaque primitive per unreduced region, when exceptional edges are
+// ignored. No structure is inferred for the residual; instead, its edges are
+// recorded in ResidualEdges, for later manual handling.
+//
+// In the node mapping of the primitive, the residual nodes are mapped to "A",
+// "B", etc, in node order (see role).
+const opaquePrim = "opaque"
+
+// collapseResidual merges each weakly connected component of graph with more
+// than one node into a single opaque node, and returns the opaque primitives
+// in node order.
+func collapseResidual(graph *dot.Graph, labels edgeLabels) ([]*Primitive, error) {
+	var prims []*Primitive
+	for _, comp := range components(graph) {
+		if len(comp) < 2 {
+			// Reduced region.
+			continue
+		}
+		region := make(map[string]bool)
+		m := make(map[string]string)
+		var names []string
+		// The entry node of the region is its node labeled "entry", if any, or
+		// its first node.
+		entry := comp[0].Name
+		for i, node := range comp {
+			if isEntry(node) {
+				entry = node.Name
+			}
+			region[node.Name] = true
+			m[role(i)] = node.Name
+			names = append(names, node.Name)
+		}
+		var edges [][2]string
+		for _, e := range graph.Edges.Edges {
+			if region[e.Src] && region[e.Dst] {
+				edges = append(edges, [2]string{e.Src, e.Dst})
+			}
+		}
+		sort.Sort(edgesByName(edges))
+		name, err := mergeRegion(graph, names, opaquePrim)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+		labels.merge(m, name)
+		var unquoted []string
+		for _, n := range names {
+			unquoted = append(unquoted, unquote(n))
+		}
+		warnf("opaque", unquoted, "residual nodes %q collapsed into opaque primitive %q", unquoted, name)
+		prim := &Primitive{
+			Primitive: &primitive.Primitive{
+				Node:  name,
+				Prim:  opaquePrim,
+				Nodes: m,
+			},
+			ResidualEdges: edges,
+			entry:         entry,
+			heuristic:     true,
+		}
+		prims = append(prims, prim)
+	}
+	return prims, nil
+}
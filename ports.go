@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/mewfork/dot"
+)
+
+// Ports is the external interface of the merged region of a primitive, as
+// requested by the "-with-ports" flag; the nodes outside of the region flowing
+// into it, and the nodes outside of the region it flows out to.
+//
+// The ports are computed from the graph under reduction at the time of the
+// merge, as the predecessors and successors of the super-node of the primitive
+// right after its region has been merged. As only the entry node of a matched
+// region may have predecessors outside of the region, and only its exit node
+// may have successors outside of it, the predecessors are those of the entry
+// node and the successors those of the exit node (e.g. of the follow node of a
+// conditional, which is part of its region). Neighbours may themselves be
+// super-nodes of previously located primitives, and are named as in the node
+// mapping. An edge from the region back into itself makes the super-node its
+// own predecessor and successor.
+type Ports struct {
+	// Predecessors of the region, sorted by name.
+	Preds []string `json:"preds,omitempty"`
+	// Successors of the region, sorted by name.
+	Succs []string `json:"succs,omitempty"`
+}
+
+// newPorts returns the ports of the region merged into the given super-node of
+// graph.
+func newPorts(graph *dot.Graph, node string) *Ports {
+	ports := &Ports{}
+	super, ok := lookupNode(graph, node)
+	if !ok {
+		return ports
+	}
+	ports.Preds = neighbourNames(super.Preds)
+	ports.Succs = neighbourNames(super.Succs)
+	return ports
+}
+
+// neighbourNames returns the unique unquoted names of the given nodes (see
+// unquoteNames), sorted by name.
+func neighbourNames(nodes []*dot.Node) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, node := range nodes {
+		name := unquote(node.Name)
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// recordPorts records the ports of the given primitive, the region of which
+// has just been merged into graph, if requested by the "-with-ports" flag and
+// not already recorded.
+func recordPorts(graph *dot.Graph, prim *Primitive) {
+	if flagWithPorts && prim.Ports == nil {
+		prim.Ports = newPorts(graph, prim.Node)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+
+	"decomp.org/x/graphs"
+	"github.com/mewfork/dot"
+)
+
+// In post-dominator follow mode (the "-postdom-follow" flag), the follow node
+// of each located conditional primitive is validated against the post-
+// dominator tree of the control flow graph. The follow node of a conditional
+// is otherwise inferred locally, as the node mapped to the exit node of the
+// primitive, which may pick the wrong join for primitives describing more than
+// the conditional itself (e.g. a conditional followed by a basic block). In
+// post-dominator follow mode, a conditional primitive only matches if its exit
+// node is mapped to the immediate post-dominator of its entry node; i.e. to the
+// join of the conditional. Conditionals without a join, as all but one of
+// their branches return, are left to the local inference.
+
+// isConditional reports whether the given primitive is a conditional; i.e.
+// whether it is acyclic and its entry node has two or more successors.
+func isConditional(sub *graphs.SubGraph) bool {
+	entry, ok := sub.Nodes.Lookup[sub.Entry()]
+	if !ok || len(entry.Succs) < 2 {
+		return false
+	}
+	return !isLoopPrim(sub)
+}
+
+// postDominators returns the immediate post-dominator of each node of graph
+// from which a node without successors is reachable. Post-dominance is
+// computed with respect to a virtual exit node succeeding each node without
+// successors, the name of which is returned; nodes immediately post-dominated
+// by the virtual exit map to it.
+func postDominators(graph *dot.Graph) (map[string]string, string, error) {
+	exit := "exit"
+	for i := 0; ; i++ {
+		if _, ok := graph.Nodes.Lookup[exit]; !ok {
+			break
+		}
+		exit = fmt.Sprintf("exit%d", i)
+	}
+	// Post-dominators are the dominators of the reversed graph, rooted at the
+	// virtual exit node.
+	var edges []*dot.Edge
+	for _, e := range graph.Edges.Edges {
+		edges = append(edges, &dot.Edge{Src: e.Dst, Dst: e.Src})
+	}
+	for _, node := range graph.Nodes.Nodes {
+		if len(node.Succs) == 0 {
+			edges = append(edges, &dot.Edge{Src: exit, Dst: node.Name})
+		}
+	}
+	nodes := append([]*dot.Node{{Name: exit}}, graph.Nodes.Nodes...)
+	rev, err := newGraph(graph.Name, nodes, edges)
+	if err != nil {
+		return nil, "", err
+	}
+	ipdoms := make(map[string]string)
+	for n, idom := range dominators(rev.Nodes.Lookup[exit]) {
+		if n.Name != exit {
+			ipdoms[n.Name] = idom.Name
+		}
+	}
+	return ipdoms, exit, nil
+}
+
+// A postdomTree is the post-dominator tree of a control flow graph at a given
+// reduction step, which is shared by the candidate matches of the step. The
+// post-dominators are computed on first use.
+type postdomTree struct {
+	// Control flow graph.
+	graph *dot.Graph
+	// Set to true once the post-dominators have been computed.
+	done bool
+	// Immediate post-dominators and virtual exit node, as returned by
+	// postDominators.
+	ipdoms map[string]string
+	exit   string
+	err    error
+}
+
+// newPostdomTree returns the post-dominator tree of the given control flow
+// graph, which must not be modified while the tree is in use.
+func newPostdomTree(graph *dot.Graph) *postdomTree {
+	return &postdomTree{graph: graph}
+}
+
+// followAgrees reports whether the exit node of the conditional primitive sub,
+// located at the node mapping m, is mapped to the immediate post-dominator of
+// its entry node in the graph. Conditionals without a join agree.
+func (pt *postdomTree) followAgrees(sub *graphs.SubGraph, m map[string]string) bool {
+	if !pt.done {
+		pt.done = true
+		pt.ipdoms, pt.exit, pt.err = postDominators(pt.graph)
+	}
+	if pt.err != nil {
+		return true
+	}
+	ipdom, ok := pt.ipdoms[m[sub.Entry()]]
+	if !ok || ipdom == pt.exit {
+		// No join.
+		return true
+	}
+	return ipdom == m[sub.Exit()]
+}
+
+// searchFollow locates an isomorphism of sub in graph, as described by search,
+// the exit node of which is mapped to the immediate post-dominator of its
+// entry node, as given by the post-dominator tree pt of graph.
+func searchFollow(graph *dot.Graph, sub *graphs.SubGraph, labels edgeLabels, pt *postdomTree) (map[string]string, bool) {
+	for _, node := range graph.Nodes.Nodes {
+		m, ok := isomorphism(graph, node, sub, labels, nil)
+		if ok && pt.followAgrees(sub, m) {
+			return m, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/gob"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"decomp.org/x/graphs"
+	"decomp.org/x/graphs/primitive"
+	"github.com/mewfork/dot"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// A Primitive is a control flow primitive located by restructure, optionally
+// annotated with additional information about its nodes.
+type Primitive struct {
+	*primitive.Primitive
+	// Attrs maps from node name to the carried attributes of the node, as
+	// specified by the "-carry-attrs" flag.
+	Attrs map[string]map[string]string `json:"attrs,omitempty"`
+	// Addr is the address of the original entry block of the primitive, as
+	// specified by the node attribute of the "-addr-attr" flag, if present.
+	Addr string `json:"addr,omitempty"`
+	// Exits lists the edges leaving the merged region of a primitive without a
+	// single follow node (i.e. a multi-exit loop or a jump table), from a node
+	// of the region to a node outside of it.
+	Exits [][2]string `json:"exits,omitempty"`
+	// Shape of the matched subgraph, as requested by the "-with-shape" flag.
+	Shape *Shape `json:"shape,omitempty"`
+	// EmptyBranch is the label of the edge of a conditional leading directly
+	// from its condition to its follow node (e.g. "T" for an empty then-branch),
+	// if labeled.
+	EmptyBranch string `json:"empty_branch,omitempty"`
+	// Labels holds the label sets of the parallel labeled edges of the
+	// primitive; e.g. the case values of a case body shared by several cases.
+	Labels []*LabelSet `json:"labels,omitempty"`
+	// Order is the index of the primitive in the order located, starting at 0,
+	// when the output is sorted by the "-sort-output" flag. The primitives may
+	// be restored to the order located, in which each super-node is defined
+	// before it is referenced, by sorting them by Order.
+	Order *int `json:"order,omitempty"`
+	// ConsumedEdges lists the edges of the original control flow graph within
+	// the merged region of the primitive, which were not already within the
+	// region of a nested primitive, as requested by the "-with-edges" flag.
+	ConsumedEdges [][2]string `json:"consumed_edges,omitempty"`
+	// Weight is the total weight of the original nodes covered by the
+	// primitive, as specified by the "-weight-attr" flag.
+	Weight float64 `json:"weight,omitempty"`
+	// Positions maps from node name to the position of the node in the node
+	// order of the input DOT file, as requested by the "-node-order" flag. The
+	// position of a super-node is the first position of its merged region.
+	Positions map[string]int `json:"positions,omitempty"`
+	// Continue is the name of the node from which the conditional continue of
+	// a loop primitive jumps back to the loop header (e.g. of the
+	// "continue_loop" primitive), as identified by the continue="true" edge
+	// attribute of the primitive.
+	Continue string `json:"continue,omitempty"`
+	// Levels maps from the super-node name of each loop of a loop nest (see
+	// loopNestPrim) to its nesting level; 0 for the outermost loop.
+	Levels map[string]int `json:"levels,omitempty"`
+	// Confidence denotes whether the primitive was located by an exact match of
+	// its template, or by a relaxation or fallback, as requested by the
+	// "-with-confidence" flag.
+	Confidence Confidence `json:"confidence,omitempty"`
+	// Mismatches holds the reasons for which the primitives of higher priority
+	// failed to match at the reduction step which located the primitive, in
+	// order of priority, as requested by the "-mismatches" flag.
+	Mismatches []*Mismatch `json:"mismatches,omitempty"`
+	// ResidualEdges lists the edges among the nodes of an opaque primitive;
+	// i.e. the edges of the residual graph of a stalled reduction, as collapsed
+	// by the "-collapse-residual" flag.
+	ResidualEdges [][2]string `json:"residual_edges,omitempty"`
+	// Ports is the external interface of the merged region of the primitive,
+	// as requested by the "-with-ports" flag.
+	Ports *Ports `json:"ports,omitempty"`
+	// Breaks lists the edges ending the cases of a switch, as attributed to
+	// the switch or to its nearest enclosing loop (see Break).
+	Breaks []*Break `json:"breaks,omitempty"`
+	// Names of the nodes mapped to the entry and exit nodes of the primitive.
+	entry, exit string
+	// heuristic specifies whether the primitive was located by a relaxation or
+	// fallback; i.e. a multi-exit or natural loop, a conditional located at its
+	// post-dominator follow node, a class of equivalent nodes, or an opaque
+	// residual.
+	heuristic bool
+}
+
+// Confidence denotes how a control flow primitive was located.
+type Confidence string
+
+// Confidence levels.
+const (
+	// ConfidenceExact denotes a primitive located by an exact match of its
+	// template, or of the structure it was located by (e.g. a switch).
+	ConfidenceExact Confidence = "exact"
+	// ConfidenceHeuristic denotes a primitive located by a relaxation or
+	// fallback, the structure of which downstream tools should treat with
+	// caution.
+	ConfidenceHeuristic Confidence = "heuristic"
+)
+
+// confidence returns the confidence level of the given primitive.
+func (prim *Primitive) confidence() Confidence {
+	if prim.heuristic {
+		return ConfidenceHeuristic
+	}
+	return ConfidenceExact
+}
+
+// newPrimitive returns the control flow primitive of sub located at the node
+// mapping m, the nodes of which were merged into the given super-node.
+func newPrimitive(sub *graphs.SubGraph, m map[string]string, node string) *Primitive {
+	prim := &Primitive{
+		Primitive: &primitive.Primitive{
+			Node:  node,
+			Prim:  sub.Name,
+			Nodes: m,
+		},
+		Continue: continueOrigin(sub, m),
+		entry:    m[sub.Entry()],
+		exit:     m[sub.Exit()],
+	}
+	if flagWithShape {
+		prim.Shape = newShape(sub)
+	}
+	return prim
+}
+
+// A Shape describes the structure of the subgraph of a control flow primitive,
+// in terms of its node roles.
+type Shape struct {
+	// Roles of the entry and exit nodes.
+	Entry string `json:"entry"`
+	Exit  string `json:"exit"`
+	// Node roles, in sorted order.
+	Nodes []string `json:"nodes"`
+	// Edges, sorted by source and destination role.
+	Edges [][2]string `json:"edges"`
+}
+
+// newShape returns the shape of the given subgraph.
+func newShape(sub *graphs.SubGraph) *Shape {
+	shape := &Shape{Entry: sub.Entry(), Exit: sub.Exit()}
+	for _, node := range sub.Nodes.Nodes {
+		shape.Nodes = append(shape.Nodes, node.Name)
+	}
+	sort.Strings(shape.Nodes)
+	for _, e := range sub.Edges.Edges {
+		shape.Edges = append(shape.Edges, [2]string{e.Src, e.Dst})
+	}
+	sort.Sort(edgesByName(shape.Edges))
+	return shape
+}
+
+// DecodePrimitives decodes control flow primitives from r, as written by the
+// "gob" output format.
+func DecodePrimitives(r io.Reader) ([]*Primitive, error) {
+	var prims []*Primitive
+	if err := gob.NewDecoder(r).Decode(&prims); err != nil {
+		return nil, err
+	}
+	return prims, nil
+}
+
+// carriedAttrs tracks the carried attributes of the nodes of a control flow
+// graph under reduction. A super-node inherits the carried attributes of the
+// entry node of its primitive, which is the representative node of the merged
+// region (e.g. the first basic block of a list).
+type carriedAttrs struct {
+	// nodes maps from node name to carried attributes.
+	nodes map[string]map[string]string
+}
+
+// newCarriedAttrs returns the given carried attributes of the nodes of graph.
+func newCarriedAttrs(graph *dot.Graph, keys []string) *carriedAttrs {
+	c := &carriedAttrs{nodes: make(map[string]map[string]string)}
+	for _, node := range graph.Nodes.Nodes {
+		attrs := make(map[string]string)
+		for _, key := range keys {
+			if _, ok := node.Attrs[key]; ok {
+				attrs[key] = attr(node.Attrs, key)
+			}
+		}
+		if len(attrs) > 0 {
+			c.nodes[unquote(node.Name)] = attrs
+		}
+	}
+	return c
+}
+
+// annotate annotates the nodes of the given primitive with their carried
+// attributes, and records the carried attributes of its super-node.
+func (c *carriedAttrs) annotate(prim *Primitive) {
+	for _, name := range prim.Nodes {
+		attrs, ok := c.nodes[name]
+		if !ok {
+			continue
+		}
+		if prim.Attrs == nil {
+			prim.Attrs = make(map[string]map[string]string)
+		}
+		prim.Attrs[name] = attrs
+	}
+	if attrs, ok := c.nodes[prim.entry]; ok {
+		c.nodes[prim.Node] = attrs
+	}
+}
+
+// entryAddrs tracks the addresses of the nodes of a control flow graph under
+// reduction. The address of a super-node is the address of the entry node of
+// its primitive; i.e. of the original block through which the merged region is
+// entered.
+type entryAddrs struct {
+	// nodes maps from node name to address.
+	nodes map[string]string
+}
+
+// newEntryAddrs returns the addresses of the nodes of graph, as specified by
+// the given node attribute. Nodes without the attribute have no address. As
+// the "label" attribute also marks the entry and exit nodes of graph, the
+// "entry" and "exit" labels are not addresses.
+func newEntryAddrs(graph *dot.Graph, key string) *entryAddrs {
+	a := &entryAddrs{nodes: make(map[string]string)}
+	for _, node := range graph.Nodes.Nodes {
+		addr := attr(node.Attrs, key)
+		if len(addr) == 0 || (key == "label" && (addr == "entry" || addr == "exit")) {
+			continue
+		}
+		a.nodes[unquote(node.Name)] = addr
+	}
+	return a
+}
+
+// annotate annotates the given primitive with the address of its entry node,
+// if known, and records the address of its super-node.
+func (a *entryAddrs) annotate(prim *Primitive) {
+	addr, ok := a.nodes[prim.entry]
+	if !ok {
+		return
+	}
+	prim.Addr = addr
+	a.nodes[prim.Node] = addr
+}
+
+// nodeWeights tracks the weights of the nodes of a control flow graph under
+// reduction. The weight of a super-node is the total weight of the original
+// nodes of its merged region.
+type nodeWeights struct {
+	// nodes maps from node name to weight.
+	nodes map[string]float64
+}
+
+// newNodeWeights returns the weights of the nodes of graph, as specified by the
+// given numeric node attribute. Nodes without the attribute weigh zero.
+func newNodeWeights(graph *dot.Graph, key string) (*nodeWeights, error) {
+	w := &nodeWeights{nodes: make(map[string]float64)}
+	for _, node := range graph.Nodes.Nodes {
+		if _, ok := node.Attrs[key]; !ok {
+			continue
+		}
+		val := attr(node.Attrs, key)
+		weight, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, errutil.Newf("invalid %s %q of node %q; expected number", key, val, node.Name)
+		}
+		w.nodes[unquote(node.Name)] = weight
+	}
+	return w, nil
+}
+
+// annotate annotates the given primitive with the total weight of its nodes,
+// and records the weight of its super-node.
+func (w *nodeWeights) annotate(prim *Primitive) {
+	var total float64
+	for _, name := range prim.Nodes {
+		total += w.nodes[name]
+	}
+	prim.Weight = total
+	w.nodes[prim.Node] = total
+}
+
+// nodePositions tracks the positions of the nodes of a control flow graph
+// under reduction, in the node order of the input DOT file; i.e. the order in
+// which the nodes of the graph are first declared or referenced. The position
+// of a super-node is the first position of the original nodes of its merged
+// region.
+type nodePositions struct {
+	// nodes maps from node name to position.
+	nodes map[string]int
+}
+
+// newNodePositions returns the positions of the nodes of graph.
+func newNodePositions(graph *dot.Graph) *nodePositions {
+	p := &nodePositions{nodes: make(map[string]int)}
+	for i, node := range graph.Nodes.Nodes {
+		p.nodes[unquote(node.Name)] = i
+	}
+	return p
+}
+
+// annotate annotates the nodes of the given primitive with their positions,
+// orders the exit, consumed and residual edges of the primitive by the
+// positions of their nodes, and records the position of its super-node.
+func (p *nodePositions) annotate(prim *Primitive) {
+	first := -1
+	for _, name := range prim.Nodes {
+		pos, ok := p.nodes[name]
+		if !ok {
+			continue
+		}
+		if prim.Positions == nil {
+			prim.Positions = make(map[string]int)
+		}
+		prim.Positions[name] = pos
+		if first == -1 || pos < first {
+			first = pos
+		}
+	}
+	sort.Stable(edgesByPosition{edges: prim.Exits, nodes: p.nodes})
+	sort.Stable(edgesByPosition{edges: prim.ConsumedEdges, nodes: p.nodes})
+	sort.Stable(edgesByPosition{edges: prim.ResidualEdges, nodes: p.nodes})
+	if first != -1 {
+		p.nodes[prim.Node] = first
+	}
+}
+
+// edgesByPosition implements sort.Interface, sorting edges by the positions of
+// their source and destination nodes.
+type edgesByPosition struct {
+	edges [][2]string
+	nodes map[string]int
+}
+
+func (es edgesByPosition) Len() int { return len(es.edges) }
+func (es edgesByPosition) Less(i, j int) bool {
+	a, b := es.edges[i], es.edges[j]
+	if es.nodes[a[0]] != es.nodes[b[0]] {
+		return es.nodes[a[0]] < es.nodes[b[0]]
+	}
+	return es.nodes[a[1]] < es.nodes[b[1]]
+}
+func (es edgesByPosition) Swap(i, j int) { es.edges[i], es.edges[j] = es.edges[j], es.edges[i] }
+
+// consumedEdges tracks the edges of the original control flow graph consumed
+// by the primitives of a reduction; i.e. the edges which fall within the merged
+// region of a primitive. For a fully reduced graph, the consumed edges of the
+// primitives partition the edges of the original graph.
+type consumedEdges struct {
+	// Edges of the original graph.
+	edges [][2]string
+	// consumed tracks the consumed edges.
+	consumed map[[2]string]bool
+	// members maps from super-node name to the original nodes of its region.
+	members map[string]map[string]bool
+}
+
+// newConsumedEdges returns a tracker of the consumed edges of graph.
+func newConsumedEdges(graph *dot.Graph) *consumedEdges {
+	c := &consumedEdges{
+		consumed: make(map[[2]string]bool),
+		members:  make(map[string]map[string]bool),
+	}
+	for _, e := range graph.Edges.Edges {
+		c.edges = append(c.edges, [2]string{unquote(e.Src), unquote(e.Dst)})
+	}
+	return c
+}
+
+// annotate annotates the given primitive with the edges consumed by it, and
+// records the original nodes of its super-node.
+func (c *consumedEdges) annotate(prim *Primitive) {
+	region := make(map[string]bool)
+	for _, name := range prim.Nodes {
+		members, ok := c.members[name]
+		if !ok {
+			region[name] = true
+			continue
+		}
+		for member := range members {
+			region[member] = true
+		}
+	}
+	for _, e := range c.edges {
+		if c.consumed[e] || !region[e[0]] || !region[e[1]] {
+			continue
+		}
+		c.consumed[e] = true
+		prim.ConsumedEdges = append(prim.ConsumedEdges, e)
+	}
+	sort.Sort(edgesByName(prim.ConsumedEdges))
+	c.members[prim.Node] = region
+}
+
+// sortPrims returns a copy of the given control flow primitives sorted by the
+// name of their super-node, as requested by the "-sort-output" flag, with the
+// order located recorded in Order. Primitives sharing a super-node name (as
+// super-node names are reused once merged) remain in the order located.
+func sortPrims(prims []*Primitive) []*Primitive {
+	sorted := make([]*Primitive, len(prims))
+	for i, prim := range prims {
+		p := *prim
+		order := i
+		p.Order = &order
+		sorted[i] = &p
+	}
+	sort.Stable(primsByNode(sorted))
+	return sorted
+}
+
+// primsByNode implements sort.Interface, sorting primitives by the name of
+// their super-node.
+type primsByNode []*Primitive
+
+func (ps primsByNode) Len() int           { return len(ps) }
+func (ps primsByNode) Less(i, j int) bool { return ps[i].Node < ps[j].Node }
+func (ps primsByNode) Swap(i, j int)      { ps[i], ps[j] = ps[j], ps[i] }
+
+// A LabelSet is the set of labels carried by the parallel edges between two
+// nodes of a control flow primitive.
+type LabelSet struct {
+	// Edge, as identified by the node roles of its source and destination.
+	Edge [2]string `json:"edge"`
+	// Labels of the parallel edges, in edge order.
+	Labels []string `json:"labels"`
+}
+
+// continueOrigin returns the name of the node mapped to the source of the
+// continue edge of the primitive sub, located at the node mapping m; i.e. the
+// edge with the continue="true" attribute. The empty string is returned if sub
+// has no continue edge.
+func continueOrigin(sub *graphs.SubGraph, m map[string]string) string {
+	for _, e := range sub.Edges.Edges {
+		if attr(e.Attrs, "continue") == "true" {
+			return m[e.Src]
+		}
+	}
+	return ""
+}
+
+// emptyBranch returns the label of the empty branch of the primitive sub,
+// located at the node mapping m of graph, or the empty string if sub is not a
+// conditional with an empty branch or the branch is unlabeled. A primitive is a
+// conditional with an empty branch if it is acyclic, and its entry node has two
+// successors, one of which is its exit node (e.g. the "if" primitive). The
+// labels must be those prior to the merge of the primitive. The labels of
+// parallel edges are separated by commas.
+func emptyBranch(sub *graphs.SubGraph, m map[string]string, labels edgeLabels) string {
+	entry, ok := sub.Nodes.Lookup[sub.Entry()]
+	if !ok || len(entry.Succs) != 2 {
+		return ""
+	}
+	direct := false
+	for _, succ := range entry.Succs {
+		if succ.Name == sub.Exit() {
+			direct = true
+		}
+	}
+	if !direct {
+		return ""
+	}
+	if isLoopPrim(sub) {
+		return ""
+	}
+	return strings.Join(labels[[2]string{m[sub.Entry()], m[sub.Exit()]}], ",")
+}
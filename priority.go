@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"decomp.org/x/graphs"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// defaultPriority is the priority of primitives without an explicit priority.
+const defaultPriority = 0
+
+// parsePriorities parses the given comma-separated list of primitive
+// priorities, as specified by the "-priorities" flag; e.g. "if=10,pre_loop=20".
+func parsePriorities(s string) (map[string]int, error) {
+	priorities := make(map[string]int)
+	for _, field := range strings.Split(s, ",") {
+		pos := strings.Index(field, "=")
+		if pos == -1 {
+			return nil, errutil.Newf("invalid priority %q; expected name=priority", field)
+		}
+		name := field[:pos]
+		priority, err := strconv.Atoi(field[pos+1:])
+		if err != nil {
+			return nil, errutil.Newf("invalid priority %q of primitive %q; expected integer", field[pos+1:], name)
+		}
+		priorities[name] = priority
+	}
+	return priorities, nil
+}
+
+// prioritize returns the primitives of set, sorted by descending priority. The
+// priority of a primitive is specified by priorities, and otherwise by the
+// "priority" graph attribute of the primitive (e.g. `priority=20` in its DOT
+// file), and is otherwise defaultPriority. Ties are broken by the order of set,
+// so that primitives of equal priority (and the variants of a primitive) keep
+// their relative order.
+func prioritize(set []*graphs.SubGraph, priorities map[string]int) ([]*graphs.SubGraph, error) {
+	known := make(map[string]bool)
+	for _, name := range primNames(set) {
+		known[name] = true
+	}
+	for name := range priorities {
+		if !known[name] {
+			return nil, errutil.Newf("unable to prioritize primitive %q; no such primitive", name)
+		}
+	}
+	ps := make([]int, len(set))
+	for i, sub := range set {
+		priority, ok := priorities[sub.Name]
+		if !ok {
+			var err error
+			if priority, err = subPriority(sub); err != nil {
+				return nil, errutil.Err(err)
+			}
+		}
+		ps[i] = priority
+	}
+	sorted := &subsByPriority{subs: append([]*graphs.SubGraph(nil), set...), priorities: ps}
+	sort.Stable(sorted)
+	return sorted.subs, nil
+}
+
+// subPriority returns the priority of the given primitive, as specified by its
+// "priority" graph attribute, or defaultPriority if unspecified.
+func subPriority(sub *graphs.SubGraph) (int, error) {
+	s := attr(sub.Attrs, "priority")
+	if len(s) == 0 {
+		return defaultPriority, nil
+	}
+	priority, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errutil.Newf("invalid priority %q of primitive %q; expected integer", s, sub.Name)
+	}
+	return priority, nil
+}
+
+// subsByPriority implements sort.Interface, sorting primitives by descending
+// priority.
+type subsByPriority struct {
+	subs       []*graphs.SubGraph
+	priorities []int
+}
+
+func (s *subsByPriority) Len() int           { return len(s.subs) }
+func (s *subsByPriority) Less(i, j int) bool { return s.priorities[i] > s.priorities[j] }
+func (s *subsByPriority) Swap(i, j int) {
+	s.subs[i], s.subs[j] = s.subs[j], s.subs[i]
+	s.priorities[i], s.priorities[j] = s.priorities[j], s.priorities[i]
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Progress, if non-nil, is invoked after each successful merge of the
+// reduction, with the index of the reduction step (starting at 0), the number
+// of nodes remaining in the control flow graph, and the control flow primitive
+// just located. It allows interactive frontends to display the progress of
+// restructure. Progress is also invoked for the attempts of RestructureBest.
+var Progress func(step, remaining int, prim *Primitive)
+
+// progress is the progress line printed as requested by the "-progress" flag,
+// if any.
+var progress *progressLine
+
+// A progressLine prints the progress of the reduction to w, overwriting the
+// line of the previous step, until the line is terminated by end.
+type progressLine struct {
+	w io.Writer
+	// Length of the current line, or 0 if no line is in progress.
+	width int
+}
+
+// newProgressLine returns a progress line which prints to w.
+func newProgressLine(w io.Writer) *progressLine {
+	return &progressLine{w: w}
+}
+
+// update prints the progress of the given reduction step, overwriting the
+// current line; update is a Progress callback.
+func (p *progressLine) update(step, remaining int, prim *Primitive) {
+	line := fmt.Sprintf("step %d: located %q; %d node(s) remaining", step+1, prim.Prim, remaining)
+	// Pad the line to clear the remainder of a longer previous line.
+	pad := ""
+	if n := p.width - len(line); n > 0 {
+		pad = strings.Repeat(" ", n)
+	}
+	fmt.Fprintf(p.w, "\r%s%s", line, pad)
+	p.width = len(line)
+}
+
+// end terminates the current line, if any, so that subsequent output starts on
+// a line of its own.
+func (p *progressLine) end() {
+	if p.width > 0 {
+		fmt.Fprintln(p.w)
+		p.width = 0
+	}
+}
+
+// endProgress terminates the progress line, if any; once a reduction finishes
+// or fails, and before a diagnostic is printed.
+func endProgress() {
+	if progress != nil {
+		progress.end()
+	}
+}
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+
+	"decomp.org/x/graphs/primitive"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// The "protobuf" output format encodes the located control flow primitives as
+// a PrimitiveList message in the Protocol Buffers wire format, as defined by
+// primitive.proto. The fields of the messages mirror those of the JSON output
+// format; fields omitted from the JSON output are left unset, and map entries
+// are encoded in sorted key order for deterministic output.
+
+// Wire types of the Protocol Buffers wire format.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// A protoBuffer is a Protocol Buffers message under construction.
+type protoBuffer []byte
+
+// varint appends the given varint to the message.
+func (b *protoBuffer) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	*b = append(*b, buf[:n]...)
+}
+
+// tag appends the tag of the given field and wire type to the message.
+func (b *protoBuffer) tag(field, wire int) {
+	b.varint(uint64(field)<<3 | uint64(wire))
+}
+
+// bytes appends the given length-delimited field to the message.
+func (b *protoBuffer) bytes(field int, v []byte) {
+	b.tag(field, wireBytes)
+	b.varint(uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+// string appends the given string field to the message, unless empty.
+func (b *protoBuffer) string(field int, s string) {
+	if len(s) > 0 {
+		b.bytes(field, []byte(s))
+	}
+}
+
+// message appends the given nested message field to the message.
+func (b *protoBuffer) message(field int, m protoBuffer) {
+	b.bytes(field, m)
+}
+
+// int64 appends the given int64 field to the message.
+func (b *protoBuffer) int64(field int, v int64) {
+	b.tag(field, wireVarint)
+	b.varint(uint64(v))
+}
+
+// double appends the given double field to the message, unless zero.
+func (b *protoBuffer) double(field int, v float64) {
+	if v == 0 {
+		return
+	}
+	b.tag(field, wireFixed64)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+	*b = append(*b, buf[:]...)
+}
+
+// stringMap appends the entries of the given map<string, string> field to the
+// message, in sorted key order.
+func (b *protoBuffer) stringMap(field int, m map[string]string) {
+	for _, key := range sortedKeys(m) {
+		var entry protoBuffer
+		entry.string(1, key)
+		entry.string(2, m[key])
+		b.message(field, entry)
+	}
+}
+
+// edge appends the given Edge message field to the message.
+func (b *protoBuffer) edge(field int, e [2]string) {
+	var m protoBuffer
+	m.string(1, e[0])
+	m.string(2, e[1])
+	b.message(field, m)
+}
+
+// writeProtobuf writes the given control flow primitives to w, as a
+// PrimitiveList message with the given metadata.
+func writeProtobuf(w io.Writer, prims []*Primitive, meta map[string]string) error {
+	var list protoBuffer
+	for _, prim := range prims {
+		list.message(1, marshalPrimitive(prim))
+	}
+	list.stringMap(2, meta)
+	_, err := w.Write(list)
+	return err
+}
+
+// marshalPrimitive returns the Primitive message of the given control flow
+// primitive.
+func marshalPrimitive(prim *Primitive) protoBuffer {
+	var b protoBuffer
+	b.string(1, prim.Prim)
+	b.string(2, prim.Node)
+	b.stringMap(3, prim.Nodes)
+	var names []string
+	for name := range prim.Attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var attrs, entry protoBuffer
+		attrs.stringMap(1, prim.Attrs[name])
+		entry.string(1, name)
+		entry.message(2, attrs)
+		b.message(4, entry)
+	}
+	for _, e := range prim.Exits {
+		b.edge(5, e)
+	}
+	if shape := prim.Shape; shape != nil {
+		var m protoBuffer
+		m.string(1, shape.Entry)
+		m.string(2, shape.Exit)
+		for _, name := range shape.Nodes {
+			m.bytes(3, []byte(name))
+		}
+		for _, e := range shape.Edges {
+			m.edge(4, e)
+		}
+		b.message(6, m)
+	}
+	b.string(7, prim.EmptyBranch)
+	for _, set := range prim.Labels {
+		var m protoBuffer
+		m.edge(1, set.Edge)
+		for _, label := range set.Labels {
+			m.bytes(2, []byte(label))
+		}
+		b.message(8, m)
+	}
+	if prim.Order != nil {
+		b.int64(9, int64(*prim.Order))
+	}
+	for _, e := range prim.ConsumedEdges {
+		b.edge(10, e)
+	}
+	b.double(11, prim.Weight)
+	b.intMap(12, prim.Positions)
+	b.string(13, prim.Continue)
+	b.intMap(14, prim.Levels)
+	b.string(15, string(prim.Confidence))
+	for _, mm := range prim.Mismatches {
+		var m protoBuffer
+		m.string(1, mm.Prim)
+		m.string(2, mm.Kind)
+		m.string(3, mm.Role)
+		m.string(4, mm.Node)
+		if mm.Edge != nil {
+			m.edge(5, *mm.Edge)
+		}
+		m.int64(6, int64(mm.Depth))
+		m.string(7, mm.Reason)
+		b.message(16, m)
+	}
+	for _, e := range prim.ResidualEdges {
+		b.edge(17, e)
+	}
+	b.string(18, prim.Addr)
+	if ports := prim.Ports; ports != nil {
+		var m protoBuffer
+		for _, name := range ports.Preds {
+			m.bytes(1, []byte(name))
+		}
+		for _, name := range ports.Succs {
+			m.bytes(2, []byte(name))
+		}
+		b.message(19, m)
+	}
+	for _, br := range prim.Breaks {
+		var m protoBuffer
+		m.string(1, br.Case)
+		m.edge(2, br.Edge)
+		m.string(3, br.Target)
+		m.string(4, br.Kind)
+		m.string(5, br.Loop)
+		b.message(20, m)
+	}
+	return b
+}
+
+// intMap appends the entries of the given map with string keys and integer
+// values to the message, in sorted key order.
+func (b *protoBuffer) intMap(field int, m map[string]int) {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var entry protoBuffer
+		entry.string(1, key)
+		entry.int64(2, int64(m[key]))
+		b.message(field, entry)
+	}
+}
+
+// sortedKeys returns the keys of the given map, in sorted order.
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// A protoField is a field of a Protocol Buffers message.
+type protoField struct {
+	// Field number.
+	num int
+	// Value of varint and fixed fields.
+	v uint64
+	// Contents of length-delimited fields.
+	data []byte
+}
+
+// protoFields parses the fields of the given Protocol Buffers message, in
+// order.
+func protoFields(buf []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(buf) > 0 {
+		tag, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, errutil.New("invalid protobuf message; truncated tag")
+		}
+		buf = buf[n:]
+		f := protoField{num: int(tag >> 3)}
+		switch wire := int(tag & 7); wire {
+		case wireVarint:
+			f.v, n = binary.Uvarint(buf)
+			if n <= 0 {
+				return nil, errutil.Newf("invalid protobuf message; truncated varint of field %d", f.num)
+			}
+			buf = buf[n:]
+		case wireFixed64:
+			if len(buf) < 8 {
+				return nil, errutil.Newf("invalid protobuf message; truncated fixed64 of field %d", f.num)
+			}
+			f.v = binary.LittleEndian.Uint64(buf)
+			buf = buf[8:]
+		case wireFixed32:
+			if len(buf) < 4 {
+				return nil, errutil.Newf("invalid protobuf message; truncated fixed32 of field %d", f.num)
+			}
+			f.v = uint64(binary.LittleEndian.Uint32(buf))
+			buf = buf[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(buf)
+			if n <= 0 || uint64(len(buf)-n) < size {
+				return nil, errutil.Newf("invalid protobuf message; truncated contents of field %d", f.num)
+			}
+			f.data = buf[n : n+int(size)]
+			buf = buf[n+int(size):]
+		default:
+			return nil, errutil.Newf("invalid protobuf message; unsupported wire type %d of field %d", wire, f.num)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// DecodeProtoPrimitives decodes control flow primitives from r, as written by
+// the "protobuf" output format. Unknown fields are ignored.
+func DecodeProtoPrimitives(r io.Reader) ([]*Primitive, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	return UnmarshalPrimitives(buf)
+}
+
+// UnmarshalPrimitives unmarshals control flow primitives from the given
+// PrimitiveList message.
+func UnmarshalPrimitives(buf []byte) ([]*Primitive, error) {
+	doc, err := UnmarshalDocument(buf)
+	if err != nil {
+		return nil, err
+	}
+	return doc.Prims, nil
+}
+
+// UnmarshalDocument unmarshals control flow primitives and their metadata from
+// the given PrimitiveList message. The metadata is nil if unspecified.
+func UnmarshalDocument(buf []byte) (*Document, error) {
+	fields, err := protoFields(buf)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	doc := &Document{Prims: []*Primitive{}}
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			prim, err := unmarshalPrimitive(f.data)
+			if err != nil {
+				return nil, errutil.Err(err)
+			}
+			doc.Prims = append(doc.Prims, prim)
+		case 2:
+			key, val, err := unmarshalEntry(f.data)
+			if err != nil {
+				return nil, errutil.Err(err)
+			}
+			if doc.Meta == nil {
+				doc.Meta = make(map[string]string)
+			}
+			doc.Meta[key] = string(val)
+		}
+	}
+	return doc, nil
+}
+
+// unmarshalPrimitive unmarshals a control flow primitive from the given
+// Primitive message.
+func unmarshalPrimitive(buf []byte) (*Primitive, error) {
+	fields, err := protoFields(buf)
+	if err != nil {
+		return nil, err
+	}
+	prim := &Primitive{Primitive: &primitive.Primitive{Nodes: make(map[string]string)}}
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			prim.Prim = string(f.data)
+		case 2:
+			prim.Node = string(f.data)
+		case 3:
+			key, val, err := unmarshalEntry(f.data)
+			if err != nil {
+				return nil, err
+			}
+			prim.Nodes[key] = string(val)
+		case 4:
+			name, val, err := unmarshalEntry(f.data)
+			if err != nil {
+				return nil, err
+			}
+			attrs := make(map[string]string)
+			entries, err := protoFields(val)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				if e.num != 1 {
+					continue
+				}
+				key, val, err := unmarshalEntry(e.data)
+				if err != nil {
+					return nil, err
+				}
+				attrs[key] = string(val)
+			}
+			if prim.Attrs == nil {
+				prim.Attrs = make(map[string]map[string]string)
+			}
+			prim.Attrs[name] = attrs
+		case 5:
+			e, err := unmarshalEdge(f.data)
+			if err != nil {
+				return nil, err
+			}
+			prim.Exits = append(prim.Exits, e)
+		case 6:
+			shape, err := unmarshalShape(f.data)
+			if err != nil {
+				return nil, err
+			}
+			prim.Shape = shape
+		case 7:
+			prim.EmptyBranch = string(f.data)
+		case 8:
+			set, err := unmarshalLabelSet(f.data)
+			if err != nil {
+				return nil, err
+			}
+			prim.Labels = append(prim.Labels, set)
+		case 9:
+			order := int(int64(f.v))
+			prim.Order = &order
+		case 10:
+			e, err := unmarshalEdge(f.data)
+			if err != nil {
+				return nil, err
+			}
+			prim.ConsumedEdges = append(prim.ConsumedEdges, e)
+		case 11:
+			prim.Weight = math.Float64frombits(f.v)
+		case 12:
+			name, pos, err := unmarshalIntEntry(f.data)
+			if err != nil {
+				return nil, err
+			}
+			if prim.Positions == nil {
+				prim.Positions = make(map[string]int)
+			}
+			prim.Positions[name] = pos
+		case 13:
+			prim.Continue = string(f.data)
+		case 14:
+			name, level, err := unmarshalIntEntry(f.data)
+			if err != nil {
+				return nil, err
+			}
+			if prim.Levels == nil {
+				prim.Levels = make(map[string]int)
+			}
+			prim.Levels[name] = level
+		case 15:
+			prim.Confidence = Confidence(f.data)
+		case 16:
+			mm, err := unmarshalMismatch(f.data)
+			if err != nil {
+				return nil, err
+			}
+			prim.Mismatches = append(prim.Mismatches, mm)
+		case 17:
+			e, err := unmarshalEdge(f.data)
+			if err != nil {
+				return nil, err
+			}
+			prim.ResidualEdges = append(prim.ResidualEdges, e)
+		case 18:
+			prim.Addr = string(f.data)
+		case 19:
+			ports, err := unmarshalPorts(f.data)
+			if err != nil {
+				return nil, err
+			}
+			prim.Ports = ports
+		case 20:
+			br, err := unmarshalBreak(f.data)
+			if err != nil {
+				return nil, err
+			}
+			prim.Breaks = append(prim.Breaks, br)
+		}
+	}
+	return prim, nil
+}
+
+// unmarshalEntry unmarshals the key and value of the given map entry message
+// with a string key and a length-delimited value.
+func unmarshalEntry(buf []byte) (key string, val []byte, err error) {
+	fields, err := protoFields(buf)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			key = string(f.data)
+		case 2:
+			val = f.data
+		}
+	}
+	return key, val, nil
+}
+
+// unmarshalIntEntry unmarshals the key and value of the given map entry
+// message with a string key and an integer value.
+func unmarshalIntEntry(buf []byte) (key string, val int, err error) {
+	fields, err := protoFields(buf)
+	if err != nil {
+		return "", 0, err
+	}
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			key = string(f.data)
+		case 2:
+			val = int(int64(f.v))
+		}
+	}
+	return key, val, nil
+}
+
+// unmarshalEdge unmarshals the given Edge message.
+func unmarshalEdge(buf []byte) ([2]string, error) {
+	src, dst, err := unmarshalEntry(buf)
+	return [2]string{src, string(dst)}, err
+}
+
+// unmarshalShape unmarshals the given Shape message.
+func unmarshalShape(buf []byte) (*Shape, error) {
+	fields, err := protoFields(buf)
+	if err != nil {
+		return nil, err
+	}
+	shape := &Shape{}
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			shape.Entry = string(f.data)
+		case 2:
+			shape.Exit = string(f.data)
+		case 3:
+			shape.Nodes = append(shape.Nodes, string(f.data))
+		case 4:
+			e, err := unmarshalEdge(f.data)
+			if err != nil {
+				return nil, err
+			}
+			shape.Edges = append(shape.Edges, e)
+		}
+	}
+	return shape, nil
+}
+
+// unmarshalPorts unmarshals the given Ports message.
+func unmarshalPorts(buf []byte) (*Ports, error) {
+	fields, err := protoFields(buf)
+	if err != nil {
+		return nil, err
+	}
+	ports := &Ports{}
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			ports.Preds = append(ports.Preds, string(f.data))
+		case 2:
+			ports.Succs = append(ports.Succs, string(f.data))
+		}
+	}
+	return ports, nil
+}
+
+// unmarshalBreak unmarshals the given Break message.
+func unmarshalBreak(buf []byte) (*Break, error) {
+	fields, err := protoFields(buf)
+	if err != nil {
+		return nil, err
+	}
+	br := &Break{}
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			br.Case = string(f.data)
+		case 2:
+			e, err := unmarshalEdge(f.data)
+			if err != nil {
+				return nil, err
+			}
+			br.Edge = e
+		case 3:
+			br.Target = string(f.data)
+		case 4:
+			br.Kind = string(f.data)
+		case 5:
+			br.Loop = string(f.data)
+		}
+	}
+	return br, nil
+}
+
+// unmarshalLabelSet unmarshals the given LabelSet message.
+func unmarshalLabelSet(buf []byte) (*LabelSet, error) {
+	fields, err := protoFields(buf)
+	if err != nil {
+		return nil, err
+	}
+	set := &LabelSet{}
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			e, err := unmarshalEdge(f.data)
+			if err != nil {
+				return nil, err
+			}
+			set.Edge = e
+		case 2:
+			set.Labels = append(set.Labels, string(f.data))
+		}
+	}
+	return set, nil
+}
+
+// unmarshalMismatch unmarshals the given Mismatch message.
+func unmarshalMismatch(buf []byte) (*Mismatch, error) {
+	fields, err := protoFields(buf)
+	if err != nil {
+		return nil, err
+	}
+	mm := &Mismatch{}
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			mm.Prim = string(f.data)
+		case 2:
+			mm.Kind = string(f.data)
+		case 3:
+			mm.Role = string(f.data)
+		case 4:
+			mm.Node = string(f.data)
+		case 5:
+			e, err := unmarshalEdge(f.data)
+			if err != nil {
+				return nil, err
+			}
+			mm.Edge = &e
+		case 6:
+			mm.Depth = int(int64(f.v))
+		case 7:
+			mm.Reason = string(f.data)
+		}
+	}
+	return mm, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"os"
+
+	"decomp.org/x/graphs"
+	"github.com/mewfork/dot"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// Phases of a reduction, in order.
+const (
+	// Locate the return primitive, as requested by the "-mark-return" flag.
+	phaseReturn = iota
+	// Collapse equivalent nodes, as requested by NodeEquivalence or the
+	// "-equiv-attr" flag.
+	phaseEquiv
+	// Search for a full reduction, as requested by the "-strategy" flag.
+	phaseStrategy
+	// Merge the first located primitive of each reduction step.
+	phaseGreedy
+	// Rename the graph and validate the primitive-coverage policy.
+	phaseFinish
+	// Reduction finished, or failed.
+	phaseDone
+)
+
+// A reduction is the reduction of a control flow graph, which is advanced by a
+// single step at a time by next. Both reduce and Iterate advance a reduction,
+// so they locate the same primitives.
+type reduction struct {
+	// Control flow graph, reduced in place.
+	graph *dot.Graph
+	// Ordered list of subgraphs of the primitives to locate.
+	set []*graphs.SubGraph
+	// Number of nodes of the fully reduced graph; one per region when
+	// exceptional edges are ignored.
+	target int
+	labels edgeLabels
+	an     *annotator
+	// Located primitives are emitted to out, unless nil; the reduction fails
+	// if out fails.
+	out Emitter
+	// Located control flow primitives, in the order located.
+	prims []*Primitive
+	// Primitives merged ahead of their reduction step (e.g. by the exhaustive
+	// strategy), in the order located.
+	pending []*step
+	phase   int
+}
+
+// newReduction returns a reduction of the given control flow graph, using the
+// given ordered list of subgraphs, which emits the located primitives to out,
+// unless nil.
+func newReduction(graph *dot.Graph, set []*graphs.SubGraph, out Emitter) (*reduction, error) {
+	r := &reduction{graph: graph, set: set, target: 1, out: out}
+	if len(flagExceptionEdges) > 0 {
+		r.target = componentCount(graph)
+	}
+	r.labels = newEdgeLabels(graph)
+	if err := collapseParallelEdges(graph); err != nil {
+		return nil, err
+	}
+	var err error
+	if r.an, err = newAnnotator(graph); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// next advances the reduction by a single step, and returns the located
+// primitive. A nil primitive is returned once the reduction has finished, and
+// on error. Every call after a failed or finished reduction returns nil.
+func (r *reduction) next() (*Primitive, error) {
+	prim, err := r.step()
+	if err != nil {
+		r.phase = phaseDone
+		endProgress()
+		return nil, err
+	}
+	if prim == nil {
+		endProgress()
+	}
+	return prim, nil
+}
+
+// step advances the reduction by a single step, as described by next.
+func (r *reduction) step() (*Primitive, error) {
+	for {
+		if len(r.pending) > 0 {
+			// The steps of an exhaustive reduction are validated and their
+			// ports recorded by reduceExhaustive, at the time of their merge.
+			s := r.pending[0]
+			r.pending = r.pending[1:]
+			if err := r.record(s.prim, s.remaining); err != nil {
+				return nil, err
+			}
+			return s.prim, nil
+		}
+		switch r.phase {
+		case phaseReturn:
+			r.phase = phaseEquiv
+			if !flagMarkReturn {
+				continue
+			}
+			prim, err := findReturn(r.graph, r.labels)
+			if err != nil {
+				return nil, err
+			}
+			if prim != nil {
+				return r.merged(prim)
+			}
+		case phaseEquiv:
+			equiv := equivalence()
+			if equiv == nil {
+				r.phase = phaseStrategy
+				continue
+			}
+			prim, err := findEquivalent(r.graph, r.labels, equiv)
+			if err != nil {
+				return nil, err
+			}
+			if prim == nil {
+				r.phase = phaseStrategy
+				continue
+			}
+			return r.merged(prim)
+		case phaseStrategy:
+			r.phase = phaseGreedy
+			switch flagStrategy {
+			case strategyGreedy:
+				// Reduced by phaseGreedy.
+			case strategyExhaustive:
+				steps, final, ok, err := reduceExhaustive(r.graph, r.set, r.labels, r.target, len(r.prims))
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					*r.graph = *final
+					r.pending = steps
+				}
+				// Otherwise, fall back to the greedy strategy, which reports
+				// the stalled reduction.
+			default:
+				return nil, errutil.Newf("invalid strategy %q", flagStrategy)
+			}
+		case phaseGreedy:
+			if len(r.graph.Nodes.Nodes) <= r.target {
+				r.phase = phaseFinish
+				continue
+			}
+			prim, err := findPrim(r.graph, r.set, r.labels)
+			if e, ok := err.(*Error); ok && e.Kind == KindUnreduced && flagLoopsOnly {
+				// Conditionals are left unstructured in loops-only mode.
+				r.phase = phaseFinish
+				continue
+			}
+			if e, ok := err.(*Error); ok && e.Kind == KindUnreduced && flagCollapseResidual {
+				// Collapse the residual graph into opaque primitives.
+				opaque, err := collapseResidual(r.graph, r.labels)
+				if err != nil {
+					return nil, err
+				}
+				for i, prim := range opaque {
+					if err := validateMerge(r.graph, prim, len(r.prims)+i); err != nil {
+						return nil, err
+					}
+					recordPorts(r.graph, prim)
+					r.pending = append(r.pending, &step{prim: prim, remaining: len(r.graph.Nodes.Nodes)})
+				}
+				r.phase = phaseFinish
+				continue
+			}
+			if err != nil {
+				return nil, r.stall(err)
+			}
+			return r.merged(prim)
+		case phaseFinish:
+			r.phase = phaseDone
+			if nm := r.an.nm; nm != nil {
+				if err := nm.renameGraph(r.graph); err != nil {
+					return nil, err
+				}
+			}
+			// Validate the primitives against the primitive-coverage policy.
+			if err := checkPolicy(r.prims, len(r.graph.Nodes.Nodes) == r.target); err != nil {
+				return nil, err
+			}
+		case phaseDone:
+			return nil, nil
+		}
+	}
+}
+
+// merged validates the merge of the given primitive, which has just been
+// merged into the graph, and records it.
+func (r *reduction) merged(prim *Primitive) (*Primitive, error) {
+	if err := validateMerge(r.graph, prim, len(r.prims)); err != nil {
+		return nil, err
+	}
+	recordPorts(r.graph, prim)
+	if err := r.record(prim, len(r.graph.Nodes.Nodes)); err != nil {
+		return nil, err
+	}
+	return prim, nil
+}
+
+// record records the given located primitive, after which remaining nodes
+// remain in the graph. An error is returned if the primitive may not be
+// emitted to the primary output.
+func (r *reduction) record(prim *Primitive, remaining int) error {
+	r.an.annotate(prim)
+	r.prims = append(r.prims, prim)
+	if r.out != nil {
+		if err := r.out.Emit(prim); err != nil {
+			return err
+		}
+	}
+	if Progress != nil {
+		Progress(len(r.prims)-1, remaining, prim)
+	}
+	return nil
+}
+
+// stall reports the stalled reduction of the graph, which failed to locate a
+// primitive with the given error, and returns the error.
+func (r *reduction) stall(err error) error {
+	if nm := r.an.nm; nm != nil {
+		if err := nm.renameGraph(r.graph); err != nil {
+			return err
+		}
+	}
+	var names []string
+	for _, node := range r.graph.Nodes.Nodes {
+		names = append(names, node.Name)
+	}
+	errorf("unreduced", names, "%v", err)
+	if flagStrict {
+		printStallReport(os.Stderr, r.graph, r.set, len(r.prims))
+	}
+	checkIrreducibleLoops(r.graph)
+	if analyze() {
+		checkResidualLoops(r.graph)
+	}
+	return err
+}
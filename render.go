@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// graphvizDot is the name of the Graphviz dot command, as located in PATH.
+var graphvizDot = "dot"
+
+// writeRender renders the primitive tree of the given primitives (see
+// writePrimTreeDOT) to the image at imgPath, using Graphviz dot. The image
+// format is determined by the file extension of imgPath (e.g. "png" for
+// "out.png"), and defaults to PNG. If dot is not available, the primitive tree
+// is written in DOT format instead, to imgPath with ".dot" appended (so as not
+// to overwrite an input DOT file of the same base name), and a notice is
+// printed to standard error.
+//
+// As with the "prim-tree-dot" output format, loop nests (see loopNestPrim) are
+// not supported, as they reference the loops of the primitive tree without
+// being part of it; the primitive tree is thus rendered before the loop nests
+// are added.
+func writeRender(imgPath string, prims []*Primitive) error {
+	for _, prim := range prims {
+		if prim.Prim == loopNestPrim {
+			return errutil.Newf("loop nests not supported by -render")
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := writePrimTreeDOT(buf, prims); err != nil {
+		return errutil.Err(err)
+	}
+	ext := filepath.Ext(imgPath)
+	dotCmd, err := exec.LookPath(graphvizDot)
+	if err != nil {
+		dotPath := imgPath + ".dot"
+		if err := ioutil.WriteFile(dotPath, buf.Bytes(), 0644); err != nil {
+			return errutil.Err(err)
+		}
+		if !flagQuiet {
+			fmt.Fprintf(os.Stderr, "Notice: unable to locate Graphviz %q; wrote primitive tree to %q instead of rendering %q\n", graphvizDot, dotPath, imgPath)
+		}
+		return nil
+	}
+	format := "png"
+	if len(ext) > 1 {
+		format = ext[1:]
+	}
+	cmd := exec.Command(dotCmd, "-T"+format, "-o", imgPath)
+	cmd.Stdin = buf
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return errutil.Newf("unable to render %q; %v: %s", imgPath, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -6,15 +6,151 @@
 //
 // Usage:
 //     restructure [OPTION]... [CFG.dot]
+//     restructure -tune [OPTION]... CFG.dot...
+//     restructure -score [OPTION]... CFG.dot...
+//     restructure -lint-prims [OPTION]...
+//     restructure -archive ARCHIVE [OPTION]...
 //
 //     Flags:
+//       -addr-attr string
+//             Node attribute holding the address of each block, to annotate primitives by entry address.
+//       -allow-prims string
+//             Comma-separated list of permitted primitives (policy check).
+//       -also-stdout
+//             Also write the output to stdout (see -o).
+//       -archive string
+//             Zip or tar archive of CFGs (*.dot, or *.json with -input json) to restructure.
+//       -assert-complete
+//             Verify that the primitives cover every node and edge of the CFG.
+//       -assert-single-root
+//             Verify that the primitives of a fully reduced CFG form a single tree.
+//       -baseline string
+//             Baseline primitives (JSON) to compare against; exit non-zero on difference.
+//       -cache-dir string
+//             Directory of cached primitives, keyed by input and primitive set.
+//       -carry-attrs string
+//             Comma-separated list of node attributes to include in the output.
+//       -collapse-residual
+//             Collapse the residual CFG of a stalled reduction into an opaque primitive.
+//       -components
+//             Restructure each weakly connected component of the CFG separately.
+//       -diagnostics string
+//             Output path of diagnostics (JSON).
+//       -dot string
+//             Source of the CFG (e.g. "digraph{A->B}"), instead of CFG.dot or stdin.
+//       -dump-graph string
+//             Output path of the reduced CFG (DOT).
+//       -dump-graph-nested
+//             Dump the CFG with each merged region as a cluster (see -dump-graph).
+//       -equiv-attr string
+//             Collapse nodes sharing the value of the given attribute before matching (opt-in).
+//       -exception-edges string
+//             Output path of exception handler associations (JSON); ignore exceptional edges.
+//       -exclude-nodes string
+//             Comma-separated list of nodes to remove before restructuring.
+//       -explain
+//             Print the rationale of each reduction step.
+//       -fingerprint
+//             Output a structural fingerprint instead of JSON.
+//       -format string
+//             Output format ("json", "gob", "protobuf", "prim-tree-dot", "rewrites", "sexpr" or "folded") (default "json").
+//       -fuzz-order N
+//             Output a report (JSON) of which of N random primitive orderings reduce the CFG differently.
 //       -indent
 //             Indent JSON output.
+//       -input string
+//             Input format ("dot" or "json") (default "dot").
+//       -lint-prims
+//             Output a report (JSON) of the problems of the primitive set, without input.
+//       -loop-nests
+//             Group nested loop primitives into composite loop_nest primitives.
+//       -loops-only
+//             Only structure loops, leaving conditionals unstructured; tolerate partial reduction.
+//       -mark-return
+//             Mark the single terminal node of the CFG as a return primitive.
+//       -max-depth int
+//             Maximum nesting depth of primitive trees in tree output; 0 for no limit (default 1000).
+//       -meta value
+//             Metadata key=value pair to include in the output (repeatable).
+//       -mismatches
+//             Include the reasons for which primitives failed to match at each step in the output.
+//       -name-offset int
+//             Starting offset of unique super-node name counters.
+//       -name-prefix string
+//             Prefix of unique super-node names.
+//       -ndjson
+//             Stream primitives as newline-delimited JSON to the output as they are located.
+//       -newer-than string
+//             Skip input files not modified since the modification time of the given file.
+//       -node-order
+//             Include node positions of the input order in the output, and order edge lists by them.
 //       -o string
 //             Output path.
+//       -order string
+//             Comma-separated list of primitives to locate first, in order.
+//       -postdom-follow
+//             Locate conditionals at the immediate post-dominator of their condition.
+//       -prefer-largest
+//             Merge the primitive covering the most nodes at each step, rather than the first matching one.
 //       -prims string
 //             Comma-separated list of control flow primitives (*.dot).
+//       -prims-dir string
+//             Directory of the default control flow primitives (*.dot), overriding the embedded ones.
+//       -priorities string
+//             Comma-separated list of primitive priorities (e.g. "if=10,pre_loop=20").
+//       -progress
+//             Print reduction progress to standard error.
+//       -quiet
+//             Suppress non-essential output (overrides -v).
+//       -render string
+//             Render the primitive tree to the given image (e.g. out.png) using Graphviz dot.
+//       -require-reduced
+//             Require the CFG to be fully reduced (policy check).
+//       -reverse
+//             Reverse the direction of each edge of the CFG; its exit node becomes the entry node.
+//       -reverse-map
+//             Include a map from each CFG node to its innermost owning primitive in JSON output.
+//       -score
+//             Output an aggregate recovery-quality report (JSON) of the given CFGs.
+//       -since string
+//             Skip input files not modified since the given time (RFC 3339).
+//       -simplify
+//             Fold redundant nestings of primitives (e.g. a list within a list).
+//       -sort-output
+//             Sort output primitives by node name (json, gob and protobuf formats).
+//       -stats string
+//             Output path of recovery metrics (JSON).
+//       -strategy string
+//             Structuring strategy ("greedy" or "exhaustive") (default "greedy").
+//       -stream
+//             Stream primitives as a JSON array to the output as they are located.
+//       -strict
+//             Print a failure report of the residual CFG when the reduction stalls.
+//       -tee string
+//             Stream primitives as newline-delimited JSON to TCP address.
+//       -transform string
+//             Comma-separated list of graph transforms to apply before restructuring.
+//       -tune
+//             Output primitive order of decreasing match frequency over CFG.dot files.
+//       -usage
+//             Output the match counts of the primitives over CFG.dot files, and the unused primitives.
 //       -v    Verbose output.
+//       -verify
+//             Validate that references among primitives are acyclic.
+//       -vet-format
+//             Print diagnostics as "file:line:col: message", using the line and col node attributes.
+//       -virtual-root string
+//             Virtual root node to remove; its successors are the real entry nodes.
+//       -weight-attr string
+//             Numeric node attribute to sum over the nodes of each primitive.
+//       -with-confidence
+//             Include the confidence of each primitive ("exact" or "heuristic") in the output.
+//       -with-edges
+//             Include the edges of the CFG consumed by each primitive in the output.
+//       -with-ports
+//             Include the predecessors and successors of the merged region of each primitive in the output.
+//       -with-shape
+//             Include the shape of the matched subgraph of each primitive in the output.
 //
 // Example input:
 //    digraph foo {
@@ -52,48 +188,322 @@ package main
 
 import (
 	"bytes"
+	"encoding/gob"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	"net"
 	"os"
-	"path/filepath"
 	"sort"
 	"strings"
 
 	"decomp.org/x/graphs"
-	"decomp.org/x/graphs/iso"
-	"decomp.org/x/graphs/merge"
-	"decomp.org/x/graphs/primitive"
 	"github.com/mewfork/dot"
 	"github.com/mewkiz/pkg/errutil"
-	"github.com/mewkiz/pkg/goutil"
 )
 
 var (
+	// flagAddrAttr specifies the node attribute holding the address of each
+	// basic block (e.g. "addr"), with which each primitive is annotated by the
+	// address of its entry block.
+	flagAddrAttr string
+	// flagAllowPrims is a comma-separated list of the control flow primitives
+	// permitted by the primitive-coverage policy; all primitives are permitted
+	// if empty.
+	flagAllowPrims string
+	// When flagAlsoStdout is true, write the output to standard output in
+	// addition to the path specified by "-o".
+	flagAlsoStdout bool
+	// flagArchive specifies the path of a zip or tar archive of control flow
+	// graphs (*.dot) to restructure.
+	flagArchive string
+	// When flagAssertComplete is true, verify that the located control flow
+	// primitives account for every node and edge of the CFG.
+	flagAssertComplete bool
+	// When flagAssertSingleRoot is true, verify that the control flow
+	// primitives of a fully reduced CFG form a single primitive tree.
+	flagAssertSingleRoot bool
+	// flagBaseline specifies the path of baseline control flow primitives
+	// (JSON) to compare the located primitives against.
+	flagBaseline string
+	// flagCacheDir specifies the directory of the primitive cache, which stores
+	// the located primitives keyed by a hash of the input and primitive set.
+	flagCacheDir string
+	// flagCarryAttrs is a comma-separated list of node attributes to include in
+	// the output (e.g. "line,file").
+	flagCarryAttrs string
+	// When flagCollapseResidual is true, collapse the residual graph of a
+	// stalled reduction into a single opaque primitive, rather than failing.
+	flagCollapseResidual bool
+	// When flagComponents is true, restructure each weakly connected component
+	// of the CFG separately, and output the results per component.
+	flagComponents bool
+	// flagDiagnostics specifies the output path of diagnostics (JSON).
+	flagDiagnostics string
+	// flagDot specifies the source of the CFG (e.g. "digraph{A->B}"), as an
+	// alternative to an input file or standard input.
+	flagDot string
+	// flagDumpGraph specifies the output path of the reduced control flow graph
+	// (DOT).
+	flagDumpGraph string
+	// When flagDumpGraphNested is true, dump the original control flow graph
+	// with each merged region wrapped in a cluster, instead of the reduced
+	// graph.
+	flagDumpGraphNested bool
+	// flagEquivAttr specifies the node attribute by which nodes with identical
+	// successors are considered equivalent, and collapsed prior to the
+	// reduction; see NodeEquivalence.
+	flagEquivAttr string
+	// flagExceptionEdges specifies the output path of exception handler
+	// associations (JSON); when set, exceptional edges are ignored when
+	// locating primitives.
+	flagExceptionEdges string
+	// flagExcludeNodes is a comma-separated list of nodes to remove from the
+	// CFG before restructuring.
+	flagExcludeNodes string
+	// When flagExplain is true, print the rationale of each reduction step.
+	flagExplain bool
+	// When flagFingerprint is true, output a structural fingerprint of the
+	// recovered control flow primitives instead of JSON.
+	flagFingerprint bool
+	// flagFormat specifies the output format; either "json", "gob",
+	// "protobuf", "prim-tree-dot", "rewrites", "sexpr" or "folded".
+	flagFormat string
+	// flagFuzzOrder specifies the number of pseudo-random orderings of the
+	// primitive set to restructure the CFG with, reporting the orderings which
+	// reduce differently; 0 to disable.
+	flagFuzzOrder int
 	// When flagIndent is true, indent JSON output.
 	flagIndent bool
+	// flagInput specifies the input format; either "dot" or "json".
+	flagInput string
+	// When flagLintPrims is true, analyze the primitive set and output a report
+	// of its problems (e.g. shadowed primitives), without processing any CFG.
+	flagLintPrims bool
+	// When flagLoopNests is true, group each loop primitive with the loop
+	// primitives nested within it into a composite loop nest primitive.
+	flagLoopNests bool
+	// When flagLoopsOnly is true, only structure the loops of the CFG, leaving
+	// conditionals unstructured, and tolerate the partial reduction.
+	flagLoopsOnly bool
+	// When flagMarkReturn is true, mark the single terminal node of the CFG as
+	// a return primitive.
+	flagMarkReturn bool
+	// flagMaxDepth specifies the maximum nesting depth of primitive trees in
+	// tree output, or 0 for no limit.
+	flagMaxDepth int
+	// flagMeta holds the metadata key=value pairs to include in the output.
+	flagMeta = make(metaFlag)
+	// When flagMismatches is true, record the reasons for which the primitives
+	// of higher priority failed to match at each reduction step, in the output.
+	flagMismatches bool
+	// flagNameOffset specifies the starting offset of the per-primitive
+	// counters of unique super-node names.
+	flagNameOffset int
+	// flagNamePrefix specifies the prefix of unique super-node names (e.g.
+	// "f1_"); when set, or when flagNameOffset is non-zero, super-node names
+	// are never reused within a graph.
+	flagNamePrefix string
+	// When flagNDJSON is true, stream the located control flow primitives to
+	// the output as newline-delimited JSON, as they are located.
+	flagNDJSON bool
+	// flagNewerThan specifies a file whose modification time is the point in
+	// time before which input files are skipped as unchanged.
+	flagNewerThan string
+	// When flagNodeOrder is true, include the positions of the nodes in the
+	// node order of the input DOT file in the output, and order the listed
+	// edges of each primitive by them.
+	flagNodeOrder bool
+	// flagOrder is a comma-separated list of primitive names, which are
+	// located before the remaining primitives in the specified order (e.g. as
+	// recommended by "-tune").
+	flagOrder string
 	// flagOutput specifies the output path.
 	flagOutput string
+	// When flagPreferLargest is true, merge the match covering the largest
+	// number of nodes at each reduction step, rather than the match of the
+	// first matching primitive.
+	flagPreferLargest bool
+	// When flagPostdomFollow is true, require the follow node of each located
+	// conditional to be the immediate post-dominator of its condition.
+	flagPostdomFollow bool
 	// flagPrimitives is a comma-separated list of control flow primitives
 	// (*.dot).
 	flagPrimitives string
+	// flagPrimsDir specifies the directory of the default control flow
+	// primitives, overriding the ones embedded in the binary.
+	flagPrimsDir string
+	// flagPriorities is a comma-separated list of primitive priorities (e.g.
+	// "if=10,pre_loop=20"); primitives are located in order of descending
+	// priority.
+	flagPriorities string
+	// When flagProgress is true, print the progress of the reduction to
+	// standard error.
+	flagProgress bool
+	// When flagQuiet is true, suppress non-essential output; only the output
+	// and fatal error messages (without timestamps) are printed.
+	flagQuiet bool
+	// flagRender specifies the path of an image to render the primitive tree
+	// to, using Graphviz dot.
+	flagRender string
+	// When flagRequireReduced is true, the primitive-coverage policy requires
+	// the CFG to be fully reduced into a single node.
+	flagRequireReduced bool
+	// When flagReverse is true, reverse the direction of each edge of the CFG
+	// before restructuring, swapping the roles of its entry and exit nodes.
+	flagReverse bool
+	// When flagReverseMap is true, include a reverse mapping from each node of
+	// the CFG to the primitive which directly contains it in JSON output.
+	flagReverseMap bool
+	// When flagScore is true, restructure the given control flow graphs and
+	// output an aggregate recovery-quality report of the primitive set.
+	flagScore bool
+	// flagSince specifies the point in time (RFC 3339) before which input
+	// files are skipped as unchanged.
+	flagSince string
+	// When flagSimplify is true, fold redundant nestings of the located
+	// control flow primitives (e.g. a list nested within a list).
+	flagSimplify bool
+	// When flagSortOutput is true, sort the output primitives by super-node
+	// name rather than in the order located.
+	flagSortOutput bool
+	// flagStats specifies the output path of recovery metrics (JSON).
+	flagStats string
+	// flagStrategy specifies the structuring strategy; either "greedy" or
+	// "exhaustive".
+	flagStrategy string
+	// When flagStream is true, stream the located control flow primitives to
+	// the output as the elements of a JSON array, as they are located.
+	flagStream bool
+	// When flagStrict is true, print a failure report of the residual graph and
+	// the primitives tried when the reduction stalls.
+	flagStrict bool
+	// flagTee specifies a TCP address to which control flow primitives are
+	// streamed as newline-delimited JSON as they are located.
+	flagTee string
+	// flagTransform is a comma-separated list of the built-in graph transforms
+	// to apply before restructuring (e.g. "split-shared-headers").
+	flagTransform string
+	// When flagTune is true, restructure the given control flow graphs and
+	// output the primitive names ordered by decreasing match frequency, for use
+	// with "-order".
+	flagTune bool
+	// When flagUsage is true, restructure the given control flow graphs and
+	// output the number of times each primitive was located, along with the
+	// primitives which were never located.
+	flagUsage bool
 	// When flagVerbose is true, enable verbose output.
 	flagVerbose bool
+	// When flagVerify is true, validate that the references among the located
+	// control flow primitives are acyclic.
+	flagVerify bool
+	// When flagVetFormat is true, print diagnostics in the vet-style format
+	// "file:line:col: message" parsed by editors.
+	flagVetFormat bool
+	// flagVirtualRoot specifies the name of a synthetic virtual root node of the
+	// CFG, which is removed before restructuring; its successors are the real
+	// entry nodes of the CFG.
+	flagVirtualRoot string
+	// When flagWithConfidence is true, include the confidence level of each
+	// primitive in the output; i.e. whether it was located by an exact match
+	// or heuristically.
+	flagWithConfidence bool
+	// When flagWithEdges is true, include the edges of the CFG consumed by each
+	// primitive in the output.
+	flagWithEdges bool
+	// When flagWithPorts is true, include the ports of each primitive in the
+	// output; i.e. the predecessors and successors of its merged region.
+	flagWithPorts bool
+	// flagWeightAttr specifies a numeric node attribute (e.g. "weight"), the
+	// values of which are summed over the nodes covered by each primitive.
+	flagWeightAttr string
+	// When flagWithShape is true, include the shape of the matched subgraph of
+	// each primitive in the output.
+	flagWithShape bool
 )
 
 func init() {
+	flag.StringVar(&flagAddrAttr, "addr-attr", "", "Node attribute holding the address of each block, to annotate primitives by entry address.")
+	flag.StringVar(&flagAllowPrims, "allow-prims", "", "Comma-separated list of permitted primitives (policy check).")
+	flag.BoolVar(&flagAlsoStdout, "also-stdout", false, "Also write the output to stdout (see -o).")
+	flag.StringVar(&flagArchive, "archive", "", "Zip or tar archive of CFGs (*.dot, or *.json with -input json) to restructure.")
+	flag.BoolVar(&flagAssertComplete, "assert-complete", false, "Verify that the primitives cover every node and edge of the CFG.")
+	flag.BoolVar(&flagAssertSingleRoot, "assert-single-root", false, "Verify that the primitives of a fully reduced CFG form a single tree.")
+	flag.StringVar(&flagBaseline, "baseline", "", "Baseline primitives (JSON) to compare against; exit non-zero on difference.")
+	flag.StringVar(&flagCacheDir, "cache-dir", "", "Directory of cached primitives, keyed by input and primitive set.")
+	flag.StringVar(&flagCarryAttrs, "carry-attrs", "", "Comma-separated list of node attributes to include in the output.")
+	flag.BoolVar(&flagCollapseResidual, "collapse-residual", false, "Collapse the residual CFG of a stalled reduction into an opaque primitive.")
+	flag.BoolVar(&flagComponents, "components", false, "Restructure each weakly connected component of the CFG separately.")
+	flag.StringVar(&flagDiagnostics, "diagnostics", "", "Output path of diagnostics (JSON).")
+	flag.StringVar(&flagDot, "dot", "", `Source of the CFG (e.g. "digraph{A->B}"), instead of CFG.dot or stdin.`)
+	flag.StringVar(&flagDumpGraph, "dump-graph", "", "Output path of the reduced CFG (DOT).")
+	flag.BoolVar(&flagDumpGraphNested, "dump-graph-nested", false, "Dump the CFG with each merged region as a cluster (see -dump-graph).")
+	flag.StringVar(&flagEquivAttr, "equiv-attr", "", "Collapse nodes sharing the value of the given attribute before matching (opt-in).")
+	flag.StringVar(&flagExceptionEdges, "exception-edges", "", "Output path of exception handler associations (JSON); ignore exceptional edges.")
+	flag.StringVar(&flagExcludeNodes, "exclude-nodes", "", "Comma-separated list of nodes to remove before restructuring.")
+	flag.BoolVar(&flagExplain, "explain", false, "Print the rationale of each reduction step.")
+	flag.BoolVar(&flagFingerprint, "fingerprint", false, "Output a structural fingerprint instead of JSON.")
+	flag.StringVar(&flagFormat, "format", "json", `Output format ("json", "gob", "protobuf", "prim-tree-dot", "rewrites", "sexpr" or "folded").`)
+	flag.IntVar(&flagFuzzOrder, "fuzz-order", 0, "Output a report (JSON) of which of `N` random primitive orderings reduce the CFG differently.")
 	flag.BoolVar(&flagIndent, "indent", false, "Indent JSON output.")
+	flag.StringVar(&flagInput, "input", "dot", `Input format ("dot" or "json").`)
+	flag.BoolVar(&flagLintPrims, "lint-prims", false, "Output a report (JSON) of the problems of the primitive set, without input.")
+	flag.BoolVar(&flagLoopNests, "loop-nests", false, "Group nested loop primitives into composite loop_nest primitives.")
+	flag.BoolVar(&flagLoopsOnly, "loops-only", false, "Only structure loops, leaving conditionals unstructured; tolerate partial reduction.")
+	flag.BoolVar(&flagMarkReturn, "mark-return", false, "Mark the single terminal node of the CFG as a return primitive.")
+	flag.IntVar(&flagMaxDepth, "max-depth", 1000, "Maximum nesting depth of primitive trees in tree output; 0 for no limit.")
+	flag.Var(flagMeta, "meta", "Metadata key=value pair to include in the output (repeatable).")
+	flag.BoolVar(&flagMismatches, "mismatches", false, "Include the reasons for which primitives failed to match at each step in the output.")
+	flag.IntVar(&flagNameOffset, "name-offset", 0, "Starting offset of unique super-node name counters.")
+	flag.StringVar(&flagNamePrefix, "name-prefix", "", "Prefix of unique super-node names.")
+	flag.BoolVar(&flagNDJSON, "ndjson", false, "Stream primitives as newline-delimited JSON to the output as they are located.")
+	flag.StringVar(&flagNewerThan, "newer-than", "", "Skip input files not modified since the modification time of the given file.")
+	flag.BoolVar(&flagNodeOrder, "node-order", false, "Include node positions of the input order in the output, and order edge lists by them.")
 	flag.StringVar(&flagOutput, "o", "", "Output path.")
+	flag.StringVar(&flagOrder, "order", "", "Comma-separated list of primitives to locate first, in order.")
+	flag.BoolVar(&flagPreferLargest, "prefer-largest", false, "Merge the primitive covering the most nodes at each step, rather than the first matching one.")
+	flag.BoolVar(&flagPostdomFollow, "postdom-follow", false, "Locate conditionals at the immediate post-dominator of their condition.")
 	flag.StringVar(&flagPrimitives, "prims", "", "Comma-separated list of control flow primitives (*.dot).")
+	flag.StringVar(&flagPrimsDir, "prims-dir", "", "Directory of the default control flow primitives (*.dot), overriding the embedded ones.")
+	flag.StringVar(&flagPriorities, "priorities", "", `Comma-separated list of primitive priorities (e.g. "if=10,pre_loop=20").`)
+	flag.BoolVar(&flagProgress, "progress", false, "Print reduction progress to standard error.")
+	flag.BoolVar(&flagQuiet, "quiet", false, "Suppress non-essential output (overrides -v).")
+	flag.StringVar(&flagRender, "render", "", "Render the primitive tree to the given image (e.g. out.png) using Graphviz dot.")
+	flag.BoolVar(&flagRequireReduced, "require-reduced", false, "Require the CFG to be fully reduced (policy check).")
+	flag.BoolVar(&flagReverse, "reverse", false, "Reverse the direction of each edge of the CFG; its exit node becomes the entry node.")
+	flag.BoolVar(&flagReverseMap, "reverse-map", false, "Include a map from each CFG node to its innermost owning primitive in JSON output.")
+	flag.BoolVar(&flagScore, "score", false, "Output an aggregate recovery-quality report (JSON) of the given CFGs.")
+	flag.StringVar(&flagSince, "since", "", "Skip input files not modified since the given time (RFC 3339).")
+	flag.BoolVar(&flagSimplify, "simplify", false, "Fold redundant nestings of primitives (e.g. a list within a list).")
+	flag.BoolVar(&flagSortOutput, "sort-output", false, "Sort output primitives by node name (json, gob and protobuf formats).")
+	flag.StringVar(&flagStats, "stats", "", "Output path of recovery metrics (JSON).")
+	flag.StringVar(&flagStrategy, "strategy", strategyGreedy, `Structuring strategy ("greedy" or "exhaustive").`)
+	flag.BoolVar(&flagStream, "stream", false, "Stream primitives as a JSON array to the output as they are located.")
+	flag.BoolVar(&flagStrict, "strict", false, "Print a failure report of the residual CFG when the reduction stalls.")
+	flag.StringVar(&flagTee, "tee", "", "Stream primitives as newline-delimited JSON to TCP address.")
+	flag.StringVar(&flagTransform, "transform", "", "Comma-separated list of graph transforms to apply before restructuring.")
+	flag.BoolVar(&flagTune, "tune", false, "Output primitive order of decreasing match frequency over CFG.dot files.")
+	flag.BoolVar(&flagUsage, "usage", false, "Output the match counts of the primitives over CFG.dot files, and the unused primitives.")
 	flag.BoolVar(&flagVerbose, "v", false, "Verbose output.")
+	flag.BoolVar(&flagVerify, "verify", false, "Validate that references among primitives are acyclic.")
+	flag.BoolVar(&flagVetFormat, "vet-format", false, `Print diagnostics as "file:line:col: message", using the line and col node attributes.`)
+	flag.StringVar(&flagVirtualRoot, "virtual-root", "", "Virtual root node to remove; its successors are the real entry nodes.")
+	flag.StringVar(&flagWeightAttr, "weight-attr", "", "Numeric node attribute to sum over the nodes of each primitive.")
+	flag.BoolVar(&flagWithConfidence, "with-confidence", false, `Include the confidence of each primitive ("exact" or "heuristic") in the output.`)
+	flag.BoolVar(&flagWithEdges, "with-edges", false, "Include the edges of the CFG consumed by each primitive in the output.")
+	flag.BoolVar(&flagWithPorts, "with-ports", false, "Include the predecessors and successors of the merged region of each primitive in the output.")
+	flag.BoolVar(&flagWithShape, "with-shape", false, "Include the shape of the matched subgraph of each primitive in the output.")
 	flag.Usage = usage
 }
 
 const use = `
 restructure [OPTION]... [CFG.dot]
+restructure -tune [OPTION]... CFG.dot...
+restructure -score [OPTION]... CFG.dot...
+restructure -lint-prims [OPTION]...
+restructure -archive ARCHIVE [OPTION]...
 Recover control flow primitives from control flow graphs (e.g. *.dot -> *.json).
 `
 
@@ -105,11 +515,36 @@ func usage() {
 func main() {
 	flag.Parse()
 	var dotPath string
-	switch flag.NArg() {
-	case 0:
+	switch n := flag.NArg(); {
+	case len(flagArchive) > 0:
+		// Read from the archive specified by -archive.
+		if n != 0 {
+			flag.Usage()
+			os.Exit(1)
+		}
+	case flagLintPrims:
+		// Lint the primitive set, without input.
+		if n != 0 {
+			flag.Usage()
+			os.Exit(1)
+		}
+	case flagTune, flagScore, flagUsage:
+		// Tune the primitive order, or score the primitive set or report its
+		// usage, using FILE...
+		if n == 0 {
+			flag.Usage()
+			os.Exit(1)
+		}
+	case len(flagDot) > 0:
+		// Read from the source specified by -dot.
+		if n != 0 {
+			log.Fatalln(errutil.New("-dot and CFG.dot are mutually exclusive"))
+		}
+		dotPath = dotFlagPath
+	case n == 0:
 		// Read from stdin.
 		dotPath = "-"
-	case 1:
+	case n == 1:
 		// Read from FILE.
 		dotPath = flag.Arg(0)
 	default:
@@ -117,38 +552,388 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Create a structured CFG from the unstructured CFG.
-	prims, err := restructure(dotPath)
-	if err != nil {
+	// Apply the graph transforms specified by -transform.
+	if len(flagTransform) > 0 {
+		ts, err := parseTransforms(flagTransform)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		transforms = append(transforms, ts...)
+	}
+
+	// Skip input files not modified since the time specified by -since or
+	// -newer-than.
+	if err := setSince(); err != nil {
 		log.Fatalln(err)
 	}
+	if len(dotPath) > 0 && !changedFile(dotPath) {
+		return
+	}
+
+	// Output the primitive-set report requested by -lint-prims, and fail if
+	// any problem was found.
+	if flagLintPrims {
+		report, err := lintPrims()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		w, err := createOutput()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := writeLint(w, report); err != nil {
+			log.Fatalln(err)
+		}
+		if err := w.Close(); err != nil {
+			log.Fatalln(err)
+		}
+		if len(report.Findings) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
 
-	// Print the JSON to stdout or the path specified by -o.
-	w := os.Stdout
-	if len(flagOutput) > 0 {
-		f, err := os.Create(flagOutput)
+	// Output the primitive order recommended by -tune.
+	if flagTune {
+		order := tune(changedPaths(flag.Args()))
+		w, err := createOutput()
 		if err != nil {
 			log.Fatalln(err)
 		}
-		defer f.Close()
-		w = f
+		defer w.Close()
+		if _, err := fmt.Fprintln(w, strings.Join(order, ",")); err != nil {
+			log.Fatalln(err)
+		}
+		return
 	}
-	if flagIndent {
-		buf, err := json.MarshalIndent(prims, "", "\t")
+
+	// Output the recovery-quality report requested by -score.
+	if flagScore {
+		q := score(changedPaths(flag.Args()))
+		w, err := createOutput()
 		if err != nil {
 			log.Fatalln(err)
 		}
-		_, err = io.Copy(w, bytes.NewReader(buf))
+		defer w.Close()
+		if err := writeScore(w, q); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	// Output the primitive usage report requested by -usage.
+	if flagUsage {
+		u := primitiveUsage(changedPaths(flag.Args()))
+		w, err := createOutput()
 		if err != nil {
 			log.Fatalln(err)
 		}
+		defer w.Close()
+		if err := writeUsage(w, u); err != nil {
+			log.Fatalln(err)
+		}
 		return
 	}
-	enc := json.NewEncoder(w)
-	err = enc.Encode(prims)
+
+	// Output the order-sensitivity report requested by -fuzz-order, and fail
+	// if any ordering reduces differently.
+	if flagFuzzOrder > 0 {
+		report, err := fuzzOrder(dotPath, flagFuzzOrder)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		w, err := createOutput()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := writeFuzz(w, report); err != nil {
+			log.Fatalln(err)
+		}
+		if err := w.Close(); err != nil {
+			log.Fatalln(err)
+		}
+		if len(report.Differences) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Print the reduction progress requested by -progress.
+	if flagProgress {
+		progress = newProgressLine(os.Stderr)
+		Progress = progress.update
+	}
+
+	// Stream primitives to the TCP address specified by -tee.
+	if len(flagTee) > 0 {
+		conn, err := net.Dial("tcp", flagTee)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer conn.Close()
+		emitters = append(emitters, newJSONEmitter(conn))
+	}
+
+	// Restructure each control flow graph of the archive specified by
+	// -archive.
+	if len(flagArchive) > 0 {
+		if err := checkArchive(); err != nil {
+			log.Fatalln(err)
+		}
+		results, err := restructureArchive(flagArchive)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		w, err := createOutput()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer w.Close()
+		if err := writeResults(w, results); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	// Restructure each weakly connected component of the CFG separately, as
+	// requested by -components.
+	if flagComponents {
+		results, err := restructureComponents(dotPath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		w, err := createOutput()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer w.Close()
+		if err := writeResults(w, results); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	// Stream primitives to the output as they are located, as requested by
+	// -stream and -ndjson.
+	var stream io.WriteCloser
+	var array *arrayEmitter
+	if flagStream || flagNDJSON {
+		if err := checkStream(); err != nil {
+			log.Fatalln(err)
+		}
+		var err error
+		stream, err = createOutput()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer stream.Close()
+		if flagStream {
+			array = newArrayEmitter(stream)
+			primary = array
+		} else {
+			primary = newJSONEmitter(stream)
+		}
+	}
+
+	// Create a structured CFG from the unstructured CFG, using the primitive
+	// cache specified by -cache-dir.
+	var prims []*Primitive
+	var err error
+	if len(flagCacheDir) > 0 && cacheable() {
+		prims, err = restructureCached(dotPath, flagCacheDir)
+	} else {
+		prims, err = restructure(dotPath)
+	}
+	if array != nil {
+		// Close the JSON array, also when the reduction fails, so that the
+		// output remains valid JSON.
+		if err := array.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if len(flagDiagnostics) > 0 {
+		if err := writeDiagnostics(flagDiagnostics); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if len(flagExceptionEdges) > 0 {
+		if err := writeHandlers(flagExceptionEdges); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if len(flagDumpGraph) > 0 {
+		if err := writeGraphDump(flagDumpGraph); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if len(flagStats) > 0 {
+		if err := writeStats(flagStats); err != nil {
+			log.Fatalln(err)
+		}
+	}
 	if err != nil {
 		log.Fatalln(err)
 	}
+	if flagSimplify {
+		prims = simplify(prims)
+	}
+	if flagVerify {
+		if err := verifyPrims(prims); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	// Render the primitive tree before the loop nests are added, as they are
+	// not part of it.
+	if len(flagRender) > 0 {
+		if err := writeRender(flagRender, prims); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if flagLoopNests {
+		prims = loopNests(prims)
+	}
+
+	// Print the output to stdout or the path specified by -o, unless already
+	// streamed.
+	if stream == nil {
+		w, err := createOutput()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer w.Close()
+		if err := writeOutput(w, prims); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	// Compare the primitives against the baseline specified by -baseline.
+	if len(flagBaseline) > 0 {
+		base, err := loadPrims(flagBaseline)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		diffs := diffPrims(base, prims)
+		for _, d := range diffs {
+			fmt.Fprintln(os.Stderr, d)
+		}
+		if len(diffs) > 0 {
+			os.Exit(1)
+		}
+	}
+}
+
+// createOutput returns the output file; standard output, or the file specified
+// by the "-o" flag. If the "-also-stdout" flag is set, output written to the
+// file is also written to standard output.
+func createOutput() (io.WriteCloser, error) {
+	if len(flagOutput) == 0 {
+		return stdoutFile{Writer: os.Stdout}, nil
+	}
+	f, err := os.Create(flagOutput)
+	if err != nil {
+		return nil, err
+	}
+	if flagAlsoStdout {
+		return &teeFile{Writer: io.MultiWriter(f, os.Stdout), f: f}, nil
+	}
+	return f, nil
+}
+
+// A stdoutFile writes to standard output. Closing a stdoutFile leaves standard
+// output open.
+type stdoutFile struct {
+	io.Writer
+}
+
+// Close is a no-op, as standard output is closed on exit.
+func (stdoutFile) Close() error {
+	return nil
+}
+
+// A teeFile writes to both an output file and standard output. Closing a
+// teeFile closes the output file.
+type teeFile struct {
+	io.Writer
+	f *os.File
+}
+
+// Close closes the output file.
+func (t *teeFile) Close() error {
+	return t.f.Close()
+}
+
+// writeOutput writes the given control flow primitives to w, in the output
+// format specified by the command line flags.
+func writeOutput(w io.Writer, prims []*Primitive) error {
+	if flagFingerprint {
+		_, err := fmt.Fprintln(w, fingerprint(prims))
+		return err
+	}
+	if flagSortOutput {
+		switch flagFormat {
+		case "json", "gob", "protobuf":
+			prims = sortPrims(prims)
+		}
+	}
+	var v interface{} = prims
+	if flagLoopNests {
+		switch flagFormat {
+		case "prim-tree-dot", "sexpr", "folded":
+			// Loop nests reference the loops of the primitive tree without
+			// being part of it.
+			return errutil.Newf("loop nests not supported by output format %q", flagFormat)
+		}
+	}
+	if len(flagMeta) > 0 {
+		switch flagFormat {
+		case "gob", "prim-tree-dot", "sexpr", "folded":
+			return errutil.Newf("metadata not supported by output format %q", flagFormat)
+		}
+	}
+	if flagReverseMap && flagFormat != "json" {
+		return errutil.Newf("reverse map not supported by output format %q", flagFormat)
+	}
+	switch flagFormat {
+	case "json":
+		if len(flagMeta) > 0 || flagReverseMap {
+			doc := &Document{Meta: flagMeta, Prims: prims}
+			if flagReverseMap {
+				doc.ReverseMap = reverseMap(prims)
+			}
+			v = doc
+		}
+	case "gob":
+		return gob.NewEncoder(w).Encode(prims)
+	case "protobuf":
+		return writeProtobuf(w, prims, flagMeta)
+	case "prim-tree-dot":
+		return writePrimTreeDOT(w, prims)
+	case "rewrites":
+		rules := rewrites(prims)
+		v = rules
+		if len(flagMeta) > 0 {
+			v = &struct {
+				Meta     map[string]string `json:"meta"`
+				Rewrites []*rewrite        `json:"rewrites"`
+			}{Meta: flagMeta, Rewrites: rules}
+		}
+	case "sexpr":
+		return writeSexpr(w, prims)
+	case "folded":
+		return writeFolded(w, prims)
+	default:
+		return errutil.Newf("invalid output format %q", flagFormat)
+	}
+	if flagIndent {
+		buf, err := json.MarshalIndent(v, "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, bytes.NewReader(buf))
+		return err
+	}
+	enc := json.NewEncoder(w)
+	return enc.Encode(v)
 }
 
 // restructure attempts to recover the control flow primitives of a given
@@ -157,73 +942,542 @@ func main() {
 // nodes until the entire graph is reduced into a single node or no structured
 // subgraphs may be located. The list of primitives is ordered in the same
 // sequence as they were located.
-func restructure(dotPath string) (prims []*primitive.Primitive, err error) {
+func restructure(dotPath string) ([]*Primitive, error) {
 	// Parse the unstructured CFG.
-	var graph *dot.Graph
-	switch dotPath {
-	case "-":
-		// Read from stdin.
-		buf, err := ioutil.ReadAll(os.Stdin)
+	graph, err := parseGraph(dotPath)
+	if err != nil {
+		resetDiagnostics()
+		handlers = nil
+		dumped = nil
+		stats = nil
+		return nil, errutil.Err(err)
+	}
+	return Restructure(graph)
+}
+
+// Restructure attempts to recover the control flow primitives of the given
+// parsed control flow graph, as described by restructure. The graph is reduced
+// in place.
+func Restructure(graph *dot.Graph) ([]*Primitive, error) {
+	return restructureGraph(graph, primary, emitters)
+}
+
+// RestructureDryRun returns the sequence of control flow primitives which
+// Restructure would locate in the given parsed control flow graph, in the order
+// merged, without modifying the graph; the reduction operates on a deep copy of
+// graph, so the original graph remains available for a subsequent pass (e.g. to
+// render the primitives on the untouched graph). As the merges are not applied
+// to graph, the located primitives are emitted neither to the primary output
+// nor to the sinks of emitters.
+//
+// The copy is made by formatting graph in DOT and parsing it again (see
+// cloneGraph), which takes time and memory linear in the number of nodes and
+// edges of graph; about the cost of parsing the input once more, and small
+// compared to the reduction itself. The copy preserves the order of the nodes
+// of graph, so node positions (see the "-node-order" flag) are those of graph.
+//
+// Apart from the graph, a dry run has the same side effects as Restructure; it
+// resets the diagnostics, exception handlers, graph dump and statistics of the
+// previous reduction, and invokes PrimHook and MergeValidator, if set, for each
+// located primitive.
+func RestructureDryRun(graph *dot.Graph) ([]*Primitive, error) {
+	c, err := cloneGraph(graph)
+	if err != nil {
+		resetDiagnostics()
+		return nil, errutil.Err(err)
+	}
+	return restructureGraph(c, nil, nil)
+}
+
+// restructureGraph attempts to recover the control flow primitives of the given
+// parsed control flow graph, as described by Restructure, and emits them to the
+// primary output stream (see primary), unless nil, and to the given sinks as
+// they are located. The graph is reduced in place.
+func restructureGraph(graph *dot.Graph, stream Emitter, sinks []Emitter) ([]*Primitive, error) {
+	graph, err := prepareGraph(graph)
+	if err != nil {
+		return nil, err
+	}
+
+	// Locate control flow primitives, emitting them to the primary output and
+	// the attached sinks as they are located.
+	fan := newFanout(sinks...)
+	defer func() {
+		if err := fan.Close(); err != nil {
+			warnf("emit-failure", nil, "unable to emit primitives; %v", err)
+		}
+	}()
+	var out Emitter = fan
+	if stream != nil {
+		out = &primaryEmitter{primary: stream, sinks: fan}
+	}
+	var cov *coverage
+	if flagAssertComplete {
+		cov = newCoverage(graph)
+	}
+	nodes := len(graph.Nodes.Nodes)
+	prims, err := reduce(graph, reductionSet(), out)
+	if err := concludeGraph(graph, nodes, prims, cov, err); err != nil {
+		return nil, err
+	}
+	return prims, nil
+}
+
+// prepareGraph prepares the given parsed control flow graph for its reduction,
+// as requested by the command line flags (e.g. "-exclude-nodes" and
+// "-transform"), after resetting the diagnostics, exception handlers, graph
+// dump and statistics of the previous reduction. The returned graph is the
+// graph to reduce, which is a copy of graph if nodes or edges are removed.
+func prepareGraph(graph *dot.Graph) (*dot.Graph, error) {
+	resetDiagnostics()
+	setSourcePositions(graph)
+	handlers = nil
+	dumped = nil
+	stats = nil
+
+	var err error
+	if len(flagExcludeNodes) > 0 {
+		graph, err = excludeNodes(graph, strings.Split(flagExcludeNodes, ","))
 		if err != nil {
 			return nil, errutil.Err(err)
 		}
-		graph, err = dot.Read(buf)
+	}
+	if len(flagExceptionEdges) > 0 {
+		graph, handlers, err = removeExceptionEdges(graph)
 		if err != nil {
 			return nil, errutil.Err(err)
 		}
-	default:
-		// Read for FILE.
-		graph, err = dot.ParseFile(dotPath)
+	}
+	for _, transform := range transforms {
+		if err := transform(graph); err != nil {
+			return nil, errutil.Err(err)
+		}
+	}
+	if len(graph.Nodes.Nodes) == 0 {
+		return nil, errutil.Newf("unable to restructure empty graph %q", graph.Name)
+	}
+	if len(flagExceptionEdges) == 0 {
+		// Exceptional edges aside, a disconnected graph may never be reduced.
+		if err := checkConnected(graph); err != nil {
+			return nil, err
+		}
+	}
+	if len(flagDumpGraph) > 0 {
+		orig, err := cloneGraph(graph)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+		dumped = &graphDump{orig: orig, reduced: graph}
+	}
+	return graph, nil
+}
+
+// reductionSet returns the ordered list of subgraphs used by the reduction of
+// restructure; the loops of subs in loops-only mode, and subs otherwise.
+func reductionSet() []*graphs.SubGraph {
+	if flagLoopsOnly {
+		return loopSubs(subs)
+	}
+	return subs
+}
+
+// concludeGraph concludes the reduction of the given control flow graph, which
+// had the given number of nodes prior to its reduction, into the given located
+// primitives. The statistics and graph dump of the reduction are recorded,
+// also when the reduction failed with reduceErr, which is returned. Otherwise,
+// the primitives are validated against the coverage cov, unless nil, and the
+// "-assert-single-root" flag, and the exception handlers are resolved.
+func concludeGraph(graph *dot.Graph, nodes int, prims []*Primitive, cov *coverage, reduceErr error) error {
+	stats = newRecoveryStats(nodes, len(graph.Nodes.Nodes), prims)
+	if dumped != nil {
+		dumped.prims = prims
+	}
+	if reduceErr != nil {
+		return reduceErr
+	}
+	if cov != nil {
+		if err := cov.check(prims); err != nil {
+			return err
+		}
+	}
+	if flagAssertSingleRoot && len(graph.Nodes.Nodes) == 1 {
+		if err := checkSingleRoot(prims); err != nil {
+			return err
+		}
+	}
+	resolveHandlers(handlers, prims)
+	if flagVerbose && len(graph.Nodes.Nodes) == 1 {
+		printSummary(os.Stderr, graph, prims)
+	}
+	return nil
+}
+
+// printSummary prints a closing summary of the full reduction of graph into a
+// single node to w; the name of the final super-node, the number of reduction
+// steps and the number of located primitives of each type, in sorted order.
+func printSummary(w io.Writer, graph *dot.Graph, prims []*Primitive) {
+	counts := make(map[string]int)
+	for _, prim := range prims {
+		counts[prim.Prim]++
+	}
+	var names []string
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var list []string
+	for _, name := range names {
+		list = append(list, fmt.Sprintf("%s=%d", name, counts[name]))
+	}
+	fmt.Fprintf(w, "Graph %q fully reduced to single node %q in %d step(s) using primitives [%s]\n", graph.Name, graph.Nodes.Nodes[0].Name, len(prims), strings.Join(list, ", "))
+}
+
+// An annotator annotates the located control flow primitives of a reduction,
+// as requested by the "-name-prefix", "-name-offset", "-carry-attrs",
+// "-addr-attr", "-weight-attr", "-with-edges" and "-node-order" flags, and
+// invokes PrimHook if set. Annotators which are not requested are nil.
+type annotator struct {
+	nm        *namer
+	carried   *carriedAttrs
+	addrs     *entryAddrs
+	weights   *nodeWeights
+	consumed  *consumedEdges
+	positions *nodePositions
+	// Copy of the control flow graph prior to its reduction, and the names
+	// assigned by PrimHook, if set.
+	orig    *dot.Graph
+	aliases aliases
+}
+
+// newAnnotator returns an annotator of the primitives located in the given
+// control flow graph, prior to its reduction.
+func newAnnotator(graph *dot.Graph) (*annotator, error) {
+	an := &annotator{}
+	if len(flagNamePrefix) > 0 || flagNameOffset != 0 {
+		an.nm = newNamer(graph, flagNamePrefix, flagNameOffset)
+	}
+	if len(flagCarryAttrs) > 0 {
+		an.carried = newCarriedAttrs(graph, strings.Split(flagCarryAttrs, ","))
+	}
+	if len(flagAddrAttr) > 0 {
+		an.addrs = newEntryAddrs(graph, flagAddrAttr)
+	}
+	if len(flagWeightAttr) > 0 {
+		var err error
+		if an.weights, err = newNodeWeights(graph, flagWeightAttr); err != nil {
+			return nil, err
+		}
+	}
+	if flagWithEdges {
+		an.consumed = newConsumedEdges(graph)
+	}
+	if flagNodeOrder {
+		an.positions = newNodePositions(graph)
+	}
+	if PrimHook != nil {
+		orig, err := cloneGraph(graph)
 		if err != nil {
 			return nil, errutil.Err(err)
 		}
+		an.orig, an.aliases = orig, make(aliases)
+	}
+	return an, nil
+}
+
+// annotate annotates the given located primitive.
+func (an *annotator) annotate(prim *Primitive) {
+	// First, as the other annotators refer to nodes by their unquoted names.
+	unquoteNames(prim)
+	if an.nm != nil {
+		an.nm.rename(prim)
+	}
+	if an.carried != nil {
+		an.carried.annotate(prim)
+	}
+	if an.addrs != nil {
+		an.addrs.annotate(prim)
+	}
+	if an.weights != nil {
+		an.weights.annotate(prim)
+	}
+	if flagWithConfidence {
+		prim.Confidence = prim.confidence()
+	}
+	if an.consumed != nil {
+		an.consumed.annotate(prim)
+	}
+	if an.positions != nil {
+		// Last, as it orders the edges listed by the other annotators.
+		an.positions.annotate(prim)
+	}
+	if an.orig != nil {
+		an.aliases.hook(prim, an.orig)
+	}
+}
+
+// reduce recovers the control flow primitives of the given control flow graph,
+// using the given ordered list of subgraphs, as described by restructure. The
+// graph is reduced in place. Located primitives are emitted to out, unless nil.
+// When the reduction stalls, the primitives located before it stalled are
+// returned along with the error.
+//
+// When exceptional edges are ignored, the graph may consist of several regions
+// (weakly connected components), and the reduction is complete when each
+// region has been reduced into a single node.
+func reduce(graph *dot.Graph, set []*graphs.SubGraph, out Emitter) ([]*Primitive, error) {
+	r, err := newReduction(graph, set, out)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		prim, err := r.next()
+		if err != nil {
+			return r.prims, err
+		}
+		if prim == nil {
+			return r.prims, nil
+		}
 	}
+}
+
+// RestructureBest attempts to recover the control flow primitives of the given
+// control flow graph using each of the candidate ordered lists of subgraphs in
+// turn, and returns the primitives of the first attempt which fully reduces the
+// graph. Each attempt operates on a copy of graph, which is left unmodified.
+// Located primitives are not emitted to the sinks of emitters, as the attempts
+// may be discarded.
+//
+// An error of kind KindUnreduced is returned if no candidate set fully reduces
+// the graph; any other error aborts the remaining attempts.
+func RestructureBest(graph *dot.Graph, candidateSets ...[]*graphs.SubGraph) ([]*Primitive, error) {
+	resetDiagnostics()
 	if len(graph.Nodes.Nodes) == 0 {
-		return nil, errutil.Newf("unable to restructure empty graph %q", dotPath)
+		return nil, errutil.Newf("unable to restructure empty graph %q", graph.Name)
 	}
+	for _, set := range candidateSets {
+		g, err := cloneGraph(graph)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+		prims, err := reduce(g, set, nil)
+		if err != nil {
+			if e, ok := err.(*Error); ok && e.Kind == KindUnreduced {
+				// Roll back and try the next candidate set.
+				continue
+			}
+			return nil, err
+		}
+		return prims, nil
+	}
+	return nil, &Error{Kind: KindUnreduced, Msg: fmt.Sprintf("unable to fully reduce graph %q using any of %d candidate primitive sets", graph.Name, len(candidateSets))}
+}
 
-	// Locate control flow primitives.
-	for len(graph.Nodes.Nodes) > 1 {
-		prim, err := findPrim(graph)
+// parseGraph parses the control flow graph of the given DOT file, or standard
+// input if dotPath is "-", and removes the virtual root specified by the
+// "-virtual-root" flag, if any. The graph is reversed if requested by the
+// "-reverse" flag.
+func parseGraph(dotPath string) (*dot.Graph, error) {
+	buf, err := readInput(dotPath)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	return parseGraphData(dotPath, buf)
+}
+
+// parseGraphData parses the control flow graph of the given contents of
+// dotPath, as described by parseGraph. Every input of a control flow graph
+// (e.g. cached inputs and archive entries) is parsed by parseGraphData, so the
+// "-input", "-virtual-root" and "-reverse" flags apply alike.
+func parseGraphData(dotPath string, buf []byte) (*dot.Graph, error) {
+	sourcePath = dotPath
+	graph, err := parseInput(dotPath, buf)
+	if err != nil {
+		return nil, err
+	}
+	if len(flagVirtualRoot) > 0 {
+		graph, err = removeVirtualRoot(graph, flagVirtualRoot)
 		if err != nil {
 			return nil, errutil.Err(err)
 		}
-		prims = append(prims, prim)
 	}
+	if flagReverse {
+		graph, err = reverseGraph(graph)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+	}
+	return graph, nil
+}
 
-	return prims, nil
+// dotFlagPath is the input path denoting the source of the "-dot" flag. As it
+// would be parsed as a flag, it may not name an input file on the command line.
+const dotFlagPath = "-dot"
+
+// parseInput parses the control flow graph of the given contents of dotPath, in
+// DOT format or in JSON format if specified by the "-input" flag.
+func parseInput(dotPath string, buf []byte) (*dot.Graph, error) {
+	switch flagInput {
+	case inputDOT:
+		graph, err := dot.Read(buf)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+		return graph, nil
+	case inputJSON:
+		graph, err := parseJSONGraph(buf)
+		if err != nil {
+			return nil, errutil.Newf("%s: %v", dotPath, err)
+		}
+		return graph, nil
+	default:
+		return nil, errutil.Newf("invalid input format %q", flagInput)
+	}
 }
 
 // findPrim locates a control flow primitive in the provided control flow graph
-// and merges its nodes into a single node.
-func findPrim(graph *dot.Graph) (*primitive.Primitive, error) {
-	for _, sub := range subs {
-		// Locate an isomorphism of sub in graph.
-		m, ok := iso.Search(graph, sub)
-		if !ok {
+// and merges its nodes into a single node. The primitives of set are tried in
+// order. Primitives with labeled edges only match edges with the same labels,
+// as tracked by labels, and value-producing nodes of primitives only match
+// nodes marked as such.
+//
+// When flagPreferLargest is true, every primitive of set is tried, and the
+// first match of the primitive covering the largest number of nodes is merged;
+// ties are broken by the order of set.
+func findPrim(graph *dot.Graph, set []*graphs.SubGraph, labels edgeLabels) (*Primitive, error) {
+	// rejected holds the primitives of higher priority than the located one,
+	// in explain mode and when mismatches are recorded.
+	var rejected []*graphs.SubGraph
+	explain := flagExplain || flagMismatches
+	var best *match
+	// The post-dominator tree is shared by the primitives of the step.
+	pt := newPostdomTree(graph)
+	for _, sub := range set {
+		mt := locate(graph, sub, labels, pt)
+		if mt == nil {
 			// No match, try next control flow primitive.
+			if explain {
+				rejected = append(rejected, sub)
+			}
 			continue
 		}
+		if best == nil || len(mt.m) > len(best.m) {
+			best = mt
+			best.rejected = append([]*graphs.SubGraph(nil), rejected...)
+		}
+		if !flagPreferLargest {
+			break
+		}
+	}
+	if best != nil {
+		sub, m := best.sub, best.m
+		var mms []*Mismatch
+		if explain {
+			mms = mismatches(graph, best.rejected, labels)
+		}
 		if flagVerbose {
 			printMapping(graph, sub, m)
 		}
+		if analyze() {
+			checkLoop(graph, sub, m)
+		}
 
 		// Merge the nodes of the subgraph isomorphism into a single node.
-		node, err := merge.Merge(graph, m, sub)
+		empty := emptyBranch(sub, m, labels)
+		sets := parallelLabels(m, labels)
+		node, err := mergePrim(graph, m, sub)
 		if err != nil {
 			return nil, errutil.Err(err)
 		}
+		labels.merge(m, node)
+		if flagExplain {
+			printExplanation(os.Stderr, sub, m, node, rejections(mms))
+		}
 
 		// Create a new control flow primitive.
-		prim := &primitive.Primitive{
-			Node:  node,
-			Prim:  sub.Name,
-			Nodes: m,
+		prim := newPrimitive(sub, m, node)
+		prim.EmptyBranch = empty
+		prim.Labels = sets
+		prim.heuristic = best.heuristic
+		if flagMismatches {
+			prim.Mismatches = mms
 		}
 		return prim, nil
 	}
 
-	return nil, errutil.New("unable to locate control flow primitive")
+	// Locate primitives which may not be described by primitive templates.
+	for _, f := range activeRegionFinders() {
+		prim, err := f.find(graph, labels)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+		if prim != nil {
+			return prim, nil
+		}
+	}
+
+	var mms []*Mismatch
+	if explain {
+		mms = mismatches(graph, rejected, labels)
+	}
+	if flagExplain {
+		printExplanation(os.Stderr, nil, nil, "", rejections(mms))
+	}
+	e := &Error{Kind: KindUnreduced, Msg: "unable to locate control flow primitive"}
+	if flagMismatches {
+		e.Mismatches = mms
+	}
+	return nil, e
+}
+
+// A match is an isomorphism of a control flow primitive located in a control
+// flow graph.
+type match struct {
+	// Located primitive, with its wildcard nodes expanded.
+	sub *graphs.SubGraph
+	// Node mapping from sub node name to graph node name.
+	m map[string]string
+	// Located by a heuristic.
+	heuristic bool
+	// Primitives of higher priority which failed to match, in explain mode and
+	// when mismatches are recorded.
+	rejected []*graphs.SubGraph
+}
+
+// locate locates the first isomorphism of sub in graph, as described by
+// findPrim, and returns nil if none is located.
+func locate(graph *dot.Graph, sub *graphs.SubGraph, labels edgeLabels, pt *postdomTree) *match {
+	var m map[string]string
+	var ok, heuristic bool
+	switch {
+	case len(wildcards(sub)) > 0:
+		// Locate the primitive with its wildcard nodes expanded.
+		var expanded *graphs.SubGraph
+		if m, expanded, ok = searchWildcards(graph, sub, labels); ok {
+			sub = expanded
+		}
+	case flagPostdomFollow && isConditional(sub):
+		// Locate the conditional at its post-dominator follow node.
+		m, ok = searchFollow(graph, sub, labels, pt)
+		heuristic = true
+	case hasEdgeLabels(sub) || hasValueNodes(sub):
+		m, ok = search(graph, sub, labels)
+	default:
+		m, ok = Matcher.Search(graph, sub)
+	}
+	if !ok {
+		return nil
+	}
+	return &match{sub: sub, m: m, heuristic: heuristic}
+}
+
+// A regionFinder locates a control flow primitive which may not be described by
+// a primitive template.
+type regionFinder struct {
+	// Name of the located primitive.
+	prim string
+	// find merges the first located primitive into a single node, and returns
+	// nil if no primitive is located.
+	find func(graph *dot.Graph, labels edgeLabels) (*Primitive, error)
 }
 
 // printMapping prints the mapping from sub node name to graph node name for an
@@ -235,50 +1489,130 @@ func printMapping(graph *dot.Graph, sub *graphs.SubGraph, m map[string]string) {
 		snames = append(snames, sname)
 	}
 	sort.Strings(snames)
-	fmt.Fprintf(os.Stderr, "Isomorphism of %q found at node %q:\n", sub.Name, entry)
+	fmt.Fprintf(os.Stderr, "Isomorphism of %q found at node %q:\n", sub.Name, unquote(entry))
 	for _, sname := range snames {
-		fmt.Fprintf(os.Stderr, "   %q=%q\n", sname, m[sname])
+		fmt.Fprintf(os.Stderr, "   %q=%q\n", sname, unquote(m[sname]))
 	}
 }
 
 var (
+	// regionFinders is an ordered list of functions locating control flow
+	// primitives which may not be described by primitive templates, as they
+	// lack a single follow node. Each function merges the located primitive
+	// into a single node, and returns nil if no primitive is located. They are
+	// tried once no primitive of subs may be located.
+	regionFinders = []regionFinder{
+		{prim: dispatchPrim, find: findDispatch},
+		{prim: switchPrim, find: findSwitch},
+		{prim: switchPrim, find: findBSTSwitch},
+		{prim: multiExitLoop, find: findMultiExitLoop},
+		{prim: jumpTable, find: findJumpTable},
+	}
 	// subs is an ordered list of subgraphs representing common control-flow
 	// primitives such as 2-way conditionals, pre-test loops, etc.
 	subs []*graphs.SubGraph
+	// priorSubNames specifies the name of each subgraph in subs which is
+	// provided by this repository and refines a primitive of subNames, arranged
+	// in the same order. These primitives are located before the ones of
+	// subNames.
+	priorSubNames = []string{
+		"select.dot", "continue_loop.dot", "post_loop_or.dot",
+		"post_loop_and.dot", "cond_eval.dot",
+	}
 	// subNames specifies the name of each subgraph in subs, arranged in the same
 	// order.
 	subNames = []string{
 		"pre_loop.dot", "post_loop.dot", "list.dot",
 		"if.dot", "if_else.dot", "if_return.dot",
 	}
+	// localSubNames specifies the name of each subgraph in subs which is
+	// provided by this repository rather than by decomp.org/x/graphs, arranged
+	// in the same order. These primitives are located after the ones of
+	// subNames.
+	localSubNames = []string{
+		"pre_loop_and.dot", "guarded_loop.dot", "hoisted_guard.dot",
+	}
 )
 
 func init() {
 	flag.Parse()
-	var subPaths []string
+	if flagQuiet {
+		// Print script-friendly error messages, and nothing else to stderr.
+		flagVerbose = false
+		log.SetFlags(0)
+	}
+	if flagLintPrims {
+		// The primitives are loaded by lintPrims, which reports the problems
+		// of the primitive set instead of failing.
+		return
+	}
+	// Parse subgraphs representing control flow primitives.
+	var err error
 	switch {
 	case len(flagPrimitives) > 0:
 		// Use custom primitives from the comma-separated list in the "-prims"
 		// flag.
-		subPaths = strings.Split(flagPrimitives, ",")
+		subs, err = parseSubs(strings.Split(flagPrimitives, ","))
+	case len(flagPrimsDir) > 0:
+		// Use default primitives from the directory of the "-prims-dir" flag.
+		subs, err = parseSubs(defaultSubPaths(flagPrimsDir))
 	default:
-		// Use default primitives.
-		subDir, err := goutil.SrcDir("decomp.org/x/graphs/testdata/primitives")
+		// Use embedded default primitives.
+		subs, err = parseSubsWith(defaultSubPaths("primitives"), parseEmbeddedSub)
+	}
+	if err != nil {
+		log.Fatalln(errutil.Err(err))
+	}
+	subs, err = orderSubs(subs)
+	if err != nil {
+		log.Fatalln(errutil.Err(err))
+	}
+}
+
+// orderSubs returns the given primitives in order of priority, as specified by
+// the "-order" and "-priorities" flags.
+func orderSubs(set []*graphs.SubGraph) ([]*graphs.SubGraph, error) {
+	var err error
+	if len(flagOrder) > 0 {
+		set, err = reorder(set, strings.Split(flagOrder, ","))
 		if err != nil {
-			log.Fatalln(errutil.Err(err))
+			return nil, errutil.Err(err)
 		}
-		for _, subName := range subNames {
-			subPath := filepath.Join(subDir, subName)
-			subPaths = append(subPaths, subPath)
+	}
+	var priorities map[string]int
+	if len(flagPriorities) > 0 {
+		priorities, err = parsePriorities(flagPriorities)
+		if err != nil {
+			return nil, errutil.Err(err)
 		}
 	}
+	return prioritize(set, priorities)
+}
 
-	// Parse subgraphs representing control flow primitives.
+// parseSubs parses the subgraphs of the given control flow primitives (*.dot).
+// Primitives with optional nodes are expanded into one subgraph per
+// combination of present optional nodes, as described by expandOptional.
+func parseSubs(subPaths []string) ([]*graphs.SubGraph, error) {
+	return parseSubsWith(subPaths, graphs.ParseSubGraph)
+}
+
+// parseSubsWith parses the subgraphs of the given control flow primitives, as
+// described by parseSubs, using parse to parse each subgraph.
+func parseSubsWith(subPaths []string, parse func(subPath string) (*graphs.SubGraph, error)) ([]*graphs.SubGraph, error) {
+	var subs []*graphs.SubGraph
 	for _, subPath := range subPaths {
-		sub, err := graphs.ParseSubGraph(subPath)
+		sub, err := parse(subPath)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+		if err := checkWildcards(sub); err != nil {
+			return nil, errutil.Newf("%s: %v", subPath, err)
+		}
+		variants, err := expandOptional(sub)
 		if err != nil {
-			log.Fatalln(errutil.Err(err))
+			return nil, errutil.Newf("%s: %v", subPath, err)
 		}
-		subs = append(subs, sub)
+		subs = append(subs, variants...)
 	}
+	return subs, nil
 }
@@ -1,57 +1,2755 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"decomp.org/x/graphs"
+	"decomp.org/x/graphs/iso"
 	"decomp.org/x/graphs/primitive"
+	"github.com/mewfork/dot"
 )
 
+// When update is true, regenerate the golden files of test cases.
+var update = flag.Bool("update", false, "Update golden files.")
+
 func TestRestructure(t *testing.T) {
+	golden := []string{
+		"testdata/foo.dot",
+		"testdata/bar.dot",
+		"testdata/while_and.dot",
+		"testdata/guarded_loop.dot",
+		"testdata/guarded_pre_loop.dot",
+		"testdata/hoisted_guard.dot",
+		"testdata/hoisted_guard_post.dot",
+		"testdata/continue_loop.dot",
+		"testdata/do_while_or.dot",
+		"testdata/do_while_and.dot",
+		"testdata/cond_eval.dot",
+		"testdata/multi_exit.dot",
+		"testdata/jump_table.dot",
+		"testdata/dispatch.dot",
+		"testdata/dispatch_converge.dot",
+		"testdata/select.dot",
+		"testdata/if_empty.dot",
+		"testdata/if_then.dot",
+		"testdata/if_then_else.dot",
+		// Entry node looping to itself, without external predecessors.
+		"testdata/self_entry.dot",
+	}
+	for _, dotPath := range golden {
+		checkGolden(t, dotPath)
+	}
+}
+
+func TestExcludeNodes(t *testing.T) {
+	defer func(old string) { flagExcludeNodes = old }(flagExcludeNodes)
+	flagExcludeNodes = "P"
+	checkGolden(t, "testdata/pad.dot")
+}
+
+// checkGolden restructures the given control flow graph and compares the
+// result against the sibling golden file of dotPath (e.g. "testdata/foo.json"
+// for "testdata/foo.dot"). The golden file is regenerated if the "-update" test
+// flag is set.
+func checkGolden(t *testing.T, dotPath string) {
+	jsonPath := strings.TrimSuffix(dotPath, filepath.Ext(dotPath)) + ".json"
+	checkGoldenFile(t, dotPath, jsonPath)
+}
+
+// checkGoldenFile restructures the given control flow graph and compares the
+// result against the given golden file, as described by checkGolden.
+func checkGoldenFile(t *testing.T, dotPath, jsonPath string) {
+	got, err := restructure(dotPath)
+	if err != nil {
+		t.Errorf("%q: error; %v", dotPath, err)
+		return
+	}
+	if *update {
+		buf, err := json.MarshalIndent(got, "", "\t")
+		if err != nil {
+			t.Errorf("%q: error; %v", dotPath, err)
+			return
+		}
+		if err := ioutil.WriteFile(jsonPath, buf, 0644); err != nil {
+			t.Errorf("%q: error; %v", dotPath, err)
+		}
+		return
+	}
+	buf, err := ioutil.ReadFile(jsonPath)
+	if err != nil {
+		t.Errorf("%q: error; %v", dotPath, err)
+		return
+	}
+	var want []*Primitive
+	if err := json.Unmarshal(buf, &want); err != nil {
+		t.Errorf("%q: error; %v", jsonPath, err)
+		return
+	}
+	// Compare the JSON encodings of the primitives, as unexported fields are
+	// not part of the golden files.
+	gotBuf, err := json.MarshalIndent(got, "", "\t")
+	if err != nil {
+		t.Errorf("%q: error; %v", dotPath, err)
+		return
+	}
+	wantBuf, err := json.MarshalIndent(want, "", "\t")
+	if err != nil {
+		t.Errorf("%q: error; %v", dotPath, err)
+		return
+	}
+	if !bytes.Equal(gotBuf, wantBuf) {
+		t.Errorf("%q: primitive mismatch; expected %s, got %s", dotPath, wantBuf, gotBuf)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	golden := []struct {
+		a, b string
+		want bool
+	}{
+		{a: "testdata/foo.dot", b: "testdata/foo_renamed.dot", want: true},
+		{a: "testdata/foo.dot", b: "testdata/bar.dot", want: false},
+	}
+	for i, g := range golden {
+		a, err := restructure(g.a)
+		if err != nil {
+			t.Errorf("i=%d: error; %v", i, err)
+			continue
+		}
+		b, err := restructure(g.b)
+		if err != nil {
+			t.Errorf("i=%d: error; %v", i, err)
+			continue
+		}
+		got := fingerprint(a) == fingerprint(b)
+		if got != g.want {
+			t.Errorf("i=%d: fingerprint equality mismatch; expected %v, got %v", i, g.want, got)
+		}
+	}
+}
+
+func TestOptional(t *testing.T) {
+	defer useSubs(t, "list.dot", "testdata/primitives/cond.dot")()
+	golden := []string{
+		"testdata/optional/if.dot",
+		"testdata/optional/if_else.dot",
+	}
+	for _, dotPath := range golden {
+		checkGolden(t, dotPath)
+	}
+}
+
+// useSubs replaces the control flow primitives used by restructure with the
+// given primitives, and returns a function which restores the original
+// primitives. Names without a directory refer to default primitives.
+func useSubs(t *testing.T, names ...string) (restore func()) {
+	defaultPaths := defaultSubPaths("primitives")
+	var subPaths []string
+	for _, name := range names {
+		subPath := name
+		if filepath.Base(name) == name {
+			for _, defaultPath := range defaultPaths {
+				if filepath.Base(defaultPath) == name {
+					subPath = defaultPath
+				}
+			}
+		}
+		subPaths = append(subPaths, subPath)
+	}
+	old := subs
+	var err error
+	subs, err = parseSubs(subPaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() { subs = old }
+}
+
+func TestEmbeddedPrims(t *testing.T) {
+	embedded, err := parseSubsWith(defaultSubPaths("primitives"), parseEmbeddedSub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onDisk, err := parseSubs(defaultSubPaths("primitives"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(embedded) != len(onDisk) {
+		t.Fatalf("primitive count mismatch; expected %d, got %d", len(onDisk), len(embedded))
+	}
+	for i, sub := range embedded {
+		want := onDisk[i]
+		if sub.Name != want.Name || sub.Entry() != want.Entry() || sub.Exit() != want.Exit() || len(sub.Nodes.Nodes) != len(want.Nodes.Nodes) {
+			t.Errorf("primitive %d mismatch; expected %q, got %q", i, want.Name, sub.Name)
+		}
+	}
+}
+
+func TestNaturalLoops(t *testing.T) {
+	graph, err := parseGraph("testdata/bar.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := entryNode(graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := naturalLoops(graph, entry)
+	want := []*loop{
+		{
+			header: "E",
+			nodes:  map[string]bool{"E": true, "F": true, "G": true, "H": true, "I": true},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("natural loop mismatch; expected %v, got %v", want, got)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	defer func(old string, require, loops bool) {
+		flagAllowPrims, flagRequireReduced, flagLoopsOnly = old, require, loops
+	}(flagAllowPrims, flagRequireReduced, flagLoopsOnly)
+	golden := []struct {
+		dotPath string
+		allow   string
+		// Loops-only mode, which returns partial results.
+		loops   bool
+		require bool
+		want    ErrorKind
+	}{
+		{dotPath: "testdata/foo.dot", allow: "list,if", want: 0},
+		{dotPath: "testdata/foo.dot", allow: "if", want: KindPolicy},
+		{dotPath: "testdata/loops_only.dot", loops: true, want: 0},
+		{dotPath: "testdata/loops_only.dot", loops: true, require: true, want: KindUnreduced},
+	}
+	for i, g := range golden {
+		flagAllowPrims = g.allow
+		flagLoopsOnly, flagRequireReduced = g.loops, g.require
+		_, err := restructure(g.dotPath)
+		var got ErrorKind
+		if err != nil {
+			e, ok := err.(*Error)
+			if !ok {
+				t.Errorf("i=%d: unexpected error; %v", i, err)
+				continue
+			}
+			got = e.Kind
+		}
+		if got != g.want {
+			t.Errorf("i=%d: error kind mismatch; expected %v, got %v", i, g.want, got)
+		}
+	}
+}
+
+func TestEdgeLabels(t *testing.T) {
+	defer useSubs(t, "list.dot", "testdata/primitives/if_else_labeled.dot")()
+	golden := []string{
+		"testdata/labels/if_else.dot",
+		"testdata/labels/if_else_list.dot",
+	}
+	for _, dotPath := range golden {
+		checkGolden(t, dotPath)
+	}
+}
+
+func TestWildcards(t *testing.T) {
+	defer useSubs(t, "testdata/primitives/cases.dot")()
+	checkGolden(t, "testdata/wildcard.dot")
+}
+
+func TestWildcardCounts(t *testing.T) {
+	golden := []struct {
+		bounds   []int
+		maxTotal int
+		want     [][]int
+	}{
+		{bounds: []int{3}, maxTotal: 5, want: [][]int{{3}, {2}, {1}}},
+		{bounds: []int{2, 2}, maxTotal: 3, want: [][]int{{2, 1}, {1, 2}, {1, 1}}},
+		{bounds: []int{2, 0}, maxTotal: 5, want: nil},
+	}
+	for i, g := range golden {
+		got := wildcardCounts(g.bounds, g.maxTotal)
+		if !reflect.DeepEqual(got, g.want) {
+			t.Errorf("i=%d: counts mismatch; expected %v, got %v", i, g.want, got)
+		}
+	}
+	// The copies of the wildcard node of cases.dot are bounded by the
+	// out-degree of the entry node.
+	subs, err := parseSubs([]string{"testdata/primitives/cases.dot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, err := parseGraph("testdata/wildcard.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := subs[0]
+	if got, want := wildcardBounds(graph, sub, wildcards(sub)), []int{3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("bounds mismatch; expected %v, got %v", want, got)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	if _, err := restructure("testdata/irreducible.dot"); err == nil {
+		t.Fatalf("expected error for irreducible graph")
+	}
+	var codes []string
+	for _, d := range Diagnostics() {
+		codes = append(codes, d.Code)
+	}
+	want := []string{"unreduced", "irreducible-loop"}
+	if !reflect.DeepEqual(codes, want) {
+		t.Errorf("diagnostic codes mismatch; expected %v, got %v", want, codes)
+	}
+}
+
+func TestVetPosition(t *testing.T) {
+	const dotPath = "testdata/vet.dot"
+	if _, err := restructure(dotPath); err == nil {
+		t.Fatalf("expected error for irreducible graph")
+	}
+	want := map[string]string{
+		"unreduced":        "testdata/vet.dot:7:2",
+		"irreducible-loop": "testdata/vet.dot:7:2",
+	}
+	for _, d := range Diagnostics() {
+		if got := vetPosition(d.Nodes); got != want[d.Code] {
+			t.Errorf("%q: position mismatch; expected %q, got %q", d.Code, want[d.Code], got)
+		}
+	}
+	// Nodes without line information.
+	if got, want := vetPosition([]string{"A"}), dotPath; got != want {
+		t.Errorf("position mismatch; expected %q, got %q", want, got)
+	}
+}
+
+func TestComponents(t *testing.T) {
+	const dotPath = "testdata/disconnected.dot"
+	_, err := restructure(dotPath)
+	if e, ok := err.(*Error); !ok || e.Kind != KindDisconnected {
+		t.Fatalf("%q: expected disconnected error, got %v", dotPath, err)
+	}
+	results, err := restructureComponents(dotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][]string)
+	for name, res := range results {
+		if len(res.Error) > 0 {
+			t.Errorf("component %q: unexpected error; %v", name, res.Error)
+			continue
+		}
+		for _, prim := range res.Prims {
+			got[name] = append(got[name], prim.Prim)
+		}
+	}
+	want := map[string][]string{
+		"E": {"list", "if"},
+		"X": {"list"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("component primitives mismatch; expected %v, got %v", want, got)
+	}
+}
+
+func TestStats(t *testing.T) {
+	golden := []struct {
+		path string
+		want *recoveryStats
+	}{
+		{path: "testdata/foo.dot", want: &recoveryStats{Nodes: 4, Steps: 2, Remaining: 1, Ratio: 0.5, Root: "if0"}},
+		{path: "testdata/irreducible.dot", want: &recoveryStats{Nodes: 3, Steps: 0, Remaining: 3, Ratio: 0}},
+	}
+	for _, g := range golden {
+		restructure(g.path)
+		if !reflect.DeepEqual(stats, g.want) {
+			t.Errorf("%q: stats mismatch; expected %v, got %v", g.path, g.want, stats)
+		}
+	}
+}
+
+func TestAlsoStdout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restructure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(output string, also bool, stdout *os.File) {
+		flagOutput, flagAlsoStdout, os.Stdout = output, also, stdout
+	}(flagOutput, flagAlsoStdout, os.Stdout)
+	flagOutput = filepath.Join(dir, "out.txt")
+	flagAlsoStdout = true
+	r, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = pw
+	w, err := createOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = "output\n"
+	if _, err := io.WriteString(w, want); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+	stdout, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ioutil.ReadFile(flagOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stdout) != want || string(file) != want {
+		t.Errorf("output mismatch; expected %q, got %q (stdout) and %q (file)", want, stdout, file)
+	}
+}
+
+func TestOutputStdout(t *testing.T) {
+	defer func(output string, stdout *os.File) { flagOutput, os.Stdout = output, stdout }(flagOutput, os.Stdout)
+	flagOutput = ""
+	r, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	os.Stdout = pw
+	w, err := createOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Closing the output leaves standard output open.
+	if _, err := io.WriteString(pw, "output\n"); err != nil {
+		t.Errorf("standard output closed; %v", err)
+	}
+	pw.Close()
+}
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restructure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const dotPath = "testdata/foo.dot"
+	want, err := restructureCached(dotPath, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("number of cache entries mismatch; expected 1, got %d", len(entries))
+	}
+	// A cache hit skips the reduction; replace the cached primitives to tell.
+	want = want[:1]
+	data, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(entries[0], data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := restructureCached(dotPath, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || !reflect.DeepEqual(got[0].Primitive, want[0].Primitive) {
+		t.Errorf("cached primitives mismatch; expected %v, got %v", want, got)
+	}
+	// Changing the primitive set invalidates the cache.
+	defer useSubs(t, "list.dot", "if.dot")()
+	got, err = restructureCached(dotPath, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Errorf("number of primitives mismatch; expected 2, got %d", len(got))
+	}
+}
+
+func TestCacheInput(t *testing.T) {
+	defer func(old string) { flagInput = old }(flagInput)
+	flagInput = inputJSON
+	checkCached(t, "testdata/foo.cfg.json")
+}
+
+func TestCacheReverse(t *testing.T) {
+	defer func(old bool) { flagReverse = old }(flagReverse)
+	flagReverse = true
+	checkCached(t, "testdata/foo.dot")
+}
+
+func TestCacheVirtualRoot(t *testing.T) {
+	defer func(old, dot string) { flagVirtualRoot, flagDot = old, dot }(flagVirtualRoot, flagDot)
+	flagVirtualRoot = "root"
+	flagDot = `digraph g { root -> E; E -> F; E -> H; F -> G; G -> H; root [label="entry"] }`
+	checkCached(t, dotFlagPath)
+}
+
+func TestCacheTee(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restructure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := make(chan int)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			lines <- -1
+			return
+		}
+		defer conn.Close()
+		n := 0
+		for s := bufio.NewScanner(conn); s.Scan(); {
+			n++
+		}
+		lines <- n
+	}()
+	// Stream to the TCP address, as by -tee.
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old []Emitter) { emitters = old }(emitters)
+	emitters = []Emitter{newJSONEmitter(conn)}
+	const dotPath = "testdata/foo.dot"
+	// The cached primitives are streamed on the cache hit of the second run.
+	for i := 0; i < 2; i++ {
+		if _, err := restructureCached(dotPath, dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+	if n := <-lines; n != 4 {
+		t.Errorf("%q: number of streamed primitives mismatch; expected 4, got %d", dotPath, n)
+	}
+}
+
+func TestCacheWithEdges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restructure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old bool) { flagWithEdges = old }(flagWithEdges)
+	const dotPath = "testdata/foo.dot"
+	// Populate the cache without consumed edges.
+	flagWithEdges = false
+	if _, err := restructureCached(dotPath, dir); err != nil {
+		t.Fatal(err)
+	}
+	flagWithEdges = true
+	prims, err := restructureCached(dotPath, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prim := range prims {
+		if len(prim.ConsumedEdges) == 0 {
+			t.Errorf("%q: consumed edges of %q missing from cached primitives", dotPath, prim.Node)
+		}
+	}
+	checkCached(t, dotPath)
+}
+
+// checkCached restructures the given control flow graph, on a cache miss and
+// on a cache hit of the primitive cache, and compares the results against
+// those of restructure.
+func checkCached(t *testing.T, dotPath string) {
+	want, err := restructure(dotPath)
+	if err != nil {
+		t.Errorf("%q: error; %v", dotPath, err)
+		return
+	}
+	dir, err := ioutil.TempDir("", "restructure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wantBuf, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hit := range []bool{false, true} {
+		got, err := restructureCached(dotPath, dir)
+		if err != nil {
+			t.Errorf("%q: error (cache hit %v); %v", dotPath, hit, err)
+			return
+		}
+		gotBuf, err := json.Marshal(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(gotBuf, wantBuf) {
+			t.Errorf("%q: primitive mismatch (cache hit %v); expected %s, got %s", dotPath, hit, wantBuf, gotBuf)
+		}
+	}
+}
+
+func TestTransform(t *testing.T) {
+	defer func(old []GraphTransform) { transforms = old }(transforms)
+	ts, err := parseTransforms("split-shared-headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transforms = ts
+	checkGolden(t, "testdata/split.dot")
+}
+
+func TestDiffPrims(t *testing.T) {
+	golden := []struct {
+		base, cur string
+		want      int
+	}{
+		{base: "testdata/foo.json", cur: "testdata/foo_renamed.dot", want: 0},
+		{base: "testdata/foo.json", cur: "testdata/bar.dot", want: 4},
+	}
+	for i, g := range golden {
+		base, err := loadPrims(g.base)
+		if err != nil {
+			t.Errorf("i=%d: error; %v", i, err)
+			continue
+		}
+		cur, err := restructure(g.cur)
+		if err != nil {
+			t.Errorf("i=%d: error; %v", i, err)
+			continue
+		}
+		if got := len(diffPrims(base, cur)); got != g.want {
+			t.Errorf("i=%d: number of differences mismatch; expected %d, got %d", i, g.want, got)
+		}
+	}
+}
+
+func TestCarryAttrs(t *testing.T) {
+	defer func(old string) { flagCarryAttrs = old }(flagCarryAttrs)
+	flagCarryAttrs = "line,file"
+	checkGolden(t, "testdata/lines.dot")
+}
+
+func TestAddrAttr(t *testing.T) {
+	defer func(attr, dot string) {
+		flagAddrAttr, flagDot = attr, dot
+	}(flagAddrAttr, flagDot)
+	flagAddrAttr = "addr"
+	checkGolden(t, "testdata/addr.dot")
+
+	// The "entry" label is not an address.
+	flagAddrAttr = "label"
+	flagDot = `digraph g {
+	A [label="entry"]
+	B [label="0x10"]
+	C [label="0x20"]
+	A -> B
+	B -> C
+	C -> B
+	C -> D
+}`
+	prims, err := restructure(dotFlagPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, prim := range prims {
+		got = append(got, prim.Addr)
+	}
+	if want := []string{"0x10", "0x10", ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("addresses mismatch; expected %q, got %q", want, got)
+	}
+
+	// Nor is the "exit" label; e.g. of a loop entered through the exit node.
+	flagDot = `digraph g {
+	A [label="entry"]
+	B [label="0x10"]
+	X [label="exit"]
+	A -> B
+	B -> X
+	X -> Y
+	Y -> X
+	X -> Z
+}`
+	prims, err = restructure(dotFlagPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, prim := range prims {
+		got = append(got, prim.Addr)
+	}
+	if want := []string{"", "", ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("addresses mismatch; expected %q, got %q", want, got)
+	}
+}
+
+func TestLoopsOnly(t *testing.T) {
+	defer func(old bool) { flagLoopsOnly = old }(flagLoopsOnly)
+	flagLoopsOnly = true
+	checkGolden(t, "testdata/loops_only.dot")
+
+	// Conditionals are left unstructured by the exhaustive strategy too.
+	defer func(old string) { flagStrategy = old }(flagStrategy)
+	flagStrategy = strategyExhaustive
+	prims, err := restructure("testdata/switch/bst.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prim := range prims {
+		if prim.Prim == switchPrim {
+			t.Errorf("unexpected %q primitive %q in loops-only mode", prim.Prim, prim.Node)
+		}
+	}
+	flagStrategy = strategyGreedy
+
+	// Only the failure to locate a primitive is tolerated in loops-only mode.
+	defer func(old []regionFinder) { loopRegionFinders = old }(loopRegionFinders)
+	loopRegionFinders = []regionFinder{{prim: naturalLoopPrim, find: func(graph *dot.Graph, labels edgeLabels) (*Primitive, error) {
+		return nil, errors.New("region finder failure")
+	}}}
+	if _, err := restructure("testdata/loops_only.dot"); err == nil || !strings.Contains(err.Error(), "region finder failure") {
+		t.Errorf("expected region finder failure, got %v", err)
+	}
+}
+
+func TestAssertComplete(t *testing.T) {
+	defer func(old, loops bool) { flagAssertComplete, flagLoopsOnly = old, loops }(flagAssertComplete, flagLoopsOnly)
+	flagAssertComplete = true
+	checkGolden(t, "testdata/foo.dot")
+	checkGolden(t, "testdata/multi_exit.dot")
+
+	// Loops-only mode leaves the nodes and edges outside of loops uncovered.
+	flagLoopsOnly = true
+	const dotPath = "testdata/loops_only.dot"
+	_, err := restructure(dotPath)
+	if e, ok := err.(*Error); !ok || e.Kind != KindIncomplete {
+		t.Errorf("%q: expected KindIncomplete error, got %v", dotPath, err)
+	}
+}
+
+func TestAssertSingleRoot(t *testing.T) {
+	defer func(old bool) { flagAssertSingleRoot = old }(flagAssertSingleRoot)
+	flagAssertSingleRoot = true
+	checkGolden(t, "testdata/foo.dot")
+	checkGolden(t, "testdata/jump_table.dot")
+
+	// Disconnected primitive trees.
+	prims := []*Primitive{
+		{Primitive: &primitive.Primitive{Prim: "list", Node: "list0", Nodes: map[string]string{"A": "F", "B": "G"}}},
+		{Primitive: &primitive.Primitive{Prim: "if", Node: "if0", Nodes: map[string]string{"A": "E", "B": "X", "C": "H"}}},
+	}
+	err := checkSingleRoot(prims)
+	if e, ok := err.(*Error); !ok || e.Kind != KindRoots {
+		t.Errorf("expected KindRoots error, got %v", err)
+	}
+	prims[1].Nodes["B"] = "list0"
+	if err := checkSingleRoot(prims); err != nil {
+		t.Errorf("unexpected error; %v", err)
+	}
+}
+
+func TestWeightAttr(t *testing.T) {
+	defer func(old string) { flagWeightAttr = old }(flagWeightAttr)
+	flagWeightAttr = "weight"
+	checkGolden(t, "testdata/weights.dot")
+}
+
+func TestExplain(t *testing.T) {
+	defer useSubs(t, "list.dot", "if.dot")()
+	graph, err := parseGraph("testdata/irreducible.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := rejections(mismatches(graph, subs, newEdgeLabels(graph)))
+	want := []string{
+		`"list": node "A" (as "A") has 2 successor(s) but "A" requires 1; unexpected ["C"]`,
+		`"if": node "B" (as "B") has 2 predecessor(s) but "B" requires 1; unexpected ["C"]`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rejections mismatch; expected %q, got %q", want, got)
+	}
+}
+
+func TestMismatches(t *testing.T) {
+	defer useSubs(t, "list.dot", "if.dot")()
+	defer func(old bool) { flagMismatches = old }(flagMismatches)
+	flagMismatches = true
+	_, err := restructure("testdata/irreducible.dot")
+	e, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("expected *Error, got %T", err)
+	}
+	want := []*Mismatch{
+		{Prim: "list", Kind: MismatchSuccessor, Role: "A", Node: "A", Edge: &[2]string{"A", "C"}, Depth: 2, Reason: `node "A" (as "A") has 2 successor(s) but "A" requires 1; unexpected ["C"]`},
+		{Prim: "if", Kind: MismatchPredecessor, Role: "B", Node: "B", Edge: &[2]string{"C", "B"}, Depth: 3, Reason: `node "B" (as "B") has 2 predecessor(s) but "B" requires 1; unexpected ["C"]`},
+	}
+	if !reflect.DeepEqual(e.Mismatches, want) {
+		buf, _ := json.Marshal(e.Mismatches)
+		t.Errorf("stall mismatches mismatch; got %s", buf)
+	}
+
+	// Mismatches of a MismatchSearcher.
+	defer func(old Searcher) { Matcher = old }(Matcher)
+	Matcher = mismatchSearcher{}
+	prims, err := restructure("testdata/foo.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The list primitive is located first, without rejections.
+	if n := len(prims[0].Mismatches); n != 0 {
+		t.Errorf("%q: expected no mismatches, got %d", prims[0].Node, n)
+	}
+	if got := prims[1].Mismatches; len(got) != 1 || got[0].Prim != "list" || got[0].Kind != "custom" {
+		buf, _ := json.Marshal(got)
+		t.Errorf("%q: unexpected mismatches; %s", prims[1].Node, buf)
+	}
+}
+
+// mismatchSearcher is a MismatchSearcher which reports a custom mismatch.
+type mismatchSearcher struct{}
+
+func (mismatchSearcher) Search(graph *dot.Graph, sub *graphs.SubGraph) (map[string]string, bool) {
+	return iso.Search(graph, sub)
+}
+
+func (mismatchSearcher) Mismatch(graph *dot.Graph, sub *graphs.SubGraph) *Mismatch {
+	return &Mismatch{Kind: "custom", Reason: "custom reason"}
+}
+
+func TestStallReport(t *testing.T) {
+	defer useSubs(t, "list.dot", "if.dot")()
+	graph, err := parseGraph("testdata/irreducible.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	printStallReport(buf, graph, subs, 0)
+	want := `Unable to locate control flow primitive in "irreducible" after 0 reduction step(s).
+Primitives tried: list, if, dispatch, switch, multi_exit_loop, jump_table
+Residual nodes (3): A, B, C
+Residual edges (4): A -> B, A -> C, B -> C, C -> B
+`
+	if got := buf.String(); got != want {
+		t.Errorf("stall report mismatch; expected %q, got %q", want, got)
+	}
+
+	// Only the region finders of loops-only mode are tried in loops-only mode.
+	defer func(old bool) { flagLoopsOnly = old }(flagLoopsOnly)
+	flagLoopsOnly = true
+	buf.Reset()
+	printStallReport(buf, graph, loopSubs(subs), 0)
+	const tried = "Primitives tried: multi_exit_loop, loop\n"
+	if got := buf.String(); !strings.Contains(got, tried) {
+		t.Errorf("stall report mismatch; expected %q in %q", tried, got)
+	}
+}
+
+func TestPrintSummary(t *testing.T) {
+	graph, err := parseGraph("testdata/bar.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prims, err := Restructure(graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	printSummary(buf, graph, prims)
+	want := "Graph \"bar\" fully reduced to single node \"pre_loop0\" in 2 step(s) using primitives [if_else=1, pre_loop=1]\n"
+	if got := buf.String(); got != want {
+		t.Errorf("summary mismatch; expected %q, got %q", want, got)
+	}
+}
+
+func TestPrimTreeDOT(t *testing.T) {
+	golden := []struct {
+		dotPath string
+		want    string
+	}{
+		{
+			dotPath: "testdata/foo.dot",
+			want: `digraph prims {
+	prim0 [label="list\nlist0"]
+	prim1 [label="if\nif0"]
+	prim1 -> prim0 [label="B"]
+}
+`,
+		},
+		// Nested loops of the same type reuse super-node names.
+		{
+			dotPath: "testdata/loop_nest.dot",
+			want: `digraph prims {
+	prim0 [label="pre_loop\npre_loop0"]
+	prim1 [label="pre_loop\npre_loop1"]
+	prim2 [label="pre_loop\npre_loop0"]
+	prim3 [label="list\nlist0"]
+	prim1 -> prim0 [label="B"]
+	prim2 -> prim1 [label="B"]
+	prim3 -> prim2 [label="B"]
+}
+`,
+		},
+	}
+	for _, g := range golden {
+		prims, err := restructure(g.dotPath)
+		if err != nil {
+			t.Errorf("%q: %v", g.dotPath, err)
+			continue
+		}
+		buf := &bytes.Buffer{}
+		if err := writePrimTreeDOT(buf, prims); err != nil {
+			t.Errorf("%q: %v", g.dotPath, err)
+			continue
+		}
+		if got := buf.String(); got != g.want {
+			t.Errorf("%q: primitive tree mismatch; expected %q, got %q", g.dotPath, g.want, got)
+		}
+	}
+}
+
+func TestSexpr(t *testing.T) {
+	defer func(old string) { flagFormat = old }(flagFormat)
+	flagFormat = "sexpr"
+	golden := []struct {
+		dotPath string
+		want    string
+	}{
+		{dotPath: "testdata/foo.dot", want: "(if E (list F G) H)\n"},
+		{dotPath: "testdata/bar.dot", want: "(pre_loop E (if_else F G H I) J)\n"},
+		{dotPath: "testdata/special.dot", want: "(if 0x401000 a:b (list \"node with space\" \"quote\\\"d\"))\n"},
+	}
+	for _, g := range golden {
+		prims, err := restructure(g.dotPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := &bytes.Buffer{}
+		if err := writeOutput(buf, prims); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != g.want {
+			t.Errorf("%q: S-expression mismatch; expected %q, got %q", g.dotPath, g.want, got)
+		}
+	}
+	if got, want := sexprAtom("a b"), `"a b"`; got != want {
+		t.Errorf("atom mismatch; expected %q, got %q", want, got)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	defer func(old metaFlag, format string) { flagMeta, flagFormat = old, format }(flagMeta, flagFormat)
+	flagMeta = make(metaFlag)
+	for _, pair := range []string{"version=1.0", "date=2016-01-02"} {
+		if err := flagMeta.Set(pair); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := flagMeta.Set("version"); err == nil {
+		t.Errorf("expected error for invalid metadata, got nil")
+	}
+	prims, err := restructure("testdata/foo.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flagFormat = "json"
+	buf := &bytes.Buffer{}
+	if err := writeOutput(buf, prims); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"meta":{"date":"2016-01-02","version":"1.0"},"prims":[{"prim":"list","node":"list0","nodes":{"A":"F","B":"G"}},{"prim":"if","node":"if0","nodes":{"A":"E","B":"list0","C":"H"}}]}
+`
+	if got := buf.String(); got != want {
+		t.Errorf("output mismatch; expected %q, got %q", want, got)
+	}
+	flagFormat = "protobuf"
+	buf.Reset()
+	if err := writeOutput(buf, prims); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := UnmarshalDocument(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(doc.Meta, map[string]string(flagMeta)) {
+		t.Errorf("metadata mismatch; expected %v, got %v", flagMeta, doc.Meta)
+	}
+	flagFormat = "gob"
+	if err := writeOutput(ioutil.Discard, prims); err == nil {
+		t.Errorf("expected error for metadata of gob output, got nil")
+	}
+}
+
+func TestReverseMap(t *testing.T) {
+	defer func(old bool, format string) { flagReverseMap, flagFormat = old, format }(flagReverseMap, flagFormat)
+	prims, err := restructure("testdata/bar.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := reverseMap(prims)
+	want := map[string]*Owner{
+		"E": {Node: "pre_loop0", Prim: "pre_loop"},
+		"F": {Node: "if_else0", Prim: "if_else"},
+		"G": {Node: "if_else0", Prim: "if_else"},
+		"H": {Node: "if_else0", Prim: "if_else"},
+		"I": {Node: "if_else0", Prim: "if_else"},
+		"J": {Node: "pre_loop0", Prim: "pre_loop"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("reverse map mismatch; expected %v, got %v", want, got)
+	}
+	flagReverseMap = true
+	flagFormat = "json"
+	buf := &bytes.Buffer{}
+	if err := writeOutput(buf, prims); err != nil {
+		t.Fatal(err)
+	}
+	var doc Document
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Meta != nil || len(doc.Prims) != len(prims) || !reflect.DeepEqual(doc.ReverseMap, want) {
+		t.Errorf("document mismatch; got %s", buf)
+	}
+	flagFormat = "sexpr"
+	if err := writeOutput(ioutil.Discard, prims); err == nil {
+		t.Errorf("expected error for reverse map of sexpr output, got nil")
+	}
+}
+
+func TestRewrites(t *testing.T) {
+	prims, err := restructure("testdata/foo.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old string) { flagFormat = old }(flagFormat)
+	flagFormat = "rewrites"
+	buf := &bytes.Buffer{}
+	if err := writeOutput(buf, prims); err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"step":0,"pattern":"list","match":["F","G"],"binding":{"A":"F","B":"G"},"replacement":"list0"},{"step":1,"pattern":"if","match":["E","H","list0"],"binding":{"A":"E","B":"list0","C":"H"},"replacement":"if0"}]
+`
+	if got := buf.String(); got != want {
+		t.Errorf("rewrites mismatch; expected %q, got %q", want, got)
+	}
+}
+
+func TestDumpGraphNested(t *testing.T) {
+	defer func(old string, nested bool) {
+		flagDumpGraph, flagDumpGraphNested = old, nested
+	}(flagDumpGraph, flagDumpGraphNested)
+	flagDumpGraph = "-"
+	flagDumpGraphNested = true
+	if _, err := restructure("testdata/foo.dot"); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := writeNestedDOT(buf, dumped.orig, dumped.prims); err != nil {
+		t.Fatal(err)
+	}
+	want := `digraph foo {
+	subgraph cluster_if0 {
+		label="if"
+		E [label="entry"]
+		subgraph cluster_list0 {
+			label="list"
+			F
+			G
+		}
+		H [label="exit"]
+	}
+	E -> F
+	E -> H
+	F -> G
+	G -> H
+}
+`
+	if got := buf.String(); got != want {
+		t.Errorf("nested graph mismatch; expected %q, got %q", want, got)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	defer func(old int) { flagMaxDepth = old }(flagMaxDepth)
+	flagMaxDepth = 1000
+	// Synthetic nesting of lists, each nested in the next.
+	const depth = 100000
+	graph := &dot.Graph{Name: "deep"}
+	prims := make([]*Primitive, depth)
+	for i := range prims {
+		a := fmt.Sprintf("N%d", i)
+		if i > 0 {
+			a = prims[i-1].Node
+		}
+		prims[i] = &Primitive{Primitive: &primitive.Primitive{
+			Prim:  "list",
+			Node:  fmt.Sprintf("list%d", i),
+			Nodes: map[string]string{"A": a, "B": fmt.Sprintf("M%d", i)},
+		}}
+	}
+	err := writeNestedDOT(ioutil.Discard, graph, prims)
+	if e, ok := err.(*Error); !ok || e.Kind != KindDepth {
+		t.Errorf("expected depth error, got %v", err)
+	}
+	if err := writePrimTreeDOT(ioutil.Discard, prims); err == nil {
+		t.Errorf("expected depth error, got nil")
+	}
+	// The primitive tree is resolved iteratively.
+	flagMaxDepth = 0
+	if err := writePrimTreeDOT(ioutil.Discard, prims); err != nil {
+		t.Errorf("unexpected error; %v", err)
+	}
+	if got := primTree(prims)[depth-1].height; got != depth {
+		t.Errorf("height mismatch; expected %d, got %d", depth, got)
+	}
+}
+
+func TestSortOutput(t *testing.T) {
+	prims, err := restructure("testdata/foo.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old bool) { flagSortOutput = old }(flagSortOutput)
+	flagSortOutput = true
+	buf := &bytes.Buffer{}
+	if err := writeOutput(buf, prims); err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"prim":"if","node":"if0","nodes":{"A":"E","B":"list0","C":"H"},"order":1},{"prim":"list","node":"list0","nodes":{"A":"F","B":"G"},"order":0}]
+`
+	if got := buf.String(); got != want {
+		t.Errorf("sorted output mismatch; expected %q, got %q", want, got)
+	}
+	if prims[0].Order != nil {
+		t.Errorf("expected primitives to be left unmodified")
+	}
+}
+
+func TestRestructureBest(t *testing.T) {
+	graph, err := parseGraph("testdata/foo.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := useSubs(t, "if_else.dot")
+	partial := subs
+	restore()
+	restore = useSubs(t, "list.dot", "if.dot")
+	full := subs
+	restore()
+
+	if _, err := RestructureBest(graph, partial); err == nil {
+		t.Errorf("expected unreduced error, got nil")
+	}
+	prims, err := RestructureBest(graph, partial, full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, prim := range prims {
+		got = append(got, prim.Prim)
+	}
+	if want := []string{"list", "if"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("primitive mismatch; expected %q, got %q", want, got)
+	}
+	// The graph is left unmodified by the attempts.
+	if n := len(graph.Nodes.Nodes); n != 4 {
+		t.Errorf("node count mismatch; expected 4, got %d", n)
+	}
+}
+
+func TestTune(t *testing.T) {
+	defer useSubs(t, "if_else.dot", "list.dot", "if.dot")()
+	got := tune([]string{"testdata/foo.dot"})
+	want := []string{"list", "if", "if_else"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("order mismatch; expected %q, got %q", want, got)
+	}
+	ordered, err := reorder(subs, []string{"if"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := primNames(ordered), []string{"if", "if_else", "list"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("reorder mismatch; expected %q, got %q", want, got)
+	}
+	if _, err := reorder(subs, []string{"switch"}); err == nil {
+		t.Errorf("expected error for unknown primitive, got nil")
+	}
+}
+
+func TestPrioritize(t *testing.T) {
+	defer useSubs(t, "if_else.dot", "list.dot", "if.dot", "testdata/primitives/seq.dot")()
+	priorities, err := parsePriorities("if=10,list=-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prioritized, err := prioritize(subs, priorities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The variants of seq inherit its priority, as specified by its graph
+	// attribute.
+	var got []string
+	for _, sub := range prioritized {
+		got = append(got, sub.Name)
+	}
+	want := []string{"seq", "seq", "if", "if_else", "list"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("priority order mismatch; expected %q, got %q", want, got)
+	}
+	if _, err := prioritize(subs, map[string]int{"switch": 1}); err == nil {
+		t.Errorf("expected error for unknown primitive, got nil")
+	}
+	if _, err := parsePriorities("if"); err == nil {
+		t.Errorf("expected error for invalid priority, got nil")
+	}
+}
+
+func TestPostdomFollow(t *testing.T) {
+	defer useSubs(t, "testdata/primitives/if_else_tail.dot", "if_else.dot", "list.dot")()
+	const dotPath = "testdata/postdom/if_else_tail.dot"
+	// The local inference picks the node following the join as follow node.
+	prims, err := restructure(dotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prims) != 1 || prims[0].Prim != "if_else_tail" {
+		t.Errorf("%q: expected a single if_else_tail primitive, got %v", dotPath, prims)
+	}
+	defer func(old bool) { flagPostdomFollow = old }(flagPostdomFollow)
+	flagPostdomFollow = true
+	checkGolden(t, dotPath)
+}
+
+func TestSimplify(t *testing.T) {
+	const dotPath = "testdata/chain.dot"
+	prims, err := restructure(dotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := simplify(prims)
+	if len(got) >= len(prims) {
+		t.Errorf("%q: expected fewer primitives after simplification, got %d of %d", dotPath, len(got), len(prims))
+	}
+	want := map[string]string{"A": "A", "B": "B", "C": "C", "D": "D"}
+	if len(got) != 1 || got[0].Prim != "list" || !reflect.DeepEqual(got[0].Nodes, want) {
+		t.Errorf("%q: expected a single list of %v, got %v", dotPath, want, got)
+	}
+	// The original primitives are not modified.
+	if len(prims[0].Nodes) != 2 {
+		t.Errorf("%q: original primitive modified; %v", dotPath, prims[0])
+	}
+
+	// The label sets and shape of the enclosing list are renumbered.
+	defer func(old bool) { flagWithShape = old }(flagWithShape)
+	flagWithShape = true
+	const labelsPath = "testdata/chain_labels.dot"
+	prims, err = restructure(labelsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = simplify(prims)
+	if len(got) != 1 {
+		t.Fatalf("%q: expected a single list, got %v", labelsPath, got)
+	}
+	wantLabels := []*LabelSet{
+		{Edge: [2]string{"A", "B"}, Labels: []string{"1", "2"}},
+		{Edge: [2]string{"C", "D"}, Labels: []string{"3", "4"}},
+	}
+	if !reflect.DeepEqual(got[0].Labels, wantLabels) {
+		t.Errorf("%q: label sets mismatch; expected %v, got %v", labelsPath, wantLabels, got[0].Labels)
+	}
+	wantShape := &Shape{
+		Entry: "A",
+		Exit:  "D",
+		Nodes: []string{"A", "B", "C", "D"},
+		Edges: [][2]string{{"A", "B"}, {"B", "C"}, {"C", "D"}},
+	}
+	if !reflect.DeepEqual(got[0].Shape, wantShape) {
+		t.Errorf("%q: shape mismatch; expected %v, got %v", labelsPath, wantShape, got[0].Shape)
+	}
+}
+
+func TestMarkReturn(t *testing.T) {
+	defer func(old, complete bool) { flagMarkReturn, flagAssertComplete = old, complete }(flagMarkReturn, flagAssertComplete)
+	flagMarkReturn = true
+	flagAssertComplete = true
+	checkGolden(t, "testdata/mark_return.dot")
+
+	// No return primitive for graphs without a single terminal node.
+	prims, err := restructure("testdata/dispatch.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prim := range prims {
+		if prim.Prim == returnPrim {
+			t.Errorf("unexpected return primitive %q", prim.Node)
+		}
+	}
+}
+
+func TestNodeEquivalence(t *testing.T) {
+	defer func(old string) { flagEquivAttr = old }(flagEquivAttr)
+	const dotPath = "testdata/equiv.dot"
+	golden := []struct {
+		attr string
+		want []string
+	}{
+		// Equivalence disabled.
+		{attr: "", want: []string{"if_else"}},
+		// F and G are both nop blocks; collapsed into a single node.
+		{attr: "kind", want: []string{"equiv", "list", "list"}},
+		// No node has the attribute.
+		{attr: "label", want: []string{"if_else"}},
+	}
+	for _, g := range golden {
+		flagEquivAttr = g.attr
+		prims, err := restructure(dotPath)
+		if err != nil {
+			t.Errorf("%q: %v", g.attr, err)
+			continue
+		}
+		var got []string
+		for _, prim := range prims {
+			got = append(got, prim.Prim)
+		}
+		if !reflect.DeepEqual(got, g.want) {
+			t.Errorf("%q: primitive mismatch; expected %q, got %q", g.attr, g.want, got)
+		}
+	}
+
+	// Custom relation.
+	flagEquivAttr = ""
+	defer func() { NodeEquivalence = nil }()
+	NodeEquivalence = func(a, b *dot.Node) bool { return true }
+	prims, err := restructure(dotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prims) == 0 || prims[0].Prim != equivPrim || prims[0].Nodes["A"] != "F" || prims[0].Nodes["B"] != "G" {
+		t.Errorf("custom relation; expected %q of F and G first, got %v", equivPrim, prims)
+	}
+}
+
+func TestVirtualRoot(t *testing.T) {
+	defer func(old string) { flagVirtualRoot = old }(flagVirtualRoot)
+	flagVirtualRoot = "root"
+	const dotPath = "testdata/virtual_root.dot"
+	graph, err := parseGraph(dotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := graph.Nodes.Lookup["root"]; ok {
+		t.Errorf("%q: virtual root not removed", dotPath)
+	}
+	for _, name := range []string{"E", "A"} {
+		if !isEntry(graph.Nodes.Lookup[name]) {
+			t.Errorf("%q: expected node %q to be labeled entry", dotPath, name)
+		}
+	}
+	results, err := restructureComponents(dotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"E", "A"} {
+		res, ok := results[name]
+		if !ok || len(res.Error) > 0 {
+			t.Errorf("%q: unable to restructure entry %q; %v", dotPath, name, res)
+		}
+	}
+	flagVirtualRoot = "X"
+	if _, err := parseGraph(dotPath); err == nil {
+		t.Errorf("%q: expected error for missing virtual root, got nil", dotPath)
+	}
+}
+
+func TestLoopNests(t *testing.T) {
+	defer func(old int) { flagNameOffset = old }(flagNameOffset)
+	// Unique super-node names, so that each loop is identified by name.
+	flagNameOffset = 1
+	prims, err := restructure("testdata/loop_nest.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nested := loopNests(prims)
+	if len(nested) != len(prims)+1 {
+		t.Fatalf("expected a single loop nest, got %d", len(nested)-len(prims))
+	}
+	headers := make(map[string]string)
+	for _, prim := range prims {
+		headers[prim.Node] = prim.Nodes["A"]
+	}
+	nest := nested[len(nested)-1]
+	if nest.Prim != loopNestPrim || nest.Node != "loop_nest1" {
+		t.Errorf("loop nest mismatch; expected %q named %q, got %q named %q", loopNestPrim, "loop_nest1", nest.Prim, nest.Node)
+	}
+	// The roles enumerate the nesting levels from the outermost loop inwards.
+	for i, header := range []string{"H1", "H2", "H3"} {
+		loop := nest.Nodes[role(i)]
+		if got := headers[loop]; got != header {
+			t.Errorf("role %q; expected loop with header %q, got %q", role(i), header, got)
+		}
+		if got := nest.Levels[loop]; got != i {
+			t.Errorf("loop %q; expected nesting level %d, got %d", loop, i, got)
+		}
+	}
+	if len(nest.Nodes) != 3 || len(nest.Levels) != 3 {
+		t.Errorf("expected 3 loops in nest, got %v", nest.Nodes)
+	}
+
+	// No loop nests without nested loops.
+	prims, err = restructure("testdata/bar.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loopNests(prims); len(got) != len(prims) {
+		t.Errorf("unexpected loop nest in %q; got %v", "testdata/bar.dot", got[len(prims):])
+	}
+}
+
+func TestReverse(t *testing.T) {
+	defer func(old bool) { flagReverse = old }(flagReverse)
+	flagReverse = true
+	prims, err := restructure("testdata/foo.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Primitive{
+		{Primitive: &primitive.Primitive{Node: "list0", Prim: "list", Nodes: map[string]string{"A": "G", "B": "F"}}},
+		{Primitive: &primitive.Primitive{Node: "if0", Prim: "if", Nodes: map[string]string{"A": "H", "B": "list0", "C": "E"}}},
+	}
+	if len(prims) != len(want) {
+		t.Fatalf("primitive count mismatch; expected %d, got %d", len(want), len(prims))
+	}
+	for i, prim := range prims {
+		if !reflect.DeepEqual(prim.Primitive, want[i].Primitive) {
+			t.Errorf("primitive %d mismatch; expected %v, got %v", i, want[i].Primitive, prim.Primitive)
+		}
+	}
+
+	// Several exit nodes.
+	if _, err := restructure("testdata/dispatch.dot"); err == nil {
+		t.Errorf("expected error for graph with several exit nodes, got nil")
+	}
+	// Exit node unreachable from an infinite loop.
+	graph, err := FromEdges("E", []string{"E", "L", "X"}, [][2]string{{"E", "L"}, {"E", "X"}, {"L", "L"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reverseGraph(graph); err == nil {
+		t.Errorf("expected error for exit node unreachable from infinite loop, got nil")
+	}
+}
+
+func TestScore(t *testing.T) {
+	defer func(old bool) { flagQuiet = old }(flagQuiet)
+	flagQuiet = true
+	got := score([]string{"testdata/foo.dot", "testdata/irreducible.dot", "testdata/nonexistent.dot"})
+	want := &qualityScore{
+		Graphs:          2,
+		Reduced:         1,
+		Failed:          1,
+		ReducedFraction: 0.5,
+		MeanRatio:       0.25,
+		Score:           0.5,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("score mismatch; expected %+v, got %+v", want, got)
+	}
+}
+
+func TestPrimitiveUsage(t *testing.T) {
+	defer func(old bool) { flagQuiet = old }(flagQuiet)
+	flagQuiet = true
+	defer useSubs(t, "if.dot", "list.dot", "pre_loop.dot")()
+	got := primitiveUsage([]string{"testdata/foo.dot", "testdata/nonexistent.dot"})
+	want := &primUsage{
+		Graphs: 1,
+		Failed: 1,
+		Counts: map[string]int{"if": 1, "list": 1, "pre_loop": 0},
+		Unused: []string{"pre_loop"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("usage mismatch; expected %+v, got %+v", want, got)
+	}
+	if Progress != nil {
+		t.Errorf("progress hook not restored")
+	}
+}
+
+func TestExceptionEdges(t *testing.T) {
+	defer func(old string) { flagExceptionEdges = old }(flagExceptionEdges)
+	flagExceptionEdges = "handlers.json"
+	checkGolden(t, "testdata/try.dot")
+	// The regions are the first list0 and the second list1 of the primitives.
+	region, handlerRegion := 0, 3
+	want := []*Handler{{Node: "B", Handler: "H", Region: "list0", RegionStep: &region, HandlerRegion: "list1", HandlerRegionStep: &handlerRegion}}
+	if got := Handlers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("handler mismatch; expected %v, got %v", want, got)
+	}
+}
+
+func TestDecodePrimitives(t *testing.T) {
+	defer func(old string) { flagFormat = old }(flagFormat)
+	flagFormat = "gob"
+	want, err := restructure("testdata/bar.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := writeOutput(buf, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodePrimitives(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotBuf, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBuf, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotBuf, wantBuf) {
+		t.Errorf("primitive mismatch; expected %s, got %s", wantBuf, gotBuf)
+	}
+}
+
+func TestDecodeProtoPrimitives(t *testing.T) {
+	defer func(old string) { flagFormat = old }(flagFormat)
+	defer func(old bool) { flagWithShape = old }(flagWithShape)
+	defer func(old bool) { flagWithPorts = old }(flagWithPorts)
+	defer func(old bool) { flagSortOutput = old }(flagSortOutput)
+	flagFormat = "protobuf"
+	flagWithShape = true
+	flagWithPorts = true
+	flagSortOutput = true
+	want, err := restructure("testdata/bar.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := writeOutput(buf, want); err != nil {
+		t.Fatal(err)
+	}
+	// Order is recorded by sorting the output.
+	want = sortPrims(want)
+	got, err := DecodeProtoPrimitives(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotBuf, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBuf, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotBuf, wantBuf) {
+		t.Errorf("primitive mismatch; expected %s, got %s", wantBuf, gotBuf)
+	}
+}
+
+func TestVerifyPrims(t *testing.T) {
+	prims, err := restructure("testdata/try.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyPrims(prims); err != nil {
+		t.Errorf("unexpected error; %v", err)
+	}
+	cyclic := []*Primitive{
+		{Primitive: &primitive.Primitive{Prim: "list", Node: "list0", Nodes: map[string]string{"A": "E", "B": "if0"}}},
+		{Primitive: &primitive.Primitive{Prim: "if", Node: "if0", Nodes: map[string]string{"A": "list0", "B": "F", "C": "G"}}},
+	}
+	err = verifyPrims(cyclic)
+	if err == nil {
+		t.Fatalf("expected cycle error, got nil")
+	}
+	if want := "list0 -> if0 -> list0"; !strings.Contains(err.Error(), want) {
+		t.Errorf("cycle mismatch; expected %q in %q", want, err)
+	}
+}
+
+func TestFromEdges(t *testing.T) {
+	nodes := []string{"E", "F", "G", "H"}
+	edges := [][2]string{{"E", "F"}, {"E", "H"}, {"F", "G"}, {"G", "H"}}
+	graph, err := FromEdges("E", nodes, edges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Restructure(graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := restructure("testdata/foo.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if canonical(got) != canonical(want) {
+		t.Errorf("primitive mismatch; expected %q, got %q", canonical(want), canonical(got))
+	}
+
+	if _, err := FromEdges("X", nodes, edges); err == nil {
+		t.Errorf("expected error for missing entry node, got nil")
+	}
+	if _, err := FromEdges("E", nodes, append(edges, [2]string{"G", "X"})); err == nil {
+		t.Errorf("expected error for undeclared node, got nil")
+	}
+}
+
+func TestProgress(t *testing.T) {
+	defer func(old func(step, remaining int, prim *Primitive)) { Progress = old }(Progress)
+	var got []string
+	Progress = func(step, remaining int, prim *Primitive) {
+		got = append(got, fmt.Sprintf("%d:%d:%s", step, remaining, prim.Prim))
+	}
+	if _, err := restructure("testdata/foo.dot"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"0:3:list", "1:1:if"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("progress mismatch; expected %q, got %q", want, got)
+	}
+}
+
+func TestProgressLine(t *testing.T) {
+	defer func(old *progressLine, callback func(step, remaining int, prim *Primitive)) {
+		progress, Progress = old, callback
+	}(progress, Progress)
+	buf := &bytes.Buffer{}
+	progress = newProgressLine(buf)
+	Progress = progress.update
+	// The line is terminated once the reduction fails, before the error is
+	// reported, also when nodes remain.
+	defer func(old string, quiet bool) { flagDot, flagQuiet = old, quiet }(flagDot, flagQuiet)
+	flagDot = `digraph g { X -> A; A -> B; A -> C; B -> C; C -> B; X [label="entry"] }`
+	flagQuiet = true
+	if _, err := restructure(dotFlagPath); err == nil {
+		t.Fatal("expected error for irreducible graph, got nil")
+	}
+	if got, want := buf.String(), "\rstep 1: located \"list\"; 3 node(s) remaining\n"; got != want {
+		t.Errorf("progress line mismatch; expected %q, got %q", want, got)
+	}
+	// A shorter line clears the remainder of a longer previous line.
+	buf.Reset()
+	progress.update(9, 100, &Primitive{Primitive: &primitive.Primitive{Prim: "pre_loop"}})
+	progress.update(10, 9, &Primitive{Primitive: &primitive.Primitive{Prim: "if"}})
+	progress.end()
+	const want = "\rstep 10: located \"pre_loop\"; 100 node(s) remaining\rstep 11: located \"if\"; 9 node(s) remaining        \n"
+	if got := buf.String(); got != want {
+		t.Errorf("progress line mismatch; expected %q, got %q", want, got)
+	}
+	// The line is terminated once the reduction finishes, also when regions
+	// remain as exceptional edges are ignored.
+	defer func(old string) { flagExceptionEdges = old }(flagExceptionEdges)
+	flagExceptionEdges = "handlers.json"
+	buf.Reset()
+	if _, err := restructure("testdata/try.dot"); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); !strings.HasSuffix(got, "\n") || strings.Count(got, "\n") != 1 {
+		t.Errorf("progress line not terminated once; got %q", got)
+	}
+}
+
+func TestIterate(t *testing.T) {
+	const dotPath = "testdata/foo.dot"
+	graph, err := parseGraph(dotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := Restructure(graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, err = parseGraph(dotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := Iterate(graph)
+	var got []*Primitive
+	for {
+		prim, err, ok := next()
+		if !ok {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%q: unable to iterate primitives; %v", dotPath, err)
+		}
+		got = append(got, prim)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%q: primitive mismatch; expected %v, got %v", dotPath, want, got)
+	}
+
+	// Stop after the first primitive.
+	graph, err = parseGraph(dotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := len(graph.Nodes.Nodes)
+	next = Iterate(graph)
+	if _, err, ok := next(); !ok || err != nil {
+		t.Fatalf("%q: unable to locate first primitive; %v", dotPath, err)
+	}
+	if n := len(graph.Nodes.Nodes); n <= 1 || n >= nodes {
+		t.Errorf("%q: expected partial reduction after first step, got %d of %d node(s) remaining", dotPath, n, nodes)
+	}
+}
+
+func TestIterateFlags(t *testing.T) {
+	defer func(strategy, exclude, exception string, loops, collapse, ret bool) {
+		flagStrategy, flagExcludeNodes, flagExceptionEdges = strategy, exclude, exception
+		flagLoopsOnly, flagCollapseResidual, flagMarkReturn = loops, collapse, ret
+	}(flagStrategy, flagExcludeNodes, flagExceptionEdges, flagLoopsOnly, flagCollapseResidual, flagMarkReturn)
+	// The primitives located by Iterate are those of Restructure, as requested
+	// by the command line flags.
+	golden := []struct {
+		dotPath string
+		set     func()
+	}{
+		{dotPath: "testdata/foo.dot", set: func() { flagStrategy = strategyExhaustive }},
+		{dotPath: "testdata/pad.dot", set: func() { flagExcludeNodes = "P" }},
+		{dotPath: "testdata/try.dot", set: func() { flagExceptionEdges = "handlers.json" }},
+		{dotPath: "testdata/loops_only.dot", set: func() { flagLoopsOnly = true }},
+		{dotPath: "testdata/irreducible.dot", set: func() { flagCollapseResidual = true }},
+		{dotPath: "testdata/mark_return.dot", set: func() { flagMarkReturn = true }},
+	}
+	for _, g := range golden {
+		flagStrategy, flagExcludeNodes, flagExceptionEdges = strategyGreedy, "", ""
+		flagLoopsOnly, flagCollapseResidual, flagMarkReturn = false, false, false
+		g.set()
+		want, err := restructure(g.dotPath)
+		if err != nil {
+			t.Errorf("%q: error; %v", g.dotPath, err)
+			continue
+		}
+		graph, err := parseGraph(g.dotPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := Iterate(graph)
+		var got []*Primitive
+		for {
+			prim, err, ok := next()
+			if !ok {
+				break
+			}
+			if err != nil {
+				t.Errorf("%q: unable to iterate primitives; %v", g.dotPath, err)
+				break
+			}
+			got = append(got, prim)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: primitive mismatch; expected %v, got %v", g.dotPath, want, got)
+		}
+	}
+}
+
+func TestRestructureDryRun(t *testing.T) {
+	defer func(old []Emitter) { emitters = old }(emitters)
+	r := &recorder{}
+	emitters = []Emitter{r}
+	const dotPath = "testdata/bar.dot"
+	graph, err := parseGraph(dotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := &bytes.Buffer{}
+	writeFlatDOT(before, graph)
+	got, err := RestructureDryRun(graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The graph is left unmodified, and no primitive is emitted.
+	after := &bytes.Buffer{}
+	writeFlatDOT(after, graph)
+	if before.String() != after.String() {
+		t.Errorf("%q: graph modified by dry run; expected %q, got %q", dotPath, before, after)
+	}
+	if len(r.names) != 0 {
+		t.Errorf("%q: expected no emitted primitives, got %q", dotPath, r.names)
+	}
+	// The primitives are those of Restructure; the graph remains available
+	// for the reduction itself.
+	want, err := Restructure(graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%q: primitive mismatch; expected %v, got %v", dotPath, want, got)
+	}
+	if len(graph.Nodes.Nodes) != 1 {
+		t.Errorf("%q: expected graph reduced to a single node, got %d node(s)", dotPath, len(graph.Nodes.Nodes))
+	}
+
+	// The copy preserves the node order of graph, which differs from the
+	// order of its edges.
+	defer func(old bool) { flagNodeOrder = old }(flagNodeOrder)
+	flagNodeOrder = true
+	const orderPath = "testdata/node_order.dot"
+	graph, err = parseGraph(orderPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = RestructureDryRun(graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err = Restructure(graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%q: primitive mismatch; expected %v, got %v", orderPath, want, got)
+	}
+}
+
+func TestMergeValidator(t *testing.T) {
+	defer func(old func(graph *dot.Graph, prim *Primitive) error) { MergeValidator = old }(MergeValidator)
+	const dotPath = "testdata/foo.dot"
+
+	// The super-node of each merge is present in the graph, as the only node of
+	// its region.
+	var merged []string
+	MergeValidator = func(graph *dot.Graph, prim *Primitive) error {
+		if _, ok := graph.Nodes.Lookup[prim.Node]; !ok {
+			return fmt.Errorf("super-node %q missing", prim.Node)
+		}
+		for _, name := range prim.Nodes {
+			if _, ok := graph.Nodes.Lookup[name]; ok {
+				return fmt.Errorf("node %q not merged", name)
+			}
+		}
+		merged = append(merged, prim.Node)
+		return nil
+	}
+	prims, err := restructure(dotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"list0", "if0"}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("%q: validated merges mismatch; expected %q, got %q", dotPath, want, merged)
+	}
+	if len(prims) != len(want) {
+		t.Errorf("%q: number of primitives mismatch; expected %d, got %d", dotPath, len(want), len(prims))
+	}
+
+	// A rejected merge aborts the reduction, identifying the failed step.
+	MergeValidator = func(graph *dot.Graph, prim *Primitive) error {
+		if prim.Prim == "if" {
+			return fmt.Errorf("in-degree mismatch")
+		}
+		return nil
+	}
+	check := func(err error) {
+		e, ok := err.(*Error)
+		if !ok || e.Kind != KindValidation {
+			t.Errorf("%q: expected KindValidation error, got %v", dotPath, err)
+			return
+		}
+		const want = `merge validation failed at reduction step 1 (primitive "if" merged into "if0"); in-degree mismatch`
+		if e.Msg != want {
+			t.Errorf("%q: error message mismatch; expected %q, got %q", dotPath, want, e.Msg)
+		}
+	}
+	_, err = restructure(dotPath)
+	check(err)
+
+	// Likewise, when iterating the primitives.
+	graph, err := parseGraph(dotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := Iterate(graph)
+	if _, err, ok := next(); !ok || err != nil {
+		t.Fatalf("%q: unable to locate first primitive; %v", dotPath, err)
+	}
+	_, err, _ = next()
+	check(err)
+	if _, _, ok := next(); ok {
+		t.Errorf("%q: expected iteration to stop after rejected merge", dotPath)
+	}
+
+	// And for the tentative merges of the exhaustive strategy.
+	defer func(old string) { flagStrategy = old }(flagStrategy)
+	flagStrategy = strategyExhaustive
+	_, err = restructure(dotPath)
+	check(err)
+}
+
+func TestPrimHook(t *testing.T) {
+	defer func(old func(p *Primitive, graph *dot.Graph)) { PrimHook = old }(PrimHook)
+	PrimHook = func(p *Primitive, graph *dot.Graph) {
+		if _, ok := graph.Nodes.Lookup[p.entry]; ok {
+			// Name primitives after their original entry node.
+			p.Prim += "_at_" + p.entry
+		}
+		p.Node = "my_" + p.Node
+	}
+	const dotPath = "testdata/foo.dot"
+	prims, err := restructure(dotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, prim := range prims {
+		got = append(got, prim.Prim, prim.Node)
+	}
+	want := []string{"list_at_F", "my_list0", "if_at_E", "my_if0"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%q: primitive mismatch; expected %q, got %q", dotPath, want, got)
+	}
+	// References to renamed super-nodes are renamed accordingly.
+	if name := prims[1].Nodes["B"]; name != "my_list0" {
+		t.Errorf("%q: expected reference to %q, got %q", dotPath, "my_list0", name)
+	}
+	if err := verifyPrims(prims); err != nil {
+		t.Errorf("%q: %v", dotPath, err)
+	}
+}
+
+func TestSearcher(t *testing.T) {
+	defer func(old Searcher) { Matcher = old }(Matcher)
+	var got []string
+	Matcher = SearcherFunc(func(graph *dot.Graph, sub *graphs.SubGraph) (map[string]string, bool) {
+		got = append(got, sub.Name)
+		return iso.Search(graph, sub)
+	})
+	checkGolden(t, "testdata/foo.dot")
+	if len(got) == 0 {
+		t.Errorf("expected searcher to be used")
+	}
+}
+
+func TestRegionEdges(t *testing.T) {
+	defer useSubs(t, "if.dot")()
+	sub := subs[0]
+	const base = `
+	P -> A
+	Q -> A
+	A -> B
+	A -> C
+	B -> C
+	C -> X
+	C -> Y
+	P [label="entry"]
+`
 	golden := []struct {
-		path string
-		want []*primitive.Primitive
+		desc  string
+		edges string
+		want  bool
+	}{
+		{desc: "external in-edges of entry node", want: true},
+		{desc: "external in-edge of body node", edges: "P -> B", want: false},
+		{desc: "external out-edge of body node", edges: "B -> Y", want: false},
+		{desc: "external in-edge of exit node", edges: "Q -> C", want: false},
+	}
+	for _, g := range golden {
+		graph, err := dot.Read([]byte("digraph g {" + base + g.edges + "\n}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Both the default matcher and the local matcher of search apply the
+		// same region semantics.
+		if _, got := iso.Search(graph, sub); got != g.want {
+			t.Errorf("%s: iso.Search match mismatch; expected %v, got %v", g.desc, g.want, got)
+		}
+		m, got := search(graph, sub, newEdgeLabels(graph))
+		if got != g.want {
+			t.Errorf("%s: search match mismatch; expected %v, got %v", g.desc, g.want, got)
+		}
+		if got && (m["A"] != "A" || m["B"] != "B" || m["C"] != "C") {
+			t.Errorf("%s: unexpected node mapping; %v", g.desc, m)
+		}
+	}
+}
+
+func TestWithPorts(t *testing.T) {
+	defer func(old bool) { flagWithPorts = old }(flagWithPorts)
+	flagWithPorts = true
+	golden := []struct {
+		dotPath string
+		want    []*Ports
 	}{
 		{
-			path: "testdata/foo.dot",
-			want: []*primitive.Primitive{
-				{
-					Prim:  "list",
-					Node:  "list0",
-					Nodes: map[string]string{"A": "F", "B": "G"},
-				},
-				{
-					Prim:  "if",
-					Node:  "if0",
-					Nodes: map[string]string{"A": "E", "B": "list0", "C": "H"},
-				},
+			dotPath: "testdata/foo.dot",
+			want: []*Ports{
+				{Preds: []string{"E"}, Succs: []string{"H"}},
+				{},
 			},
 		},
+		// The back edge of the loop enclosing the if_else primitive.
 		{
-			path: "testdata/bar.dot",
-			want: []*primitive.Primitive{
-				{
-					Prim:  "if_else",
-					Node:  "if_else0",
-					Nodes: map[string]string{"A": "F", "B": "G", "C": "H", "D": "I"},
-				},
-				{
-					Prim:  "pre_loop",
-					Node:  "pre_loop0",
-					Nodes: map[string]string{"A": "E", "B": "if_else0", "C": "J"},
-				},
+			dotPath: "testdata/bar.dot",
+			want: []*Ports{
+				{Preds: []string{"E"}, Succs: []string{"E"}},
+				{},
 			},
 		},
 	}
+	for _, g := range golden {
+		prims, err := restructure(g.dotPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []*Ports
+		for _, prim := range prims {
+			got = append(got, prim.Ports)
+		}
+		if !reflect.DeepEqual(got, g.want) {
+			t.Errorf("%q: ports mismatch; expected %v, got %v", g.dotPath, g.want, got)
+		}
+	}
 
-	for i, g := range golden {
-		got, err := restructure(g.path)
+	// Ports recorded by the exhaustive strategy refer to the graph at the time
+	// of the merge.
+	defer useSubs(t, "if_return.dot", "if_else.dot", "list.dot", "pre_loop.dot")()
+	defer func(old string) { flagStrategy = old }(flagStrategy)
+	flagStrategy = strategyExhaustive
+	prims, err := restructure("testdata/exhaustive.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := prims[len(prims)-1]
+	if last.Ports == nil || len(last.Ports.Preds) != 0 || len(last.Ports.Succs) != 0 {
+		t.Errorf("ports of final primitive %q mismatch; expected none, got %v", last.Node, last.Ports)
+	}
+	for _, prim := range prims[:len(prims)-1] {
+		if prim.Ports == nil || len(prim.Ports.Preds)+len(prim.Ports.Succs) == 0 {
+			t.Errorf("ports of primitive %q missing; got %v", prim.Node, prim.Ports)
+		}
+	}
+}
+
+func TestWithEdges(t *testing.T) {
+	defer func(old bool) { flagWithEdges = old }(flagWithEdges)
+	flagWithEdges = true
+	const dotPath = "testdata/foo.dot"
+	graph, err := parseGraph(dotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[[2]string]bool)
+	for _, e := range graph.Edges.Edges {
+		want[[2]string{e.Src, e.Dst}] = true
+	}
+	prims, err := Restructure(graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The consumed edges of the primitives partition the original edges.
+	got := make(map[[2]string]bool)
+	for _, prim := range prims {
+		for _, e := range prim.ConsumedEdges {
+			if got[e] {
+				t.Errorf("%q: edge %q consumed more than once", dotPath, e)
+			}
+			got[e] = true
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%q: consumed edges mismatch; expected %v, got %v", dotPath, want, got)
+	}
+}
+
+func TestInputJSON(t *testing.T) {
+	want, err := restructure("testdata/foo.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old string) { flagInput = old }(flagInput)
+	flagInput = inputJSON
+	const jsonPath = "testdata/foo.cfg.json"
+	got, err := restructure(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%q: primitive mismatch; expected %v, got %v", jsonPath, want, got)
+	}
+	if _, err := parseJSONGraph([]byte(`{"nodes": [{"name": "A"}], "edges": [{"src": "A", "dst": "B"}]}`)); err == nil {
+		t.Errorf("expected error for undeclared node, got nil")
+	}
+}
+
+func TestNodeOrder(t *testing.T) {
+	defer func(old, with bool) { flagNodeOrder, flagWithEdges = old, with }(flagNodeOrder, flagWithEdges)
+	flagNodeOrder, flagWithEdges = true, true
+	checkGolden(t, "testdata/node_order.dot")
+	// The node order of a JSON control flow graph is the order of its nodes,
+	// regardless of the order of its edges.
+	defer func(old string) { flagInput = old }(flagInput)
+	flagInput = inputJSON
+	checkGoldenFile(t, "testdata/node_order.cfg.json", "testdata/node_order.json")
+}
+
+func TestWithShape(t *testing.T) {
+	defer func(old bool) { flagWithShape = old }(flagWithShape)
+	flagWithShape = true
+	prims, err := restructure("testdata/foo.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Shape{
+		Entry: "A",
+		Exit:  "C",
+		Nodes: []string{"A", "B", "C"},
+		Edges: [][2]string{{"A", "B"}, {"A", "C"}, {"B", "C"}},
+	}
+	if got := prims[1].Shape; !reflect.DeepEqual(got, want) {
+		t.Errorf("shape mismatch; expected %v, got %v", want, got)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restructure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archivePath := filepath.Join(dir, "cfgs.zip")
+	f, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	entries := map[string]string{
+		"cfgs/foo.dot":             "testdata/foo.dot",
+		"cfgs/sub/irreducible.dot": "testdata/irreducible.dot",
+		"cfgs/foo.cfg.json":        "testdata/foo.cfg.json",
+		"cfgs/README":              "testdata/foo.json",
+	}
+	for name, src := range entries {
+		buf, err := ioutil.ReadFile(src)
 		if err != nil {
-			t.Errorf("i=%d: error; %v", i, err)
+			t.Fatal(err)
+		}
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := restructureArchive(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(results); n != 2 {
+		t.Errorf("result count mismatch; expected 2, got %d", n)
+	}
+	if r, ok := results["cfgs/foo.dot"]; !ok || len(r.Prims) != 2 {
+		t.Errorf("unexpected result of %q; %v", "cfgs/foo.dot", r)
+	}
+	if r, ok := results["cfgs/sub/irreducible.dot"]; !ok || len(r.Error) == 0 {
+		t.Errorf("unexpected result of %q; %v", "cfgs/sub/irreducible.dot", r)
+	}
+
+	// Entries are parsed like control flow graphs given on the command line.
+	defer func(old bool) { flagReverse = old }(flagReverse)
+	flagReverse = true
+	want, err := restructure("testdata/foo.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err = restructureArchive(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := results["cfgs/foo.dot"]; !ok || !reflect.DeepEqual(r.Prims, want) {
+		t.Errorf("unexpected result of reversed %q; expected %v, got %v", "cfgs/foo.dot", want, r)
+	}
+	flagReverse = false
+	defer func(old string) { flagInput = old }(flagInput)
+	flagInput = inputJSON
+	want, err = restructure("testdata/foo.cfg.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err = restructureArchive(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(results); n != 1 {
+		t.Errorf("result count mismatch; expected 1, got %d", n)
+	}
+	if r, ok := results["cfgs/foo.cfg.json"]; !ok || !reflect.DeepEqual(r.Prims, want) {
+		t.Errorf("unexpected result of %q; expected %v, got %v", "cfgs/foo.cfg.json", want, r)
+	}
+
+	// Output of a single reduction is rejected.
+	defer func(old string) { flagStats = old }(flagStats)
+	flagStats = filepath.Join(dir, "stats.json")
+	if err := checkArchive(); err == nil {
+		t.Errorf("expected error for -archive with -stats, got nil")
+	}
+}
+
+func TestConfidence(t *testing.T) {
+	defer func(old bool) { flagWithConfidence = old }(flagWithConfidence)
+	flagWithConfidence = true
+	prims, err := restructure("testdata/multi_exit.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prim := range prims {
+		want := ConfidenceExact
+		if prim.Prim == multiExitLoop {
+			want = ConfidenceHeuristic
+		}
+		if prim.Confidence != want {
+			t.Errorf("%q: confidence mismatch; expected %q, got %q", prim.Node, want, prim.Confidence)
+		}
+	}
+
+	// Conditionals located at their post-dominator follow node.
+	defer func(old bool) { flagPostdomFollow = old }(flagPostdomFollow)
+	flagPostdomFollow = true
+	prims, err = restructure("testdata/foo.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prim := range prims {
+		want := ConfidenceExact
+		if prim.Prim == "if" {
+			want = ConfidenceHeuristic
+		}
+		if prim.Confidence != want {
+			t.Errorf("%q: confidence mismatch; expected %q, got %q", prim.Node, want, prim.Confidence)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restructure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string, quiet bool) { graphvizDot, flagQuiet = old, quiet }(graphvizDot, flagQuiet)
+	graphvizDot = "restructure-no-such-dot"
+	flagQuiet = true
+	prims, err := restructure("testdata/foo.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgPath := filepath.Join(dir, "foo.png")
+	if err := writeRender(imgPath, prims); err != nil {
+		t.Fatal(err)
+	}
+	// Fall back to the primitive tree in DOT format.
+	got, err := ioutil.ReadFile(imgPath + ".dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &bytes.Buffer{}
+	if err := writePrimTreeDOT(want, prims); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("primitive tree mismatch; expected %q, got %q", want, got)
+	}
+	if _, err := os.Stat(imgPath); !os.IsNotExist(err) {
+		t.Errorf("unexpected image %q; %v", imgPath, err)
+	}
+
+	// Loop nests are not part of the primitive tree.
+	prims, err = restructure("testdata/loop_nest.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nestPath := filepath.Join(dir, "loop_nest.png")
+	if err := writeRender(nestPath, loopNests(prims)); err == nil {
+		t.Errorf("expected error for loop nests, got nil")
+	}
+	if _, err := os.Stat(nestPath + ".dot"); !os.IsNotExist(err) {
+		t.Errorf("unexpected primitive tree %q; %v", nestPath+".dot", err)
+	}
+}
+
+func TestLintPrims(t *testing.T) {
+	defer func(old string) { flagPrimitives = old }(flagPrimitives)
+	flagPrimitives = strings.Join([]string{
+		"primitives/list.dot",
+		"testdata/lint/list3.dot",
+		"testdata/lint/no_entry.dot",
+		"testdata/lint/unreachable.dot",
+		"primitives/if.dot",
+		"primitives/list.dot",
+	}, ",")
+	report, err := lintPrims()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"list", "list3", "if"}
+	if !reflect.DeepEqual(report.Prims, want) {
+		t.Errorf("primitives mismatch; expected %q, got %q", want, report.Prims)
+	}
+	var got []string
+	for _, f := range report.Findings {
+		got = append(got, f.Prim+":"+f.Kind)
+	}
+	want = []string{"no_entry:no-entry", "unreachable:unmatchable", "list:duplicate", "list3:shadowed"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("findings mismatch; expected %q, got %q", want, got)
+	}
+	if f := report.Findings[len(report.Findings)-1]; !reflect.DeepEqual(f.ShadowedBy, []string{"list"}) {
+		t.Errorf("shadowing primitives mismatch; expected %q, got %q", []string{"list"}, f.ShadowedBy)
+	}
+}
+
+func TestFolded(t *testing.T) {
+	defer func(old string) { flagWeightAttr = old }(flagWeightAttr)
+	golden := []struct {
+		weightAttr string
+		want       string
+	}{
+		{want: "root;if0;list0 2\nroot;if0 2\n"},
+		{weightAttr: "weight", want: "root;if0;list0 7.5\nroot;if0 3\n"},
+	}
+	for _, g := range golden {
+		flagWeightAttr = g.weightAttr
+		prims, err := restructure("testdata/weights.dot")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := &bytes.Buffer{}
+		if err := writeFolded(buf, prims); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != g.want {
+			t.Errorf("weight attribute %q: folded stacks mismatch; expected %q, got %q", g.weightAttr, g.want, got)
+		}
+	}
+}
+
+func TestDotFlag(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/foo.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := restructure("testdata/foo.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old string) { flagDot = old }(flagDot)
+	flagDot = string(buf)
+	got, err := restructure(dotFlagPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("primitives mismatch; expected %v, got %v", want, got)
+	}
+	data, err := readInput(dotFlagPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, buf) {
+		t.Errorf("input mismatch; expected %q, got %q", buf, data)
+	}
+}
+
+func TestCollapseResidual(t *testing.T) {
+	defer func(old bool) { flagCollapseResidual = old }(flagCollapseResidual)
+	flagCollapseResidual = true
+	prims, err := restructure("testdata/irreducible.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prims) != 1 {
+		t.Fatalf("expected 1 primitive, got %d", len(prims))
+	}
+	prim := prims[0]
+	if prim.Prim != opaquePrim || prim.Node != "opaque0" {
+		t.Errorf("primitive mismatch; expected %q at %q, got %q at %q", opaquePrim, "opaque0", prim.Prim, prim.Node)
+	}
+	wantNodes := map[string]string{"A": "A", "B": "B", "C": "C"}
+	if !reflect.DeepEqual(prim.Nodes, wantNodes) {
+		t.Errorf("nodes mismatch; expected %v, got %v", wantNodes, prim.Nodes)
+	}
+	wantEdges := [][2]string{{"A", "B"}, {"A", "C"}, {"B", "C"}, {"C", "B"}}
+	if !reflect.DeepEqual(prim.ResidualEdges, wantEdges) {
+		t.Errorf("residual edges mismatch; expected %v, got %v", wantEdges, prim.ResidualEdges)
+	}
+	if got := prim.confidence(); got != ConfidenceHeuristic {
+		t.Errorf("confidence mismatch; expected %q, got %q", ConfidenceHeuristic, got)
+	}
+
+	// Fully reduced graphs are left unaffected.
+	checkGolden(t, "testdata/foo.dot")
+}
+
+func TestPreferLargest(t *testing.T) {
+	defer useSubs(t, "list.dot", "if_else.dot")()
+	defer func(dot string, largest bool) {
+		flagDot, flagPreferLargest = dot, largest
+	}(flagDot, flagPreferLargest)
+	flagDot = `digraph largest {
+	E [label="entry"]
+	E -> A
+	A -> B
+	A -> C
+	B -> D
+	C -> D
+}`
+	golden := []struct {
+		largest bool
+		// Primitives in order of reduction, and the nodes of the first.
+		want  []string
+		nodes []string
+	}{
+		// The list of higher priority is located first, and consumes the
+		// condition of the 2-way conditional.
+		{largest: false, want: []string{"list", "if_else"}, nodes: []string{"A", "E"}},
+		// The 2-way conditional covers more nodes than the list.
+		{largest: true, want: []string{"if_else", "list"}, nodes: []string{"A", "B", "C", "D"}},
+	}
+	for _, g := range golden {
+		flagPreferLargest = g.largest
+		prims, err := restructure(dotFlagPath)
+		if err != nil {
+			t.Errorf("prefer-largest=%v: %v", g.largest, err)
 			continue
 		}
+		var got []string
+		for _, prim := range prims {
+			got = append(got, prim.Prim)
+		}
 		if !reflect.DeepEqual(got, g.want) {
-			t.Errorf("i=%d: primitive mismatch; expected %v, got %v", i, g.want, got)
+			t.Errorf("prefer-largest=%v: primitives mismatch; expected %q, got %q", g.largest, g.want, got)
+		}
+		var nodes []string
+		for _, name := range prims[0].Nodes {
+			nodes = append(nodes, name)
+		}
+		sort.Strings(nodes)
+		if !reflect.DeepEqual(nodes, g.nodes) {
+			t.Errorf("prefer-largest=%v: nodes mismatch; expected %q, got %q", g.largest, g.nodes, nodes)
+		}
+	}
+}
+
+func TestSince(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restructure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	old, cur := filepath.Join(dir, "old.dot"), filepath.Join(dir, "cur.dot")
+	for _, p := range []string{old, cur} {
+		if err := ioutil.WriteFile(p, []byte("digraph f {}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(old, now.Add(-time.Hour), now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	defer func(s, newer string) {
+		flagSince, flagNewerThan = s, newer
+		since = time.Time{}
+	}(flagSince, flagNewerThan)
+	flagSince = now.Add(-time.Minute).Format(time.RFC3339)
+	if err := setSince(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"-", cur, filepath.Join(dir, "missing.dot")}
+	got := changedPaths([]string{"-", old, cur, filepath.Join(dir, "missing.dot")})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("changed paths mismatch; expected %q, got %q", want, got)
+	}
+	flagSince = "yesterday"
+	if err := setSince(); err == nil {
+		t.Errorf("expected error for invalid -since timestamp")
+	}
+
+	// Skip unchanged archive entries.
+	flagSince = ""
+	flagNewerThan = cur
+	if err := setSince(); err != nil {
+		t.Fatal(err)
+	}
+	archivePath := filepath.Join(dir, "cfgs.zip")
+	f, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	buf, err := ioutil.ReadFile("testdata/foo.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, modTime := range map[string]time.Time{"old.dot": now.Add(-time.Hour), "new.dot": now.Add(time.Hour)} {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	results, err := restructureArchive(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := results["new.dot"]; !ok || len(results) != 1 {
+		t.Errorf("unexpected archive results; expected only %q, got %v", "new.dot", results)
+	}
+}
+
+func TestSwitch(t *testing.T) {
+	golden := []string{
+		"testdata/switch/none.dot",
+		"testdata/switch/labeled.dot",
+		"testdata/switch/range.dot",
+		"testdata/switch/bst.dot",
+		"testdata/switch/shared.dot",
+		// Switches nested in loops, with cases breaking out of (or continuing)
+		// the switch, the nearest enclosing loop and an outer loop.
+		"testdata/switch/loop.dot",
+		"testdata/switch/nested_loop.dot",
+	}
+	for _, dotPath := range golden {
+		checkGolden(t, dotPath)
+	}
+}
+
+func TestNamePrefix(t *testing.T) {
+	defer useSubs(t, "if_return.dot", "if_else.dot", "list.dot", "pre_loop.dot")()
+	defer func(strategy, prefix string) {
+		flagStrategy, flagNamePrefix = strategy, prefix
+	}(flagStrategy, flagNamePrefix)
+	flagStrategy = strategyExhaustive
+	flagNamePrefix = "f_"
+	prims, err := restructure("testdata/exhaustive.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, prim := range prims {
+		got = append(got, prim.Node)
+	}
+	want := []string{"f_list0", "f_list1", "f_pre_loop0", "f_list2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("super-node names mismatch; expected %q, got %q", want, got)
+	}
+	if got, want := prims[2].Nodes, map[string]string{"A": "f_list0", "B": "E", "C": "f_list1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("node mapping mismatch; expected %v, got %v", want, got)
+	}
+	if got, want := prims[3].Nodes["B"], "f_pre_loop0"; got != want {
+		t.Errorf("node mapping mismatch; expected %q, got %q", want, got)
+	}
+}
+
+func TestNameOffset(t *testing.T) {
+	defer func(old int) { flagNameOffset = old }(flagNameOffset)
+	flagNameOffset = 1
+	prims, err := restructure("testdata/bar.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*primitive.Primitive{
+		{Prim: "if_else", Node: "if_else1", Nodes: map[string]string{"A": "F", "B": "G", "C": "H", "D": "I"}},
+		{Prim: "pre_loop", Node: "pre_loop1", Nodes: map[string]string{"A": "E", "B": "if_else1", "C": "J"}},
+	}
+	if len(prims) != len(want) {
+		t.Fatalf("number of primitives mismatch; expected %d, got %d", len(want), len(prims))
+	}
+	for i, prim := range prims {
+		if !reflect.DeepEqual(prim.Primitive, want[i]) {
+			t.Errorf("i=%d: primitive mismatch; expected %v, got %v", i, want[i], prim.Primitive)
+		}
+	}
+	if err := verifyPrims(prims); err != nil {
+		t.Errorf("unexpected error; %v", err)
+	}
+}
+
+func TestFindAllPrims(t *testing.T) {
+	defer useSubs(t, "list.dot", "if.dot")()
+	graph, err := parseGraph("testdata/try.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := len(graph.Nodes.Nodes)
+	var got []string
+	for _, prim := range FindAllPrims(graph) {
+		got = append(got, fmt.Sprintf("%s@%s", prim.Prim, prim.entry))
+	}
+	want := []string{"list@A", "list@C", "list@H"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("candidate mismatch; expected %q, got %q", want, got)
+	}
+	if n := len(graph.Nodes.Nodes); n != before {
+		t.Errorf("node count mismatch; expected %d, got %d", before, n)
+	}
+}
+
+func TestFuzzOrder(t *testing.T) {
+	defer useSubs(t, "if_return.dot", "if_else.dot", "list.dot", "pre_loop.dot")()
+	orig := subs
+	// The greedy reduction stalls using the given order (see TestStrategy),
+	// but not using others.
+	const dotPath = "testdata/exhaustive.dot"
+	report, err := fuzzOrder(dotPath, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != len(orig) || subs[0] != orig[0] {
+		t.Errorf("primitive set not restored")
+	}
+	if report.Base.Reduced {
+		t.Errorf("%q: expected order %q to stall", dotPath, report.Base.Order)
+	}
+	if len(report.Differences) == 0 {
+		t.Fatalf("%q: expected orderings which reduce differently", dotPath)
+	}
+	for _, d := range report.Differences {
+		if !d.Reduced || d.Difference != fuzzReducibility || len(d.Fingerprint) == 0 {
+			t.Errorf("%q: unexpected outcome of order %q; reduced=%v, difference=%q, fingerprint=%q", dotPath, d.Order, d.Reduced, d.Difference, d.Fingerprint)
+		}
+	}
+
+	// The reported orderings may be reproduced.
+	d := report.Differences[0]
+	subs, err = reorder(orig, d.Order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prims, err := restructure(dotPath)
+	subs = orig
+	if err != nil {
+		t.Fatalf("%q: order %q; %v", dotPath, d.Order, err)
+	}
+	if got := fingerprint(prims); got != d.Fingerprint {
+		t.Errorf("%q: fingerprint mismatch; expected %q, got %q", dotPath, d.Fingerprint, got)
+	}
+}
+
+func TestStrategy(t *testing.T) {
+	defer useSubs(t, "if_return.dot", "if_else.dot", "list.dot", "pre_loop.dot")()
+	const dotPath = "testdata/exhaustive.dot"
+	if _, err := restructure(dotPath); err == nil {
+		t.Errorf("%q: expected greedy strategy to stall", dotPath)
+	}
+	defer func(old string) { flagStrategy = old }(flagStrategy)
+	flagStrategy = strategyExhaustive
+	checkGolden(t, dotPath)
+}
+
+func TestSpecialNames(t *testing.T) {
+	const dotPath = "testdata/special.dot"
+	checkGolden(t, dotPath)
+
+	// Node names are output unquoted, and survive a JSON round-trip.
+	defer func(complete, edges, order bool) {
+		flagAssertComplete, flagWithEdges, flagNodeOrder = complete, edges, order
+	}(flagAssertComplete, flagWithEdges, flagNodeOrder)
+	flagAssertComplete, flagWithEdges, flagNodeOrder = true, true, true
+	prims, err := restructure(dotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := json.Marshal(prims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []*Primitive
+	if err := json.Unmarshal(buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(prims) {
+		t.Fatalf("%q: number of primitives mismatch after round-trip; expected %d, got %d", dotPath, len(prims), len(got))
+	}
+	for i, prim := range got {
+		if !reflect.DeepEqual(prim.Nodes, prims[i].Nodes) {
+			t.Errorf("%q: node mapping mismatch after round-trip; expected %v, got %v", dotPath, prims[i].Nodes, prim.Nodes)
 		}
 	}
+	want := map[string]string{"A": "0x401000", "B": "a:b", "C": "list0"}
+	if !reflect.DeepEqual(prims[1].Nodes, want) {
+		t.Errorf("%q: node mapping mismatch; expected %v, got %v", dotPath, want, prims[1].Nodes)
+	}
+	if _, ok := prims[1].Positions["a:b"]; !ok {
+		t.Errorf("%q: position of %q missing; got %v", dotPath, "a:b", prims[1].Positions)
+	}
+	edge := [2]string{"node with space", `quote"d`}
+	if len(prims[0].ConsumedEdges) != 1 || prims[0].ConsumedEdges[0] != edge {
+		t.Errorf("%q: consumed edges mismatch; expected %q, got %q", dotPath, [][2]string{edge}, prims[0].ConsumedEdges)
+	}
+
+	// Unquoted names are accepted by -exclude-nodes.
+	defer func(old string) { flagExcludeNodes = old }(flagExcludeNodes)
+	flagExcludeNodes = "a:b"
+	if _, err := restructure(dotPath); err != nil {
+		t.Errorf("%q: unable to exclude node %q; %v", dotPath, "a:b", err)
+	}
+	flagExcludeNodes = ""
+
+	// The nested dump of the graph is valid DOT.
+	defer func(old string, nested bool) {
+		flagDumpGraph, flagDumpGraphNested = old, nested
+	}(flagDumpGraph, flagDumpGraphNested)
+	flagDumpGraph, flagDumpGraphNested = "-", true
+	if _, err := restructure(dotPath); err != nil {
+		t.Fatal(err)
+	}
+	dump := &bytes.Buffer{}
+	if err := writeNestedDOT(dump, dumped.orig, dumped.prims); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dot.Read(dump.Bytes()); err != nil {
+		t.Errorf("%q: unable to parse nested dump; %v", dotPath, err)
+	}
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"decomp.org/x/graphs/primitive"
+	"github.com/mewfork/dot"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// returnPrim is the name of the return primitive.
+//
+// A return is the single terminal node of a control flow graph; i.e. the only
+// node without successors, such as the return block of a function with a
+// single exit. As requested by the "-mark-return" flag, the terminal node is
+// merged into a super-node of its own prior to the reduction, so that the
+// primitives enclosing the return block refer to the return primitive, and the
+// structured output explicitly marks where the function ends. Graphs with
+// several terminal nodes (or none, e.g. an infinite loop) have no return
+// primitive.
+//
+// In the node mapping of the primitive, the terminal node is mapped to "A".
+const returnPrim = "return"
+
+// findReturn locates the single terminal node of graph and merges it into a
+// single node. It returns nil if graph has no single terminal node.
+func findReturn(graph *dot.Graph, labels edgeLabels) (*Primitive, error) {
+	var terminal *dot.Node
+	for _, node := range graph.Nodes.Nodes {
+		if len(node.Succs) > 0 {
+			continue
+		}
+		if terminal != nil {
+			// Several terminal nodes.
+			return nil, nil
+		}
+		terminal = node
+	}
+	if terminal == nil {
+		return nil, nil
+	}
+	m := map[string]string{"A": terminal.Name}
+	name, err := mergeRegion(graph, []string{terminal.Name}, returnPrim)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	labels.merge(m, name)
+	prim := &Primitive{
+		Primitive: &primitive.Primitive{
+			Node:  name,
+			Prim:  returnPrim,
+			Nodes: m,
+		},
+		entry: terminal.Name,
+		exit:  terminal.Name,
+	}
+	return prim, nil
+}
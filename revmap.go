@@ -0,0 +1,35 @@
+package main
+
+// An Owner identifies the control flow primitive which directly contains a
+// node of the original control flow graph, as listed by the reverse map of the
+// "-reverse-map" flag.
+type Owner struct {
+	// Node name of the primitive; i.e. the name of its super-node.
+	Node string `json:"node"`
+	// Primitive name.
+	Prim string `json:"prim"`
+}
+
+// reverseMap returns the reverse mapping from the name of each node of the
+// original control flow graph covered by the given primitives to the primitive
+// which directly contains it; i.e. the innermost primitive, the node mapping of
+// which references the node itself rather than the super-node of an enclosing
+// primitive.
+func reverseMap(prims []*Primitive) map[string]*Owner {
+	supers := make(map[string]bool)
+	for _, prim := range prims {
+		supers[prim.Node] = true
+	}
+	owners := make(map[string]*Owner)
+	for _, prim := range prims {
+		for _, name := range prim.Nodes {
+			if supers[name] {
+				continue
+			}
+			if _, ok := owners[name]; !ok {
+				owners[name] = &Owner{Node: prim.Node, Prim: prim.Prim}
+			}
+		}
+	}
+	return owners
+}
@@ -0,0 +1,40 @@
+package main
+
+import "sort"
+
+// A rewrite is a graph-rewrite rule applied by a reduction step; the subgraph
+// matching a pattern at the given nodes is replaced with a single node.
+type rewrite struct {
+	// Index of the reduction step, starting at 0.
+	Step int `json:"step"`
+	// Name of the pattern (i.e. the control flow primitive).
+	Pattern string `json:"pattern"`
+	// Matched nodes, in sorted order.
+	Match []string `json:"match"`
+	// Binding maps from node role of the pattern to matched node.
+	Binding map[string]string `json:"binding"`
+	// Name of the node replacing the matched nodes.
+	Replacement string `json:"replacement"`
+}
+
+// rewrites returns the reduction of the given control flow primitives, as a
+// sequence of graph-rewrite rules in the order applied.
+func rewrites(prims []*Primitive) []*rewrite {
+	rs := make([]*rewrite, 0, len(prims))
+	for i, prim := range prims {
+		var match []string
+		for _, name := range prim.Nodes {
+			match = append(match, name)
+		}
+		sort.Strings(match)
+		r := &rewrite{
+			Step:        i,
+			Pattern:     prim.Prim,
+			Match:       match,
+			Binding:     prim.Nodes,
+			Replacement: prim.Node,
+		}
+		rs = append(rs, r)
+	}
+	return rs
+}
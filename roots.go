@@ -0,0 +1,34 @@
+package main
+
+import "fmt"
+
+// primRoots returns the super-node names of the root primitives of the given
+// control flow primitives, in the order located; i.e. of the primitives not
+// nested within any other primitive.
+func primRoots(prims []*Primitive) []string {
+	var roots []string
+	for _, n := range primTree(prims) {
+		if n.parent == nil {
+			roots = append(roots, n.prim.Node)
+		}
+	}
+	return roots
+}
+
+// checkSingleRoot validates that the given control flow primitives of a fully
+// reduced control flow graph form a single primitive tree, as requested by the
+// "-assert-single-root" flag; i.e. that exactly one primitive (the final
+// super-node) is not nested within any other primitive, and every primitive is
+// thus reachable from it. Several disconnected roots indicate a reduction bug
+// or a disconnected input, and are reported as an error of kind KindRoots.
+func checkSingleRoot(prims []*Primitive) error {
+	if len(prims) == 0 {
+		// A single-node graph has no primitives.
+		return nil
+	}
+	roots := primRoots(prims)
+	if len(roots) != 1 {
+		return &Error{Kind: KindRoots, Msg: fmt.Sprintf("primitives form %d disconnected trees with roots %q; expected a single root", len(roots), roots)}
+	}
+	return nil
+}
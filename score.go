@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// qualityScore is the aggregate recovery-quality report of a corpus of control
+// flow graphs, as requested by the "-score" flag. It condenses the recovery
+// metrics of each graph (see recoveryStats) into comparable numbers, e.g. to
+// measure the effect of changes to a custom primitive set.
+type qualityScore struct {
+	// Number of control flow graphs scored.
+	Graphs int `json:"graphs"`
+	// Number of control flow graphs fully reduced into a single node.
+	Reduced int `json:"reduced"`
+	// Number of control flow graphs which could not be reduced at all (e.g. as
+	// they could not be parsed); these are not scored.
+	Failed int `json:"failed"`
+	// Fraction of the scored control flow graphs which were fully reduced.
+	ReducedFraction float64 `json:"reduced_fraction"`
+	// Mean reduction ratio (see recoveryStats) of the scored control flow
+	// graphs.
+	MeanRatio float64 `json:"mean_ratio"`
+	// Overall score in the range [0, 1]; the mean completeness of the
+	// reductions, where the completeness of a reduction of n nodes into r
+	// nodes is (n-r)/(n-1), and 1 for a graph of a single node.
+	Score float64 `json:"score"`
+}
+
+// score restructures each of the given control flow graphs and returns the
+// aggregate recovery-quality report of the reductions. Stalled reductions are
+// scored by the primitives located before they stalled, while control flow
+// graphs which may not be restructured at all are skipped with a warning.
+func score(dotPaths []string) *qualityScore {
+	q := &qualityScore{}
+	var ratios, completeness float64
+	for _, dotPath := range dotPaths {
+		_, err := restructure(dotPath)
+		if stats == nil {
+			warnf("score-skip", nil, "skipping %q; %v", dotPath, err)
+			q.Failed++
+			continue
+		}
+		q.Graphs++
+		if stats.Remaining == 1 {
+			q.Reduced++
+		}
+		ratios += stats.Ratio
+		if stats.Nodes > 1 {
+			completeness += float64(stats.Nodes-stats.Remaining) / float64(stats.Nodes-1)
+		} else {
+			completeness++
+		}
+	}
+	if q.Graphs > 0 {
+		n := float64(q.Graphs)
+		q.ReducedFraction = float64(q.Reduced) / n
+		q.MeanRatio = ratios / n
+		q.Score = completeness / n
+	}
+	return q
+}
+
+// writeScore writes the given recovery-quality report as JSON to w.
+func writeScore(w io.Writer, q *qualityScore) error {
+	buf, err := json.MarshalIndent(q, "", "\t")
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	_, err = w.Write(buf)
+	return err
+}
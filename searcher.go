@@ -0,0 +1,42 @@
+package main
+
+import (
+	"decomp.org/x/graphs"
+	"decomp.org/x/graphs/iso"
+	"github.com/mewfork/dot"
+)
+
+// A Searcher locates isomorphisms of control flow primitives in control flow
+// graphs.
+type Searcher interface {
+	// Search locates an isomorphism of sub in graph, and returns a mapping from
+	// sub node name to graph node name.
+	Search(graph *dot.Graph, sub *graphs.SubGraph) (map[string]string, bool)
+}
+
+// Matcher is the searcher used to locate the primitives of the reduction. It
+// defaults to iso.Search, and may be replaced to experiment with alternative
+// matching algorithms. Primitives with labeled edges are always located by the
+// local matcher of search, as the labels of edges between super-nodes are not
+// tracked by the graph. The exhaustive strategy enumerates the matches of each
+// reduction step using the local matcher, and does not use Matcher.
+var Matcher Searcher = SearcherFunc(iso.Search)
+
+// A MismatchSearcher is a Searcher which also reports why no isomorphism was
+// located, in explain mode and when mismatches are recorded (see Mismatch).
+// Unless Matcher implements MismatchSearcher, the reasons are determined by the
+// local matcher of search.
+type MismatchSearcher interface {
+	Searcher
+	// Mismatch returns the furthest point of mismatch of the search for an
+	// isomorphism of sub in graph, or nil if an isomorphism exists.
+	Mismatch(graph *dot.Graph, sub *graphs.SubGraph) *Mismatch
+}
+
+// SearcherFunc adapts an ordinary function to the Searcher interface.
+type SearcherFunc func(graph *dot.Graph, sub *graphs.SubGraph) (map[string]string, bool)
+
+// Search returns f(graph, sub).
+func (f SearcherFunc) Search(graph *dot.Graph, sub *graphs.SubGraph) (map[string]string, bool) {
+	return f(graph, sub)
+}
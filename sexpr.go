@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// writeSexpr writes the primitive tree of the given control flow primitives to
+// w, as S-expressions; one line per root primitive, in the order located. Each
+// primitive is written as a list with the primitive type as operator and the
+// nodes of its roles, in sorted role order, as operands; a nested primitive is
+// written as a nested S-expression, and a node of the original control flow
+// graph as its name, e.g.
+//
+//    (if E (list F G) H)
+//
+// Node names which are not valid symbols (e.g. as they contain whitespace or
+// parentheses) are written as quoted strings.
+func writeSexpr(w io.Writer, prims []*Primitive) error {
+	nodes := primTree(prims)
+	if err := checkDepth(nodes); err != nil {
+		return err
+	}
+	// exprs maps from primitive tree node to its S-expression. Nested
+	// primitives precede the primitives in which they are nested, so the
+	// S-expressions are built bottom-up without recursion.
+	exprs := make(map[*primNode]string)
+	for _, n := range nodes {
+		buf := &bytes.Buffer{}
+		buf.WriteString("(")
+		buf.WriteString(sexprAtom(n.prim.Prim))
+		for _, role := range n.roles() {
+			buf.WriteString(" ")
+			if child, ok := n.children[role]; ok {
+				buf.WriteString(exprs[child])
+				continue
+			}
+			buf.WriteString(sexprAtom(n.prim.Nodes[role]))
+		}
+		buf.WriteString(")")
+		exprs[n] = buf.String()
+	}
+	for _, n := range nodes {
+		if n.parent != nil {
+			continue
+		}
+		if _, err := fmt.Fprintln(w, exprs[n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sexprAtom returns the given name as an S-expression atom; as a symbol if
+// valid, and as a quoted string otherwise.
+func sexprAtom(name string) string {
+	if len(name) == 0 || strings.ContainsAny(name, " \t\r\n()[]{}\";'`,|#\\") {
+		return strconv.Quote(name)
+	}
+	return name
+}
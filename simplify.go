@@ -0,0 +1,197 @@
+package main
+
+import (
+	"sort"
+
+	"decomp.org/x/graphs/primitive"
+)
+
+// listPrim is the name of the sequence primitive.
+const listPrim = "list"
+
+// simplify returns the given control flow primitives with redundant nestings
+// folded, as requested by the "-simplify" flag. The primitives are expected to
+// be ordered as located by restructure, and are not modified. The following
+// rule is applied, innermost nesting first:
+//
+//    1. A list nested within a list is inlined; the nodes of the nested list
+//       replace the role of the nested list in the enclosing list, in order,
+//       and the nested list is removed. As sequencing is associative, the
+//       enclosing list covers the same nodes in the same order.
+//
+// The roles of the enclosing list are renumbered as "A", "B", "C", etc., in
+// sequence order, and its label sets and shape are updated accordingly. The
+// carried attributes, node positions, consumed edges and label sets of the
+// nested list are merged into the enclosing list. The weight and ports of the
+// enclosing list are unchanged, as it covers the same region.
+func simplify(prims []*Primitive) []*Primitive {
+	// Copy the primitives, so that the original ones are not modified.
+	cp := make([]*Primitive, len(prims))
+	for i, prim := range prims {
+		p := *prim
+		p.Primitive = &primitive.Primitive{
+			Node:  prim.Node,
+			Prim:  prim.Prim,
+			Nodes: make(map[string]string),
+		}
+		for role, name := range prim.Nodes {
+			p.Nodes[role] = name
+		}
+		// The maps updated by mergeAnnotations are copied as well.
+		if prim.Attrs != nil {
+			p.Attrs = make(map[string]map[string]string)
+			for name, attrs := range prim.Attrs {
+				p.Attrs[name] = attrs
+			}
+		}
+		if prim.Positions != nil {
+			p.Positions = make(map[string]int)
+			for name, pos := range prim.Positions {
+				p.Positions[name] = pos
+			}
+		}
+		cp[i] = &p
+	}
+	removed := make(map[*Primitive]bool)
+	for _, n := range primTree(cp) {
+		if n.prim.Prim != listPrim {
+			continue
+		}
+		inlined := false
+		for _, child := range n.children {
+			if child.prim.Prim == listPrim {
+				inlined = true
+			}
+		}
+		if !inlined {
+			continue
+		}
+		old := n.prim.Nodes
+		// nested maps from super-node name to the inlined list.
+		nested := make(map[string]*Primitive)
+		var members []string
+		for i, name := range sequence(n.prim) {
+			child, ok := n.children[role(i)]
+			if !ok || child.prim.Prim != listPrim {
+				members = append(members, name)
+				continue
+			}
+			members = append(members, sequence(child.prim)...)
+			mergeAnnotations(n.prim, child.prim)
+			nested[name] = child.prim
+			removed[child.prim] = true
+		}
+		n.prim.Nodes = make(map[string]string)
+		for i, name := range members {
+			n.prim.Nodes[role(i)] = name
+		}
+		renumberList(n.prim, old, nested)
+	}
+	var simplified []*Primitive
+	for _, prim := range cp {
+		if !removed[prim] {
+			simplified = append(simplified, prim)
+		}
+	}
+	return simplified
+}
+
+// sequence returns the node names of the given list primitive, in sequence
+// order; i.e. in the order of the roles "A", "B", "C", etc.
+func sequence(prim *Primitive) []string {
+	var names []string
+	for i := 0; ; i++ {
+		name, ok := prim.Nodes[role(i)]
+		if !ok {
+			return names
+		}
+		names = append(names, name)
+	}
+}
+
+// renumberList updates the label sets and shape of the given list primitive,
+// the roles of which have been renumbered after inlining the nested lists,
+// which map from super-node name to list. The old node mapping of the list is
+// given by old. An edge into or out of a nested list is an edge into its first
+// or out of its last node, respectively.
+func renumberList(prim *Primitive, old map[string]string, nested map[string]*Primitive) {
+	// roles maps from node name to renumbered role.
+	roles := make(map[string]string)
+	for role, name := range prim.Nodes {
+		roles[name] = role
+	}
+	sets := make(map[[2]string]*LabelSet)
+	var edges [][2]string
+	add := func(src, dst string, labels []string) {
+		e := [2]string{roles[src], roles[dst]}
+		if _, ok := sets[e]; !ok {
+			edges = append(edges, e)
+		}
+		sets[e] = &LabelSet{Edge: e, Labels: labels}
+	}
+	for _, set := range prim.Labels {
+		src, dst := old[set.Edge[0]], old[set.Edge[1]]
+		if list, ok := nested[src]; ok {
+			seq := sequence(list)
+			src = seq[len(seq)-1]
+		}
+		if list, ok := nested[dst]; ok {
+			dst = sequence(list)[0]
+		}
+		add(src, dst, set.Labels)
+	}
+	for _, list := range nested {
+		for _, set := range list.Labels {
+			add(list.Nodes[set.Edge[0]], list.Nodes[set.Edge[1]], set.Labels)
+		}
+	}
+	sort.Sort(edgesByName(edges))
+	prim.Labels = nil
+	for _, e := range edges {
+		prim.Labels = append(prim.Labels, sets[e])
+	}
+	if prim.Shape != nil {
+		prim.Shape = listShape(len(prim.Nodes))
+	}
+}
+
+// listShape returns the shape of a list of n nodes, the roles of which are "A",
+// "B", "C", etc., in sequence order.
+func listShape(n int) *Shape {
+	shape := &Shape{Entry: role(0), Exit: role(n - 1)}
+	for i := 0; i < n; i++ {
+		shape.Nodes = append(shape.Nodes, role(i))
+		if i > 0 {
+			shape.Edges = append(shape.Edges, [2]string{role(i - 1), role(i)})
+		}
+	}
+	sort.Strings(shape.Nodes)
+	sort.Sort(edgesByName(shape.Edges))
+	return shape
+}
+
+// mergeAnnotations merges the carried attributes, node positions and consumed
+// edges of the nested primitive into the enclosing primitive, which replaces
+// the nested one.
+func mergeAnnotations(prim, nested *Primitive) {
+	for name, attrs := range nested.Attrs {
+		if prim.Attrs == nil {
+			prim.Attrs = make(map[string]map[string]string)
+		}
+		prim.Attrs[name] = attrs
+	}
+	if prim.Positions != nil {
+		delete(prim.Positions, nested.Node)
+	}
+	for name, pos := range nested.Positions {
+		if prim.Positions == nil {
+			prim.Positions = make(map[string]int)
+		}
+		prim.Positions[name] = pos
+	}
+	// The consumed edges of the nested primitive precede those of the
+	// enclosing one, as they were consumed first.
+	if len(nested.ConsumedEdges) > 0 {
+		prim.ConsumedEdges = append(append([][2]string(nil), nested.ConsumedEdges...), prim.ConsumedEdges...)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// In incremental mode (the "-since" and "-newer-than" flags), input files last
+// modified before a given point in time are skipped without being read; i.e.
+// the given CFG, the CFGs of "-tune", "-score" and "-usage", and the entries
+// of "-archive". Standard input, and files whose modification time cannot be
+// determined, are never skipped. As the check is based on modification times
+// alone, a file which was touched but not changed is restructured again; when
+// combined with "-cache-dir", its primitives are then read from the cache.
+
+// since is the point in time before which input files are considered
+// unchanged, or the zero time if incremental mode is disabled.
+var since time.Time
+
+// setSince sets the point in time of incremental mode, as specified by the
+// "-since" or "-newer-than" flag. The zero time is used if neither is set.
+func setSince() error {
+	switch {
+	case len(flagSince) > 0 && len(flagNewerThan) > 0:
+		return errutil.Newf("-since and -newer-than are mutually exclusive")
+	case len(flagSince) > 0:
+		t, err := time.Parse(time.RFC3339, flagSince)
+		if err != nil {
+			return errutil.Newf("invalid -since timestamp %q; expected RFC 3339 (e.g. %q)", flagSince, "2006-01-02T15:04:05Z")
+		}
+		since = t
+	case len(flagNewerThan) > 0:
+		fi, err := os.Stat(flagNewerThan)
+		if err != nil {
+			return errutil.Err(err)
+		}
+		since = fi.ModTime()
+	default:
+		since = time.Time{}
+	}
+	return nil
+}
+
+// changed reports whether an input last modified at modTime is to be
+// processed in incremental mode.
+func changed(modTime time.Time) bool {
+	return since.IsZero() || !modTime.Before(since)
+}
+
+// changedFile reports whether the given input file is to be processed in
+// incremental mode.
+func changedFile(path string) bool {
+	if since.IsZero() || path == "-" {
+		return true
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		// Report the error when reading the file.
+		return true
+	}
+	if !changed(fi.ModTime()) {
+		if flagVerbose {
+			log.Printf("skipping %q; not modified since %v", path, since.Format(time.RFC3339))
+		}
+		return false
+	}
+	return true
+}
+
+// changedPaths returns the input files of paths to be processed in incremental
+// mode, in order.
+func changedPaths(paths []string) []string {
+	var changed []string
+	for _, path := range paths {
+		if changedFile(path) {
+			changed = append(changed, path)
+		}
+	}
+	return changed
+}
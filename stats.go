@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+// recoveryStats holds the recovery metrics of a call to Restructure, as
+// requested by the "-stats" flag.
+type recoveryStats struct {
+	// Number of nodes of the control flow graph prior to reduction.
+	Nodes int `json:"nodes"`
+	// Number of reduction steps taken; i.e. the number of located primitives,
+	// including those located before a stalled reduction.
+	Steps int `json:"steps"`
+	// Number of nodes remaining after the reduction; 1 if fully reduced.
+	Remaining int `json:"remaining"`
+	// Reduction ratio; the number of located primitives per node of the
+	// control flow graph. A low ratio flags a graph which reduces poorly.
+	Ratio float64 `json:"ratio"`
+	// Super-node name of the single root primitive of a fully reduced graph;
+	// i.e. the primitive within which every other primitive is nested.
+	Root string `json:"root,omitempty"`
+}
+
+// stats holds the recovery metrics of the most recent call to Restructure, or
+// nil if the control flow graph could not be restructured.
+var stats *recoveryStats
+
+// newRecoveryStats returns the recovery metrics of a reduction of nodes nodes
+// into remaining nodes, which located the given primitives.
+func newRecoveryStats(nodes, remaining int, prims []*Primitive) *recoveryStats {
+	s := &recoveryStats{
+		Nodes:     nodes,
+		Steps:     len(prims),
+		Remaining: remaining,
+	}
+	if nodes > 0 {
+		s.Ratio = float64(len(prims)) / float64(nodes)
+	}
+	if remaining == 1 {
+		if roots := primRoots(prims); len(roots) == 1 {
+			s.Root = roots[0]
+		}
+	}
+	return s
+}
+
+// writeStats writes the recovery metrics as JSON to the given path; null if
+// the control flow graph could not be restructured.
+func writeStats(path string) error {
+	buf, err := json.MarshalIndent(stats, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf, 0644)
+}
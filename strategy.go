@@ -0,0 +1,142 @@
+package main
+
+import (
+	"decomp.org/x/graphs"
+	"github.com/mewfork/dot"
+)
+
+// Structuring strategies.
+const (
+	// The greedy strategy merges the first match of the first matching
+	// primitive at each reduction step.
+	strategyGreedy = "greedy"
+	// The exhaustive strategy backtracks over the matches of each reduction
+	// step, to locate a reduction which fully reduces the graph.
+	strategyExhaustive = "exhaustive"
+)
+
+// maxExhaustiveStates specifies the maximum number of reduction states explored
+// by the exhaustive strategy, which bounds its otherwise exponential cost.
+const maxExhaustiveStates = 10000
+
+// A step is a reduction step of the exhaustive strategy.
+type step struct {
+	// Located control flow primitive.
+	prim *Primitive
+	// Number of nodes remaining in the graph after the step.
+	remaining int
+}
+
+// reduceExhaustive searches for a sequence of reduction steps which reduces
+// graph into target nodes, by depth-first search over the matches of each
+// reduction step. The matches of a step are tried in order of primitive in set
+// and entry node in graph, so the greedy reduction is tried first; primitives
+// located without a template are only tried when no template matches, as by
+// the greedy strategy. The graph and labels are left unmodified; on success,
+// the reduction steps and the reduced graph are returned.
+//
+// The search gives up after exploring maxExhaustiveStates reduction states, in
+// which case the boolean return value is false, as it is when no full
+// reduction exists. Each tentative merge is validated by MergeValidator, as
+// reduction step first plus the depth of the merge; the search is aborted if
+// any merge fails validation.
+//
+// As a Searcher locates a single isomorphism, the matches of each step are
+// enumerated by the local matcher of search (see isomorphism), rather than by
+// Matcher; a custom Matcher is thus not used by the exhaustive strategy.
+func reduceExhaustive(graph *dot.Graph, set []*graphs.SubGraph, labels edgeLabels, target, first int) ([]*step, *dot.Graph, bool, error) {
+	states := 0
+	var steps []*step
+	// Error of the first merge which failed validation.
+	var invalid error
+	var visit func(g *dot.Graph, labels edgeLabels) (*dot.Graph, bool)
+	visit = func(g *dot.Graph, labels edgeLabels) (*dot.Graph, bool) {
+		if len(g.Nodes.Nodes) <= target {
+			return g, true
+		}
+		states++
+		if states > maxExhaustiveStates {
+			return nil, false
+		}
+		// try reduces a copy of g using the given reduction, and continues the
+		// search from the reduced graph.
+		try := func(reduce func(c *dot.Graph, l edgeLabels) (*Primitive, error)) (*dot.Graph, bool) {
+			c, err := cloneGraph(g)
+			if err != nil {
+				return nil, false
+			}
+			l := labels.clone()
+			prim, err := reduce(c, l)
+			if err != nil || prim == nil {
+				return nil, false
+			}
+			if err := validateMerge(c, prim, first+len(steps)); err != nil {
+				invalid = err
+				return nil, false
+			}
+			recordPorts(c, prim)
+			steps = append(steps, &step{prim: prim, remaining: len(c.Nodes.Nodes)})
+			if final, ok := visit(c, l); ok {
+				return final, true
+			}
+			steps = steps[:len(steps)-1]
+			return nil, false
+		}
+		matched := false
+		// The post-dominator tree is shared by the matches of the step.
+		pt := newPostdomTree(g)
+		for _, sub := range set {
+			for _, node := range g.Nodes.Nodes {
+				m, ok := isomorphism(g, node, sub, labels, nil)
+				if !ok {
+					continue
+				}
+				if flagPostdomFollow && isConditional(sub) && !pt.followAgrees(sub, m) {
+					continue
+				}
+				matched = true
+				sub := sub
+				final, ok := try(func(c *dot.Graph, l edgeLabels) (*Primitive, error) {
+					empty := emptyBranch(sub, m, l)
+					sets := parallelLabels(m, l)
+					node, err := mergePrim(c, m, sub)
+					if err != nil {
+						return nil, err
+					}
+					l.merge(m, node)
+					prim := newPrimitive(sub, m, node)
+					prim.EmptyBranch = empty
+					prim.Labels = sets
+					prim.heuristic = flagPostdomFollow && isConditional(sub)
+					return prim, nil
+				})
+				if ok {
+					return final, true
+				}
+				if states > maxExhaustiveStates || invalid != nil {
+					return nil, false
+				}
+			}
+		}
+		if matched {
+			return nil, false
+		}
+		for _, f := range activeRegionFinders() {
+			if final, ok := try(f.find); ok {
+				return final, true
+			}
+			if invalid != nil {
+				return nil, false
+			}
+		}
+		return nil, false
+	}
+	final, ok := visit(graph, labels)
+	if invalid != nil {
+		return nil, nil, false, invalid
+	}
+	if !ok {
+		return nil, nil, false, nil
+	}
+	return steps, final, true, nil
+}
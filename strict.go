@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"decomp.org/x/graphs"
+	"github.com/mewfork/dot"
+)
+
+// printStallReport prints a failure report of a stalled reduction to w, as
+// requested by the "-strict" flag; the number of reduction steps taken, the
+// primitives tried, in order (those of set, followed by those of the region
+// finders of the reduction), and the nodes and edges of the residual graph.
+func printStallReport(w io.Writer, graph *dot.Graph, set []*graphs.SubGraph, steps int) {
+	fmt.Fprintf(w, "Unable to locate control flow primitive in %q after %d reduction step(s).\n", graph.Name, steps)
+	var names []string
+	seen := make(map[string]bool)
+	for _, sub := range set {
+		if !seen[sub.Name] {
+			seen[sub.Name] = true
+			names = append(names, sub.Name)
+		}
+	}
+	for _, f := range activeRegionFinders() {
+		if !seen[f.prim] {
+			seen[f.prim] = true
+			names = append(names, f.prim)
+		}
+	}
+	fmt.Fprintf(w, "Primitives tried: %s\n", strings.Join(names, ", "))
+	var nodes []string
+	for _, node := range graph.Nodes.Nodes {
+		nodes = append(nodes, node.Name)
+	}
+	fmt.Fprintf(w, "Residual nodes (%d): %s\n", len(nodes), strings.Join(nodes, ", "))
+	var edges []string
+	for _, e := range graph.Edges.Edges {
+		edges = append(edges, fmt.Sprintf("%s -> %s", e.Src, e.Dst))
+	}
+	fmt.Fprintf(w, "Residual edges (%d): %s\n", len(edges), strings.Join(edges, ", "))
+}
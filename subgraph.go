@@ -0,0 +1,91 @@
+package main
+
+import (
+	"decomp.org/x/graphs"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// expandOptional expands the given control flow primitive into one subgraph
+// per combination of present optional nodes.
+//
+// A node of a primitive is marked as optional using the "optional" attribute,
+// e.g.
+//
+//    digraph cond {
+//       A -> B
+//       A -> C
+//       B -> D
+//       C -> D
+//       A [label="entry"]
+//       B
+//       C [optional="true"]
+//       D [label="exit"]
+//    }
+//
+// Each variant of the primitive is derived by removing a subset of its optional
+// nodes, rewiring the edges of the removed nodes as described by excludeNodes.
+// The above primitive thus matches both a 2-way conditional with a body for
+// each branch (A -> B -> D and A -> C -> D) and a 2-way conditional with a
+// single body (A -> B -> D and A -> D). Absent optional nodes are omitted from
+// the node mapping of located primitives.
+//
+// The variants share the name of the primitive and are ordered by decreasing
+// size, so that the largest match is preferred when several variants would
+// match, and inherit the graph attributes of the primitive. The entry and exit
+// nodes of a primitive may not be optional.
+func expandOptional(sub *graphs.SubGraph) ([]*graphs.SubGraph, error) {
+	var optional []string
+	for _, node := range sub.Nodes.Nodes {
+		if attr(node.Attrs, "optional") != "true" {
+			continue
+		}
+		if node.Name == sub.Entry() || node.Name == sub.Exit() {
+			return nil, errutil.Newf("invalid optional node %q in primitive %q; entry and exit nodes may not be optional", node.Name, sub.Name)
+		}
+		optional = append(optional, node.Name)
+	}
+	if len(optional) == 0 {
+		return []*graphs.SubGraph{sub}, nil
+	}
+
+	// Each bit set in a mask denotes an absent optional node.
+	var masks []int
+	for n := 0; n <= len(optional); n++ {
+		for mask := 0; mask < 1<<uint(len(optional)); mask++ {
+			if bitCount(mask) == n {
+				masks = append(masks, mask)
+			}
+		}
+	}
+	var variants []*graphs.SubGraph
+	for _, mask := range masks {
+		var absent []string
+		for i, name := range optional {
+			if mask&(1<<uint(i)) != 0 {
+				absent = append(absent, name)
+			}
+		}
+		graph, err := excludeNodes(sub.Graph, absent)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+		variant, err := graphs.NewSubGraph(graph)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+		// Variants inherit the graph attributes of the primitive (e.g. its
+		// priority).
+		variant.Attrs = sub.Attrs
+		variants = append(variants, variant)
+	}
+	return variants, nil
+}
+
+// bitCount returns the number of bits set in x.
+func bitCount(x int) int {
+	n := 0
+	for ; x != 0; x &= x - 1 {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"sort"
+
+	"decomp.org/x/graphs/primitive"
+	"github.com/mewfork/dot"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// switchPrim is the name of the switch primitive.
+//
+// A switch is a dispatcher node with three or more successors, each of which is
+// either a case node, entered exclusively from the dispatcher and leading only
+// to the follow node (or to an enclosing loop, see below), or the follow node
+// itself (when no case matches and there is no default case). The follow node
+// may only be entered from within the switch. As the number of cases varies,
+// switches may not be described by a primitive template. Instead, they are
+// located once no primitive template may be located, after dispatches (see
+// dispatchPrim) and before binary search tree switches (see findBSTSwitch),
+// multi-exit loops and jump tables.
+//
+// The default case is distinguished from the explicit cases as follows:
+//
+//    1. A case node is the default case if the edge from the dispatcher is
+//       labeled "default", e.g. D -> C [label="default"].
+//    2. Otherwise, if the only predecessor of the dispatcher is a range check
+//       with two successors, the dispatcher and a case node, the case node is
+//       the default case; i.e. the target reached both when the value is out of
+//       range and through the holes of the dispatch. The range check is then
+//       part of the switch.
+//
+// The nodes of the switch, including its follow node, are merged into a single
+// node. In the node mapping of the primitive, the range check (if any), the
+// dispatcher, the explicit cases (in successor order) and the follow node are
+// mapped to "A", "B", "C", etc., and the default case (if any) to "default".
+//
+// Within a loop, a case may also end with an edge to the header of an
+// enclosing loop (a continue) or out of it (a break of the loop, e.g. by goto),
+// rather than to the follow node. As switches are reduced before the loops
+// enclosing them, the loops of the graph at the time of the match are those
+// enclosing the switch. An edge to the header of an enclosing loop is a
+// continue of that loop, even when it leaves an inner loop; e.g. a continue of
+// an outer loop from within an inner loop. Any other edge is attributed to the
+// nearest enclosing loop for which its target is outside of the loop. The edges
+// ending each case are recorded in Breaks, as attributed to the switch or to a
+// loop.
+const switchPrim = "switch"
+
+// Constructs targeted by the edge ending a case of a switch.
+const (
+	// The edge leads to the follow node of the switch.
+	breakSwitch = "switch"
+	// The edge leads to the header of an enclosing loop, or out of it.
+	breakLoop = "loop"
+)
+
+// Kinds of the edge ending a case of a switch.
+const (
+	// The edge leads to the follow node of the switch, or out of a loop.
+	kindBreak = "break"
+	// The edge leads to the header of an enclosing loop.
+	kindContinue = "continue"
+)
+
+// A Break is an edge ending a case of a switch, as attributed to the construct
+// it breaks out of (or continues).
+type Break struct {
+	// Role of the case node.
+	Case string `json:"case"`
+	// Edge from the case node to the target of the break.
+	Edge [2]string `json:"edge"`
+	// Construct targeted by the break; "switch" or "loop".
+	Target string `json:"target"`
+	// Kind of the break; "break" or "continue".
+	Kind string `json:"kind"`
+	// Header of the loop targeted by the break, if any.
+	Loop string `json:"loop,omitempty"`
+}
+
+// minSwitchSuccs specifies the minimum number of successors of the dispatcher
+// of a switch; a node with two successors is a 2-way conditional.
+const minSwitchSuccs = 3
+
+// A switchMatch is a located switch.
+type switchMatch struct {
+	// Range check, or nil.
+	rangeCheck *dot.Node
+	// Dispatcher.
+	dispatcher *dot.Node
+	// Explicit cases, in successor order.
+	cases []*dot.Node
+	// Default case, or nil.
+	dflt *dot.Node
+	// Follow node.
+	follow *dot.Node
+	// jumps maps from the targets of the edges of cases leading to an
+	// enclosing loop to the jump.
+	jumps map[*dot.Node]loopJump
+}
+
+// findSwitch locates the first switch of graph, in node order, and merges its
+// nodes into a single node. It returns nil if graph contains no switch.
+func findSwitch(graph *dot.Graph, labels edgeLabels) (*Primitive, error) {
+	lj := &loopJumps{graph: graph}
+	for _, node := range graph.Nodes.Nodes {
+		s, ok := matchSwitch(node, labels, lj)
+		if !ok {
+			continue
+		}
+		m := make(map[string]string)
+		var names []string
+		add := func(role string, n *dot.Node) {
+			m[role] = n.Name
+			names = append(names, n.Name)
+		}
+		entry := s.dispatcher
+		if s.rangeCheck != nil {
+			entry = s.rangeCheck
+			add(role(len(m)), s.rangeCheck)
+		}
+		add(role(len(m)), s.dispatcher)
+		for _, c := range s.cases {
+			add(role(len(m)), c)
+		}
+		add(role(len(m)), s.follow)
+		if s.dflt != nil {
+			add("default", s.dflt)
+		}
+		breaks := s.breaks(m)
+		sets := parallelLabels(m, labels)
+		name, err := mergeRegion(graph, names, switchPrim)
+		if err != nil {
+			return nil, errutil.Err(err)
+		}
+		labels.merge(m, name)
+		prim := &Primitive{
+			Primitive: &primitive.Primitive{
+				Node:  name,
+				Prim:  switchPrim,
+				Nodes: m,
+			},
+			Labels: sets,
+			Breaks: breaks,
+			entry:  entry.Name,
+			exit:   s.follow.Name,
+		}
+		return prim, nil
+	}
+	return nil, nil
+}
+
+// breaks returns the edges ending the cases of the switch, in case order and
+// with the default case last, given the node mapping m of the switch.
+func (s *switchMatch) breaks(m map[string]string) []*Break {
+	roles := make(map[string]string)
+	for r, name := range m {
+		roles[name] = r
+	}
+	cases := s.cases
+	if s.dflt != nil {
+		cases = append(cases[:len(cases):len(cases)], s.dflt)
+	}
+	var breaks []*Break
+	for _, c := range cases {
+		for _, succ := range c.Succs {
+			b := &Break{Case: roles[c.Name], Edge: [2]string{c.Name, succ.Name}, Target: breakSwitch, Kind: kindBreak}
+			if succ != s.follow {
+				j := s.jumps[succ]
+				b.Target, b.Kind, b.Loop = breakLoop, j.kind, j.header
+			}
+			breaks = append(breaks, b)
+		}
+	}
+	return breaks
+}
+
+// matchSwitch reports whether d is the dispatcher of a switch, and returns the
+// located switch if so. The jumps out of the loops enclosing d are tracked by
+// lj.
+func matchSwitch(d *dot.Node, labels edgeLabels, lj *loopJumps) (*switchMatch, bool) {
+	if len(d.Succs) < minSwitchSuccs || isIndirect(d) {
+		// The dispatcher of a switch is a conditional, not an indirect jump.
+		return nil, false
+	}
+	// Candidate follow nodes; the successor of a case node, or a successor of
+	// the dispatcher.
+	for _, succ := range d.Succs {
+		follow := succ
+		if len(succ.Succs) == 1 {
+			follow = succ.Succs[0]
+		}
+		if s, ok := matchSwitchFollow(d, follow, labels, lj); ok {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// matchSwitchFollow reports whether d is the dispatcher of a switch with the
+// given follow node, and returns the located switch if so.
+func matchSwitchFollow(d, follow *dot.Node, labels edgeLabels, lj *loopJumps) (*switchMatch, bool) {
+	if follow == d || isEntry(follow) {
+		return nil, false
+	}
+	s := &switchMatch{dispatcher: d, follow: follow, jumps: make(map[*dot.Node]loopJump)}
+
+	// Locate the range check of the default case.
+	var rangeDefault *dot.Node
+	if len(d.Preds) == 1 {
+		r := d.Preds[0]
+		if r != d && r != follow && len(r.Succs) == 2 {
+			x := r.Succs[0]
+			if x == d {
+				x = r.Succs[1]
+			}
+			if x != d && x != follow && len(x.Preds) == 2 {
+				s.rangeCheck, rangeDefault = r, x
+			}
+		}
+	}
+
+	region := map[*dot.Node]bool{d: true, follow: true}
+	for _, c := range d.Succs {
+		if c == follow {
+			continue
+		}
+		if c == d || isEntry(c) || len(c.Succs) == 0 {
+			return nil, false
+		}
+		for _, succ := range c.Succs {
+			if succ == follow {
+				continue
+			}
+			// Jump to an enclosing loop.
+			j, ok := lj.targets(d)[succ]
+			if !ok {
+				return nil, false
+			}
+			s.jumps[succ] = j
+		}
+		switch {
+		case len(c.Preds) == 1:
+			// Entered exclusively from the dispatcher.
+		case c == rangeDefault:
+			// Entered from the dispatcher and the range check.
+		default:
+			return nil, false
+		}
+		region[c] = true
+		if labels.has([2]string{d.Name, c.Name}, "default") && s.dflt == nil {
+			s.dflt = c
+			continue
+		}
+		s.cases = append(s.cases, c)
+	}
+	if rangeDefault != nil && !region[rangeDefault] {
+		// The other successor of the predecessor is not a case; not a range
+		// check.
+		s.rangeCheck, rangeDefault = nil, nil
+	}
+	if rangeDefault != nil {
+		if s.dflt != nil && s.dflt != rangeDefault {
+			// Conflicting default cases; not a range check.
+			return nil, false
+		}
+		region[s.rangeCheck] = true
+		if s.dflt == nil {
+			s.dflt = rangeDefault
+			for i, c := range s.cases {
+				if c == rangeDefault {
+					s.cases = append(s.cases[:i], s.cases[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+
+	// The follow node may only be entered from within the switch.
+	for _, pred := range follow.Preds {
+		if !region[pred] {
+			return nil, false
+		}
+	}
+	// Jumps to enclosing loops leave the switch.
+	for target := range s.jumps {
+		if region[target] {
+			return nil, false
+		}
+	}
+	return s, true
+}
+
+// loopJumps tracks the targets of the jumps to the loops of a control flow
+// graph enclosing the dispatchers of switches. The natural loops of the graph
+// are computed on first use.
+type loopJumps struct {
+	// Control flow graph.
+	graph *dot.Graph
+	// Natural loops of the graph, sorted by decreasing number of nodes.
+	loops []*loop
+	// Set to true once the natural loops have been computed.
+	done bool
+	// cache maps from dispatcher to the targets of the jumps of its enclosing
+	// loops.
+	cache map[*dot.Node]map[*dot.Node]loopJump
+}
+
+// A loopJump is a jump to a loop enclosing the dispatcher of a switch.
+type loopJump struct {
+	// Kind of the jump; a continue to the header of the loop, or a break to a
+	// node outside of it.
+	kind string
+	// Header of the loop.
+	header string
+}
+
+// targets returns the targets of the jumps to the loops enclosing the node d,
+// mapped to the jump; a continue for the header of a loop, or a break for a
+// node outside of it. The header of a loop is attributed to that loop, and any
+// other target to the nearest enclosing loop which it is outside of.
+func (lj *loopJumps) targets(d *dot.Node) map[*dot.Node]loopJump {
+	if !lj.done {
+		lj.done = true
+		if entry, err := entryNode(lj.graph); err == nil {
+			lj.loops = naturalLoops(lj.graph, entry)
+			sort.Stable(loopsBySize(lj.loops))
+		}
+		lj.cache = make(map[*dot.Node]map[*dot.Node]loopJump)
+	}
+	if targets, ok := lj.cache[d]; ok {
+		return targets
+	}
+	targets := make(map[*dot.Node]loopJump)
+	// Iterate from the outermost loop, so that the breaks of inner loops take
+	// precedence, except over the continues of outer loops; the header of an
+	// outer loop is outside of the inner loops.
+	for _, l := range lj.loops {
+		if !l.nodes[d.Name] {
+			continue
+		}
+		for _, e := range regionExits(lj.graph, l.nodes) {
+			target := lj.graph.Nodes.Lookup[e[1]]
+			if targets[target].kind == kindContinue {
+				continue
+			}
+			targets[target] = loopJump{kind: kindBreak, header: l.header}
+		}
+		targets[lj.graph.Nodes.Lookup[l.header]] = loopJump{kind: kindContinue, header: l.header}
+	}
+	lj.cache[d] = targets
+	return targets
+}
+
+// loopsBySize implements sort.Interface, sorting loops by decreasing number of
+// nodes.
+type loopsBySize []*loop
+
+func (ls loopsBySize) Len() int           { return len(ls) }
+func (ls loopsBySize) Less(i, j int) bool { return len(ls[i].nodes) > len(ls[j].nodes) }
+func (ls loopsBySize) Swap(i, j int)      { ls[i], ls[j] = ls[j], ls[i] }
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mewfork/dot"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// A GraphTransform rewrites a control flow graph in place, before it is
+// restructured. Transforms may add synthetic nodes to the graph, which then
+// appear in the located control flow primitives like any other node.
+type GraphTransform func(graph *dot.Graph) error
+
+// transforms specifies the graph transforms applied by restructure to the
+// parsed control flow graph, in order, before the reduction.
+var transforms []GraphTransform
+
+// builtinTransforms maps from name to built-in graph transform, as enabled by
+// the "-transform" flag.
+var builtinTransforms = map[string]GraphTransform{
+	"split-shared-headers": splitSharedHeaders,
+}
+
+// parseTransforms returns the built-in graph transforms of the given
+// comma-separated list of names.
+func parseTransforms(s string) ([]GraphTransform, error) {
+	var ts []GraphTransform
+	for _, name := range strings.Split(s, ",") {
+		t, ok := builtinTransforms[name]
+		if !ok {
+			var names []string
+			for name := range builtinTransforms {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, errutil.Newf("unknown graph transform %q; valid transforms are %q", name, names)
+		}
+		ts = append(ts, t)
+	}
+	return ts, nil
+}
+
+// splitSharedHeaders makes irreducible loops reducible by node splitting.
+//
+// A loop (i.e. a cyclic strongly connected component) is irreducible if it has
+// more than one entry node. All but one entry node of such a loop are split;
+// the entry node of the graph is kept if part of the loop, and otherwise the
+// first entry node in the node order of the graph. Each split entry node n is
+// copied into a synthetic node named "n_splitN" (for the lowest unused N),
+// with the same attributes, successors and edge attributes as n, and the edges
+// into n from outside of the loop are redirected to the copy. The copy is not
+// part of the loop, but its successors may now be additional entry nodes; the
+// process is therefore repeated until every loop has a single entry node.
+// Since node splitting may grow the graph exponentially in the worst case, an
+// error is returned after maxSplits splits per node of the original graph.
+func splitSharedHeaders(graph *dot.Graph) error {
+	limit := maxSplits * len(graph.Nodes.Nodes)
+	for i := 0; ; i++ {
+		if i >= limit {
+			return errutil.Newf("unable to split shared loop headers of graph %q; split limit of %d reached", graph.Name, limit)
+		}
+		split, err := splitSharedHeader(graph)
+		if err != nil {
+			return errutil.Err(err)
+		}
+		if !split {
+			return nil
+		}
+	}
+}
+
+// maxSplits specifies the maximum number of irreducible loops split by
+// splitSharedHeaders per node of the original graph.
+const maxSplits = 8
+
+// splitSharedHeader splits the entry nodes of the first irreducible loop of
+// graph, as described by splitSharedHeaders, and reports whether any loop was
+// split.
+func splitSharedHeader(graph *dot.Graph) (bool, error) {
+	for _, comp := range sccs(graph) {
+		if !isCyclic(comp) {
+			continue
+		}
+		entries := sccEntries(comp)
+		if len(entries) < 2 {
+			continue
+		}
+		// Keep the entry node of the graph, or otherwise the first entry node
+		// in graph order, and split the others.
+		pos := make(map[*dot.Node]int)
+		for i, node := range graph.Nodes.Nodes {
+			pos[node] = i
+			if isEntry(node) {
+				pos[node] = -1
+			}
+		}
+		sort.Sort(nodesByPos{nodes: entries, pos: pos})
+		in := make(map[string]bool)
+		for _, n := range comp {
+			in[n.Name] = true
+		}
+		nodes := append([]*dot.Node(nil), graph.Nodes.Nodes...)
+		var edges []*dot.Edge
+		// copies maps from split entry node name to the name of its copy.
+		copies := make(map[string]string)
+		for _, entry := range entries[1:] {
+			name := uniqueName(graph, entry.Name+"_split")
+			copies[entry.Name] = name
+			nodes = append(nodes, &dot.Node{Name: name, Attrs: entry.Attrs})
+		}
+		for _, e := range graph.Edges.Edges {
+			if c, ok := copies[e.Dst]; ok && !in[e.Src] {
+				edges = append(edges, &dot.Edge{Src: e.Src, Dst: c, Attrs: e.Attrs})
+				continue
+			}
+			edges = append(edges, e)
+		}
+		for _, e := range graph.Edges.Edges {
+			if c, ok := copies[e.Src]; ok {
+				edges = append(edges, &dot.Edge{Src: c, Dst: e.Dst, Attrs: e.Attrs})
+			}
+		}
+		g, err := newGraph(graph.Name, nodes, edges)
+		if err != nil {
+			return false, errutil.Err(err)
+		}
+		*graph = *g
+		return true, nil
+	}
+	return false, nil
+}
+
+// uniqueName returns the first name of the form "prefixN" (for N = 1, 2, ...)
+// which is not used by any node of graph.
+func uniqueName(graph *dot.Graph, prefix string) string {
+	for i := 1; ; i++ {
+		name := fmt.Sprintf("%s%d", prefix, i)
+		if !nameTaken(graph, name) {
+			return name
+		}
+	}
+}
+
+// nodesByPos implements sort.Interface, sorting nodes by position.
+type nodesByPos struct {
+	nodes []*dot.Node
+	pos   map[*dot.Node]int
+}
+
+func (ns nodesByPos) Len() int           { return len(ns.nodes) }
+func (ns nodesByPos) Less(i, j int) bool { return ns.pos[ns.nodes[i]] < ns.pos[ns.nodes[j]] }
+func (ns nodesByPos) Swap(i, j int)      { ns.nodes[i], ns.nodes[j] = ns.nodes[j], ns.nodes[i] }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// A primNode is a node of the primitive tree of a control flow graph; i.e. a
+// located control flow primitive and the primitives nested within it.
+type primNode struct {
+	// Control flow primitive.
+	prim *Primitive
+	// Index of the primitive, in the order located.
+	index int
+	// children maps from node role to the primitive nested at the role; roles
+	// mapped to nodes of the original control flow graph are absent.
+	children map[string]*primNode
+	// Primitive in which the primitive is nested, or nil for a root primitive.
+	parent *primNode
+	// Nesting depth of the primitive tree rooted at the primitive; 1 for a
+	// primitive without nested primitives.
+	height int
+}
+
+// primTree resolves the super-node references of the given control flow
+// primitives into parent/child relationships, and returns one primitive tree
+// node per primitive, in the same order. A role of a primitive is resolved to
+// a nested primitive if it is mapped to the super-node of a primitive located
+// earlier.
+//
+// The primitives are expected to be ordered as located by restructure, so that
+// each super-node is defined before it is referenced.
+func primTree(prims []*Primitive) []*primNode {
+	nodes := make([]*primNode, len(prims))
+	// defs maps from super-node name to the tree node of its primitive.
+	defs := make(map[string]*primNode)
+	for i, prim := range prims {
+		n := &primNode{prim: prim, index: i, children: make(map[string]*primNode), height: 1}
+		for role, name := range prim.Nodes {
+			if child, ok := defs[name]; ok {
+				n.children[role] = child
+				child.parent = n
+				if child.height >= n.height {
+					n.height = child.height + 1
+				}
+			}
+		}
+		nodes[i] = n
+		defs[prim.Node] = n
+	}
+	return nodes
+}
+
+// checkDepth validates that the given primitive tree nodes, as returned by
+// primTree, are nested no deeper than permitted by the "-max-depth" flag. As the
+// height of each node is computed iteratively by primTree, it guards the
+// recursive traversals of primitive trees against stack exhaustion on
+// pathologically deep nestings (e.g. of machine-generated control flow graphs).
+func checkDepth(nodes []*primNode) error {
+	if flagMaxDepth <= 0 {
+		return nil
+	}
+	for _, n := range nodes {
+		if n.height > flagMaxDepth {
+			return &Error{Kind: KindDepth, Msg: fmt.Sprintf("primitive tree of %q nested %d levels deep; exceeds maximum depth %d (see -max-depth)", n.prim.Node, n.height, flagMaxDepth)}
+		}
+	}
+	return nil
+}
+
+// roles returns the node roles of the primitive, in sorted order.
+func (n *primNode) roles() []string {
+	var roles []string
+	for role := range n.prim.Nodes {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// id returns the DOT node ID of the primitive, which is unique within the
+// primitive tree.
+func (n *primNode) id() string {
+	return fmt.Sprintf("prim%d", n.index)
+}
+
+// writePrimTreeDOT writes the primitive tree of the given control flow
+// primitives to w, in Graphviz DOT format. Each primitive is written as a node
+// labeled with its type and super-node name, and each nested primitive as an
+// edge from its parent, labeled with the role of the nested primitive within
+// the parent. As super-node names may be reused by later primitives (e.g. of
+// nested loops), the nodes are identified by primitive index.
+func writePrimTreeDOT(w io.Writer, prims []*Primitive) error {
+	nodes := primTree(prims)
+	if err := checkDepth(nodes); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(w, "digraph prims {"); err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		label := fmt.Sprintf("%s\n%s", n.prim.Prim, n.prim.Node)
+		if _, err := fmt.Fprintf(w, "\t%s [label=%q]\n", n.id(), label); err != nil {
+			return err
+		}
+	}
+	for _, n := range nodes {
+		for _, role := range n.roles() {
+			child, ok := n.children[role]
+			if !ok {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "\t%s -> %s [label=%q]\n", n.id(), child.id(), role); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sort"
+
+	"decomp.org/x/graphs"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// tune restructures each of the given control flow graphs, counting the number
+// of times each primitive of subs is located, and returns the names of the
+// primitives ordered by decreasing match frequency. Primitives with equal
+// match frequencies keep their relative order in subs. The returned order may
+// be fed back to restructure using the "-order" flag, so that common
+// primitives are searched for first.
+//
+// Control flow graphs which may not be restructured are skipped with a
+// warning.
+func tune(dotPaths []string) []string {
+	counts := make(map[string]int)
+	for _, dotPath := range dotPaths {
+		prims, err := restructure(dotPath)
+		if err != nil {
+			warnf("tune-skip", nil, "skipping %q; %v", dotPath, err)
+			continue
+		}
+		for _, prim := range prims {
+			counts[prim.Prim]++
+		}
+	}
+	names := primNames(subs)
+	sort.Stable(byFrequency{names: names, counts: counts})
+	return names
+}
+
+// byFrequency implements sort.Interface, sorting primitive names by decreasing
+// match frequency.
+type byFrequency struct {
+	names  []string
+	counts map[string]int
+}
+
+func (b byFrequency) Len() int           { return len(b.names) }
+func (b byFrequency) Less(i, j int) bool { return b.counts[b.names[i]] > b.counts[b.names[j]] }
+func (b byFrequency) Swap(i, j int)      { b.names[i], b.names[j] = b.names[j], b.names[i] }
+
+// primNames returns the distinct names of the given primitives, in order of
+// first occurrence. Variants of a primitive share its name.
+func primNames(set []*graphs.SubGraph) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, sub := range set {
+		if !seen[sub.Name] {
+			seen[sub.Name] = true
+			names = append(names, sub.Name)
+		}
+	}
+	return names
+}
+
+// reorder returns the primitives of set, where the primitives with the given
+// names are moved to the front in the specified order. The remaining
+// primitives follow in their original order, and variants of a primitive keep
+// their relative order.
+func reorder(set []*graphs.SubGraph, names []string) ([]*graphs.SubGraph, error) {
+	known := make(map[string]bool)
+	for _, name := range primNames(set) {
+		known[name] = true
+	}
+	var ordered []*graphs.SubGraph
+	moved := make(map[string]bool)
+	for _, name := range names {
+		if !known[name] {
+			return nil, errutil.Newf("unable to reorder primitive %q; no such primitive", name)
+		}
+		if moved[name] {
+			continue
+		}
+		moved[name] = true
+		for _, sub := range set {
+			if sub.Name == name {
+				ordered = append(ordered, sub)
+			}
+		}
+	}
+	for _, sub := range set {
+		if !moved[sub.Name] {
+			ordered = append(ordered, sub)
+		}
+	}
+	return ordered, nil
+}
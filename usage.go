@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// A primUsage is a usage report of the primitive set over a corpus of control
+// flow graphs, as requested by the "-usage" flag.
+type primUsage struct {
+	// Number of control flow graphs restructured, including stalled
+	// reductions.
+	Graphs int `json:"graphs"`
+	// Number of control flow graphs which could not be restructured at all
+	// (e.g. as they could not be parsed).
+	Failed int `json:"failed"`
+	// Number of times each primitive of subs was located, by primitive name.
+	Counts map[string]int `json:"counts"`
+	// Names of the primitives of subs which were never located, in order of
+	// priority; candidates for pruning from the primitive set.
+	Unused []string `json:"unused"`
+}
+
+// primitiveUsage restructures each of the given control flow graphs, counting
+// the number of times each primitive of subs is located, and returns the usage
+// report of the primitive set. Primitives located before a stalled reduction
+// are counted, while control flow graphs which may not be restructured at all
+// are skipped with a warning. Variants of a primitive are counted towards the
+// primitive; primitives located without a template (e.g. switches) are not
+// part of subs, and are not reported.
+func primitiveUsage(dotPaths []string) *primUsage {
+	u := &primUsage{Counts: make(map[string]int), Unused: []string{}}
+	names := primNames(subs)
+	for _, name := range names {
+		u.Counts[name] = 0
+	}
+	// Count the primitives as they are located, so that stalled reductions
+	// are accounted for.
+	defer func(old func(step, remaining int, prim *Primitive)) { Progress = old }(Progress)
+	prev := Progress
+	Progress = func(step, remaining int, prim *Primitive) {
+		if _, ok := u.Counts[prim.Prim]; ok {
+			u.Counts[prim.Prim]++
+		}
+		if prev != nil {
+			prev(step, remaining, prim)
+		}
+	}
+	for _, dotPath := range dotPaths {
+		_, err := restructure(dotPath)
+		if stats == nil {
+			warnf("usage-skip", nil, "skipping %q; %v", dotPath, err)
+			u.Failed++
+			continue
+		}
+		u.Graphs++
+	}
+	for _, name := range names {
+		if u.Counts[name] == 0 {
+			u.Unused = append(u.Unused, name)
+		}
+	}
+	return u
+}
+
+// writeUsage writes the given usage report as JSON to w.
+func writeUsage(w io.Writer, u *primUsage) error {
+	buf, err := json.MarshalIndent(u, "", "\t")
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	_, err = w.Write(buf)
+	return err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// verifyPrims validates that the references among the given control flow
+// primitives are acyclic, and returns an error identifying the first cycle
+// found otherwise.
+//
+// A node of a primitive references the primitive whose super-node has the same
+// name. As super-node names may be reused once merged, a reference resolves to
+// the most recent preceding primitive with the given super-node name, and
+// otherwise to the first succeeding one. Primitives located by restructure only
+// reference preceding primitives, and are thus always acyclic; a forward
+// reference indicates a malformed list of primitives, which may form a cycle
+// that would hang consumers resolving the primitive tree.
+func verifyPrims(prims []*Primitive) error {
+	// defs maps from super-node name to the indices of its primitives, in
+	// increasing order.
+	defs := make(map[string][]int)
+	for i, prim := range prims {
+		defs[prim.Node] = append(defs[prim.Node], i)
+	}
+	// resolve returns the index of the primitive referenced by the node name
+	// of the i:th primitive.
+	resolve := func(i int, name string) (int, bool) {
+		ds := defs[name]
+		for k := len(ds) - 1; k >= 0; k-- {
+			if ds[k] < i {
+				return ds[k], true
+			}
+		}
+		for _, d := range ds {
+			if d > i {
+				return d, true
+			}
+		}
+		return 0, false
+	}
+
+	// Detect cycles by depth-first search; color 1 denotes an index on the
+	// current path and color 2 a completed index.
+	color := make([]int, len(prims))
+	var path []int
+	var visit func(i int) []int
+	visit = func(i int) []int {
+		color[i] = 1
+		path = append(path, i)
+		var roles []string
+		for role := range prims[i].Nodes {
+			roles = append(roles, role)
+		}
+		sort.Strings(roles)
+		for _, role := range roles {
+			j, ok := resolve(i, prims[i].Nodes[role])
+			if !ok {
+				continue
+			}
+			switch color[j] {
+			case 1:
+				// Cycle from j back to j.
+				for k, p := range path {
+					if p == j {
+						return append(append([]int(nil), path[k:]...), j)
+					}
+				}
+			case 0:
+				if cycle := visit(j); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		color[i] = 2
+		return nil
+	}
+	for i := range prims {
+		if color[i] != 0 {
+			continue
+		}
+		if cycle := visit(i); cycle != nil {
+			var names []string
+			for _, j := range cycle {
+				names = append(names, prims[j].Node)
+			}
+			return errutil.Newf("cycle among primitive references: %s", strings.Join(names, " -> "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"decomp.org/x/graphs"
+	"github.com/mewfork/dot"
+	"github.com/mewkiz/pkg/errutil"
+)
+
+// A node of a primitive is marked as a wildcard using the "repeat" attribute,
+// e.g.
+//
+//    digraph cases {
+//       A -> B
+//       B -> C
+//       A [label="entry"]
+//       B [repeat="true"]
+//       C [label="exit"]
+//    }
+//
+// A wildcard node matches one or more nodes of the control flow graph, each of
+// which has the predecessors and successors of the wildcard node. The above
+// primitive thus matches a conditional dispatching to any number of cases, all
+// of which continue at a common follow node. The copies of a wildcard node are
+// mapped to the roles of the wildcard node suffixed by 1, 2, etc (e.g. "B",
+// "B1", "B2"), in the node order of the control flow graph. The largest match
+// is preferred. The entry and exit nodes of a primitive may not be wildcards.
+
+// wildcardAfter is the name of the internal node attribute of a copy of a
+// wildcard node, which specifies the role of the preceding copy. A copy is only
+// mapped to a node after the node of the preceding copy in the node order of
+// the control flow graph, which avoids trying every permutation of the copies.
+const wildcardAfter = "wildcard_after"
+
+// isWildcard reports whether the given node of a primitive is a wildcard.
+func isWildcard(node *dot.Node) bool {
+	return attr(node.Attrs, "repeat") == "true"
+}
+
+// wildcards returns the names of the wildcard nodes of the given primitive.
+func wildcards(sub *graphs.SubGraph) []string {
+	var names []string
+	for _, node := range sub.Nodes.Nodes {
+		if isWildcard(node) {
+			names = append(names, node.Name)
+		}
+	}
+	return names
+}
+
+// checkWildcards validates the wildcard nodes of the given primitive.
+func checkWildcards(sub *graphs.SubGraph) error {
+	for _, name := range wildcards(sub) {
+		if name == sub.Entry() || name == sub.Exit() {
+			return errutil.Newf("invalid wildcard node %q in primitive %q; entry and exit nodes may not be wildcards", name, sub.Name)
+		}
+	}
+	return nil
+}
+
+// searchWildcards locates an isomorphism of the primitive sub, which contains
+// wildcard nodes, in graph. The number of copies of each wildcard node is
+// bounded by wildcardBounds, and larger numbers of copies are tried first. The
+// expanded primitive of the located isomorphism is returned, the nodes of which
+// are the roles of the node mapping.
+func searchWildcards(graph *dot.Graph, sub *graphs.SubGraph, labels edgeLabels) (map[string]string, *graphs.SubGraph, bool) {
+	names := wildcards(sub)
+	bounds := wildcardBounds(graph, sub, names)
+	// Each copy is mapped to a distinct node of graph.
+	maxTotal := len(graph.Nodes.Nodes) - len(sub.Nodes.Nodes) + len(names)
+	for _, counts := range wildcardCounts(bounds, maxTotal) {
+		expanded := expansion(sub, names, counts)
+		if expanded == nil {
+			continue
+		}
+		if m, ok := search(graph, expanded, labels); ok {
+			return m, expanded, true
+		}
+	}
+	return nil, nil, false
+}
+
+// wildcardBounds returns the maximum number of copies of each of the given
+// wildcard nodes of the primitive sub in graph. The copies of a wildcard node
+// share the successors of each of its predecessors in sub, so their number is
+// bounded by the maximum out-degree of graph, less the other successors;
+// likewise for the in-degree and the successors of the wildcard node.
+func wildcardBounds(graph *dot.Graph, sub *graphs.SubGraph, names []string) []int {
+	maxSuccs, maxPreds := 0, 0
+	for _, node := range graph.Nodes.Nodes {
+		if len(node.Succs) > maxSuccs {
+			maxSuccs = len(node.Succs)
+		}
+		if len(node.Preds) > maxPreds {
+			maxPreds = len(node.Preds)
+		}
+	}
+	bounds := make([]int, len(names))
+	for i, name := range names {
+		bound := len(graph.Nodes.Nodes) - len(sub.Nodes.Nodes) + 1
+		node := sub.Nodes.Lookup[name]
+		for _, pred := range node.Preds {
+			if pred.Name == name {
+				continue
+			}
+			if b := maxSuccs - len(pred.Succs) + 1; b < bound {
+				bound = b
+			}
+		}
+		for _, succ := range node.Succs {
+			if succ.Name == name {
+				continue
+			}
+			if b := maxPreds - len(succ.Preds) + 1; b < bound {
+				bound = b
+			}
+		}
+		bounds[i] = bound
+	}
+	return bounds
+}
+
+// wildcardCounts returns every combination of the number of copies of the
+// wildcard nodes, from 1 to the given bound copies each and at most maxTotal
+// copies in total, ordered by decreasing total. No combination is returned if
+// a bound is less than 1.
+func wildcardCounts(bounds []int, maxTotal int) [][]int {
+	var combos [][]int
+	var visit func(combo []int, sum int)
+	visit = func(combo []int, sum int) {
+		if len(combo) == len(bounds) {
+			combos = append(combos, append([]int(nil), combo...))
+			return
+		}
+		// Each remaining wildcard node has at least one copy.
+		rest := len(bounds) - len(combo) - 1
+		for c := bounds[len(combo)]; c >= 1; c-- {
+			if sum+c+rest > maxTotal {
+				continue
+			}
+			visit(append(combo, c), sum+c)
+		}
+	}
+	visit(nil, 0)
+	sort.Stable(byTotal(combos))
+	return combos
+}
+
+// byTotal implements sort.Interface, sorting combinations by decreasing total.
+type byTotal [][]int
+
+func (cs byTotal) Len() int           { return len(cs) }
+func (cs byTotal) Less(i, j int) bool { return total(cs[i]) > total(cs[j]) }
+func (cs byTotal) Swap(i, j int)      { cs[i], cs[j] = cs[j], cs[i] }
+
+// total returns the sum of xs.
+func total(xs []int) int {
+	sum := 0
+	for _, x := range xs {
+		sum += x
+	}
+	return sum
+}
+
+// expansionKey identifies an expanded primitive, by primitive and number of
+// copies of its wildcard nodes.
+type expansionKey struct {
+	sub    *graphs.SubGraph
+	counts string
+}
+
+// expansions maps from expansion key to expanded primitive, or to nil if the
+// primitive may not be expanded. The expanded primitives are shared by the
+// reduction steps, as they only depend on the primitive.
+var expansions = make(map[expansionKey]*graphs.SubGraph)
+
+// expansion returns the primitive sub, in which each of the given wildcard
+// nodes is repeated the given number of times, as described by
+// expandWildcards, or nil if the primitive may not be expanded.
+func expansion(sub *graphs.SubGraph, names []string, counts []int) *graphs.SubGraph {
+	key := expansionKey{sub: sub, counts: fmt.Sprint(counts)}
+	if expanded, ok := expansions[key]; ok {
+		return expanded
+	}
+	expanded, err := expandWildcards(sub, names, counts)
+	if err != nil {
+		expanded = nil
+	}
+	expansions[key] = expanded
+	return expanded
+}
+
+// expandWildcards returns a copy of the primitive sub, in which each of the
+// given wildcard nodes is repeated the given number of times. Edges incident
+// to a wildcard node are repeated for each copy.
+func expandWildcards(sub *graphs.SubGraph, names []string, counts []int) (*graphs.SubGraph, error) {
+	// roles maps from wildcard node name to the roles of its copies, including
+	// the wildcard node itself.
+	roles := make(map[string][]string)
+	for i, name := range names {
+		roles[name] = []string{name}
+		for j := 1; j < counts[i]; j++ {
+			role := fmt.Sprintf("%s%d", name, j)
+			if _, ok := sub.Nodes.Lookup[role]; ok {
+				return nil, errutil.Newf("invalid wildcard node %q in primitive %q; role %q of copy already in use", name, sub.Name, role)
+			}
+			roles[name] = append(roles[name], role)
+		}
+	}
+	copiesOf := func(name string) []string {
+		if rs, ok := roles[name]; ok {
+			return rs
+		}
+		return []string{name}
+	}
+	var nodes []*dot.Node
+	for _, node := range sub.Nodes.Nodes {
+		rs := copiesOf(node.Name)
+		for i, role := range rs {
+			attrs := make(dot.Attrs)
+			for key, val := range node.Attrs {
+				attrs[key] = val
+			}
+			if i > 0 {
+				attrs[wildcardAfter] = rs[i-1]
+			}
+			nodes = append(nodes, &dot.Node{Name: role, Attrs: attrs})
+		}
+	}
+	var edges []*dot.Edge
+	for _, e := range sub.Edges.Edges {
+		if e.Src == e.Dst {
+			for _, role := range copiesOf(e.Src) {
+				edges = append(edges, &dot.Edge{Src: role, Dst: role, Attrs: e.Attrs})
+			}
+			continue
+		}
+		for _, src := range copiesOf(e.Src) {
+			for _, dst := range copiesOf(e.Dst) {
+				edges = append(edges, &dot.Edge{Src: src, Dst: dst, Attrs: e.Attrs})
+			}
+		}
+	}
+	graph, err := newGraph(sub.Name, nodes, edges)
+	if err != nil {
+		return nil, errutil.Err(err)
+	}
+	return graphs.NewSubGraph(graph)
+}